@@ -0,0 +1,73 @@
+package operadatatypes
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Reads back the records of a .raw file, i.e. the concatenated contents of
+// BinaryFileWriteJobs, each starting with its OUTPUT_FILE_RAW_TYPE_INDICATOR.
+// Compressed (.raw.gz) archives are read transparently.
+type RawArchiveReader struct {
+	r   *bufio.Reader
+	n   int
+	err error
+}
+
+func NewRawArchiveReader(r io.Reader) *RawArchiveReader {
+	br := bufio.NewReader(r)
+	zr, err := maybeGunzip(br)
+	if err != nil {
+		return &RawArchiveReader{r: br, err: err}
+	}
+	if zr != io.Reader(br) {
+		br = bufio.NewReader(zr)
+	}
+	return &RawArchiveReader{r: br}
+}
+
+// Returns the next record as a *PrimaryData, *SecondaryData or *OperaData, or
+// io.EOF once the archive ends cleanly on a record boundary.
+func (a *RawArchiveReader) Next() (OutputData, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	indicator, err := a.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	var d OutputData
+	switch indicator {
+	case OUTPUT_FILE_RAW_TYPE_INDICATOR_PRIMARY:
+		d = &PrimaryData{}
+	case OUTPUT_FILE_RAW_TYPE_INDICATOR_SECONDARY:
+		d = &SecondaryData{}
+	case OUTPUT_FILE_RAW_TYPE_INDICATOR_OPERA_OUTPUT:
+		d = &OperaData{}
+	default:
+		return nil, fmt.Errorf("record #%d has unknown type indicator: %q", a.n, indicator)
+	}
+	if err := d.Unpack(a.r); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to unpack record #%d (%c): %v", a.n, indicator, err)
+	}
+	a.n++
+	return d, nil
+}
+
+func OutputDataUnixSec(d OutputData) uint32 {
+	switch v := d.(type) {
+	case *PrimaryData:
+		return v.TeensyData.UnixSec
+	case *SecondaryData:
+		return v.UnixSec
+	case *OperaData:
+		return v.UnixSec
+	default:
+		return 0
+	}
+}
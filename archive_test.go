@@ -0,0 +1,60 @@
+package operadatatypes
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestRawArchiveReader(t *testing.T) {
+	primary := &PrimaryData{
+		PortentaSerial: "abcdefg12345",
+		TeensyData: NewTeensyData{
+			UnixSec: 100,
+			Counts: []*NewTeensyCounts{{
+				PinLaser: 99,
+				Pulses:   []NewPulse{{Indices: [8]uint16{1, 2, 3, 4, 5, 6, 7, 8}, RawPeak: 25, SidePeak: 20}},
+			}},
+		},
+	}
+	secondary := &SecondaryData{UnixSec: 101, PortentaSerial: "abcdefg12345", Sps30: Sps30Data{Pm2p5: 4}, Co2: 410, OmbHumidityScd: 40}
+
+	archive := new(bytes.Buffer)
+	for _, d := range []OutputData{primary, secondary, primary} {
+		for _, job := range d.BinaryFileWriteJob("abcdefg12345") {
+			archive.Write(job.Content)
+		}
+	}
+
+	reader := NewRawArchiveReader(archive)
+	for idx, expected := range []OutputData{primary, secondary, primary} {
+		d, err := reader.Next()
+		if err != nil {
+			t.Errorf("reader.Next() for record #%d: %v", idx, err)
+			return
+		}
+		switch v := d.(type) {
+		case *PrimaryData:
+			if err := checkPrimaryStructEquality(*expected.(*PrimaryData), *v); err != nil {
+				t.Errorf("record #%d: %v", idx, err)
+			}
+		case *SecondaryData:
+			if err := checkSecondaryStructEquality(*expected.(*SecondaryData), *v); err != nil {
+				t.Errorf("record #%d: %v", idx, err)
+			}
+			if m := v.M4SensorMeasurement(); m.UnixSec != 101 || m.Co2 != 410 || m.HumScd != 40 {
+				t.Errorf("M4SensorMeasurement() did not invert Populate: %v", m)
+			}
+		default:
+			t.Errorf("record #%d has unexpected type %T", idx, d)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF at end of archive, got %v", err)
+	}
+
+	truncated := NewRawArchiveReader(bytes.NewReader(secondary.BinaryFileWriteJob("x")[0].Content[:10]))
+	if _, err := truncated.Next(); err == nil || err == io.EOF {
+		t.Errorf("expected an error for a truncated record, got %v", err)
+	}
+}
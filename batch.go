@@ -0,0 +1,328 @@
+package operadatatypes
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const DATA_TYPE_BATCH = "X"
+
+const (
+	DEFAULT_BATCH_MAX_COUNT   = 64
+	DEFAULT_BATCH_MAX_LATENCY = 250 * time.Millisecond
+	// Batches' worth of records kept per data type while sends fail.
+	DEFAULT_BATCH_MAX_PENDING_BATCHES = 16
+)
+
+// Several same-typed messages received in one frame. Items hold the same
+// pointer types ReceiveStructGob returns for DataType, e.g. *NewTeensyData.
+type MessageBatch struct {
+	DataType string
+	Items    []interface{}
+}
+
+func (b *MessageBatch) String() string {
+	return fmt.Sprintf("[Batch| Type %s | %d Items]", b.DataType, len(b.Items))
+}
+
+// Sends a slice of same-typed records (e.g. []*NewTeensyData) as a single frame.
+func SendGobBatch(items interface{}, dataIdentifier string, unixSocketPath string) error {
+	if v := reflect.ValueOf(items); v.Kind() != reflect.Slice {
+		return fmt.Errorf("batch items must be a slice, got %T", items)
+	}
+
+	conn, err := DefaultTransport.Dial(unixSocketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to socket, %s: %v", unixSocketPath, err)
+	}
+
+	encoder := gob.NewEncoder(conn)
+	if err := encoder.Encode(DATA_TYPE_BATCH); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to send data type: %v", err)
+	}
+	if err := encoder.Encode(dataIdentifier); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to send batch item type: %v", err)
+	}
+	if err := encoder.Encode(items); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to send batch: %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		return fmt.Errorf("failed to close connection to socket, %s: %v", unixSocketPath, err)
+	}
+	return nil
+}
+
+/* Batch Queue */
+
+// Items pending under one key, e.g. records of one data type. A send that
+// fails puts its items back in front of any queued since, to go with the next
+// send, and the error is returned by the next add or flush after that call's
+// own items are queued. At most maxPending items are kept per key while sends
+// fail; the oldest beyond that are dropped and reported.
+type batchQueue[K comparable, V any] struct {
+	maxLatency time.Duration
+	maxPending int
+	full       func(items []V) bool // Send now rather than on the timer
+	send       func(key K, items []V) error
+
+	mu      sync.Mutex
+	pending map[K]*queuedBatch[V]
+	lastErr error
+	closed  bool
+	sending int        // Batches taken and not yet sent or requeued
+	idle    *sync.Cond // Signaled when sending drops to 0
+}
+
+type queuedBatch[V any] struct {
+	items []V
+	timer *time.Timer
+}
+
+func newBatchQueue[K comparable, V any](maxLatency time.Duration, maxPending int, full func([]V) bool, send func(K, []V) error) *batchQueue[K, V] {
+	q := &batchQueue[K, V]{
+		maxLatency: maxLatency,
+		maxPending: maxPending,
+		full:       full,
+		send:       send,
+		pending:    map[K]*queuedBatch[V]{},
+	}
+	q.idle = sync.NewCond(&q.mu)
+	return q
+}
+
+// Queues items under key, sending the key's batch if it is full. Returns the
+// error of that send and any left by an earlier one.
+func (q *batchQueue[K, V]) add(key K, items ...V) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return errBatchQueueClosed
+	}
+	err := q.lastErr
+	q.lastErr = nil
+	p := q.queue(key, items, false)
+	if !q.full(p.items) {
+		q.mu.Unlock()
+		return err
+	}
+	batch := q.take(key)
+	q.sending++
+	q.mu.Unlock()
+	return errors.Join(err, q.sendOrRequeue(key, batch, false))
+}
+
+var errBatchQueueClosed = errors.New("closed")
+
+// Adds items to the back of key's batch, or to the front for items of a failed
+// send, starting its timer. Caller must hold mu.
+func (q *batchQueue[K, V]) queue(key K, items []V, front bool) *queuedBatch[V] {
+	p, ok := q.pending[key]
+	if !ok {
+		p = &queuedBatch[V]{}
+		q.pending[key] = p
+	}
+	if front {
+		p.items = append(append([]V{}, items...), p.items...)
+	} else {
+		p.items = append(p.items, items...)
+	}
+	if q.maxPending > 0 && len(p.items) > q.maxPending {
+		dropped := len(p.items) - q.maxPending
+		p.items = append([]V{}, p.items[dropped:]...)
+		q.lastErr = errors.Join(q.lastErr, fmt.Errorf("dropped %d items held back by failed sends", dropped))
+	}
+	if p.timer == nil {
+		p.timer = time.AfterFunc(q.maxLatency, func() { q.flushOnTimer(key, p) })
+	}
+	return p
+}
+
+// Removes and returns the pending items of key. Caller must hold mu.
+func (q *batchQueue[K, V]) take(key K) []V {
+	p, ok := q.pending[key]
+	if !ok {
+		return nil
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	delete(q.pending, key)
+	return p.items
+}
+
+// Sends items taken from key's batch, putting them back in front of it if that
+// fails. With keep set, the error is also left for the next add or flush. The
+// caller counts the send in sending when taking the items.
+func (q *batchQueue[K, V]) sendOrRequeue(key K, items []V, keep bool) error {
+	var err error
+	if len(items) > 0 {
+		err = q.send(key, items)
+	}
+	if err != nil {
+		q.requeue(key, items, err, keep)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.sending--; q.sending == 0 {
+		q.idle.Broadcast()
+	}
+	return err
+}
+
+// Puts items back in front of key's batch after a failed send.
+func (q *batchQueue[K, V]) requeue(key K, items []V, err error, keep bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if keep {
+		q.lastErr = errors.Join(q.lastErr, err)
+	}
+	if !q.closed && len(items) > 0 {
+		q.queue(key, items, true)
+	}
+}
+
+func (q *batchQueue[K, V]) flushOnTimer(key K, p *queuedBatch[V]) {
+	q.mu.Lock()
+	if q.pending[key] != p { // Already sent by add or flush
+		q.mu.Unlock()
+		return
+	}
+	items := q.take(key)
+	q.sending++
+	q.mu.Unlock()
+	q.sendOrRequeue(key, items, true)
+}
+
+// Returns and clears the error left by an earlier send.
+func (q *batchQueue[K, V]) takeErr() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.lastErr
+	q.lastErr = nil
+	return err
+}
+
+// Sends everything pending regardless of count or age, after any sends under
+// way have finished or been requeued. Batches that fail stay queued.
+func (q *batchQueue[K, V]) flush() error {
+	q.mu.Lock()
+	for q.sending > 0 {
+		q.idle.Wait()
+	}
+	batches := map[K][]V{}
+	for key := range q.pending {
+		batches[key] = q.take(key)
+	}
+	q.sending += len(batches)
+	err := q.lastErr
+	q.lastErr = nil
+	q.mu.Unlock()
+
+	for key, items := range batches {
+		err = errors.Join(err, q.sendOrRequeue(key, items, false))
+	}
+	return err
+}
+
+// Flushes and refuses further items. Items whose send fails are dropped, with
+// the error saying how many.
+func (q *batchQueue[K, V]) close() error {
+	err := q.flush()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	dropped := 0
+	for key := range q.pending {
+		dropped += len(q.take(key))
+	}
+	if dropped > 0 {
+		err = errors.Join(err, fmt.Errorf("dropped %d unsent items on close", dropped))
+	}
+	return err
+}
+
+/* Batcher */
+
+// Coalesces messages bound for one socket, sending a batch per data type once
+// MaxCount records are pending or the oldest pending record is MaxLatency old.
+// Records of a failed send are kept, up to DEFAULT_BATCH_MAX_PENDING_BATCHES
+// batches' worth per data type, and sent with the next batch.
+type Batcher struct {
+	UnixSocketPath string
+	MaxCount       int
+	MaxLatency     time.Duration
+
+	mu    sync.Mutex
+	types map[string]reflect.Type // Data identifier to record type
+	queue *batchQueue[string, interface{}]
+}
+
+func NewBatcher(unixSocketPath string, maxCount int, maxLatency time.Duration) *Batcher {
+	if maxCount <= 0 {
+		maxCount = DEFAULT_BATCH_MAX_COUNT
+	}
+	if maxLatency <= 0 {
+		maxLatency = DEFAULT_BATCH_MAX_LATENCY
+	}
+	b := &Batcher{
+		UnixSocketPath: unixSocketPath,
+		MaxCount:       maxCount,
+		MaxLatency:     maxLatency,
+		types:          map[string]reflect.Type{},
+	}
+	b.queue = newBatchQueue(maxLatency, maxCount*DEFAULT_BATCH_MAX_PENDING_BATCHES,
+		func(items []interface{}) bool { return len(items) >= b.MaxCount },
+		b.send)
+	return b
+}
+
+func (b *Batcher) send(dataIdentifier string, items []interface{}) error {
+	slice := reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(items[0])), 0, len(items))
+	for _, d := range items {
+		slice = reflect.Append(slice, reflect.ValueOf(d))
+	}
+	return SendGobBatch(slice.Interface(), dataIdentifier, b.UnixSocketPath)
+}
+
+// Queues d to be sent with other records of the same dataIdentifier. Any error
+// from a send triggered by the latency timer is returned by the next Add or
+// Close, after d is queued.
+func (b *Batcher) Add(d interface{}, dataIdentifier string) error {
+	b.mu.Lock()
+	if t, ok := b.types[dataIdentifier]; !ok {
+		b.types[dataIdentifier] = reflect.TypeOf(d)
+	} else if t != reflect.TypeOf(d) {
+		b.mu.Unlock()
+		return fmt.Errorf("batch for type %s holds %v, cannot add %T", dataIdentifier, t, d)
+	}
+	b.mu.Unlock()
+
+	err := b.queue.add(dataIdentifier, d)
+	if err == errBatchQueueClosed {
+		return fmt.Errorf("batcher for %s is closed", b.UnixSocketPath)
+	}
+	return err
+}
+
+func (b *Batcher) AddTeensyData(d *NewTeensyData) error {
+	return b.Add(d, DATA_TYPE_TEENSY)
+}
+
+// Sends everything pending regardless of count or age. Records of a failed
+// send stay queued.
+func (b *Batcher) Flush() error {
+	return b.queue.flush()
+}
+
+// Flushes and refuses further records.
+func (b *Batcher) Close() error {
+	return b.queue.close()
+}
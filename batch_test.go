@@ -0,0 +1,175 @@
+package operadatatypes
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatcherRoundTrip(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "batch.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Errorf("failed to listen on test socket: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	received := make(chan interface{}, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			HandleStructGob(conn, func(d interface{}) error {
+				received <- d
+				return nil
+			})
+			conn.Close()
+		}
+	}()
+
+	b := NewBatcher(socketPath, 3, time.Hour)
+	for i := uint32(0); i < 4; i++ {
+		if err := b.AddTeensyData(&NewTeensyData{UnixSec: i, Counts: []*NewTeensyCounts{{NumPulses: i}}}); err != nil {
+			t.Errorf("b.AddTeensyData(): %v", err)
+			return
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("b.Close(): %v", err)
+		return
+	}
+
+	for i := uint32(0); i < 4; i++ {
+		select {
+		case d := <-received:
+			teensy, ok := d.(*NewTeensyData)
+			if !ok {
+				t.Errorf("received %T, expected *NewTeensyData", d)
+				return
+			}
+			if teensy.UnixSec != i || teensy.Counts[0].NumPulses != i {
+				t.Errorf("received record #%d out of order: %v", i, teensy)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("timed out waiting for record #%d", i)
+			return
+		}
+	}
+}
+
+func TestBatcherLatencyFlush(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "batch.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Errorf("failed to listen on test socket: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	received := make(chan interface{}, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if d, err := ReceiveStructGob(conn); err == nil {
+			received <- d
+		}
+	}()
+
+	b := NewBatcher(socketPath, 100, 10*time.Millisecond)
+	if err := b.Add(&Sps30Data{Pm2p5: 12}, DATA_TYPE_SPS30); err != nil {
+		t.Errorf("b.Add(): %v", err)
+		return
+	}
+	select {
+	case d := <-received:
+		batch, ok := d.(*MessageBatch)
+		if !ok || batch.DataType != DATA_TYPE_SPS30 || len(batch.Items) != 1 {
+			t.Errorf("expected a batch of 1 sps30 record, got %v", d)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("batch was not sent after its latency budget")
+	}
+}
+
+func TestBatcherKeepsFailedBatch(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "batch.sock")
+	b := NewBatcher(socketPath, 100, 10*time.Millisecond)
+	b.Add(&Sps30Data{Pm2p5: 1}, DATA_TYPE_SPS30)
+	time.Sleep(50 * time.Millisecond) // Timer send fails, nothing listens yet
+
+	if err := b.Add(&Sps30Data{Pm2p5: 2}, DATA_TYPE_SPS30); err == nil {
+		t.Errorf("expected the failed timer send to be reported")
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Errorf("failed to listen on test socket: %v", err)
+		return
+	}
+	defer listener.Close()
+	/* A retry on the timer may send part of them before Close sends the rest */
+	received := make(chan []interface{}, 1)
+	go func() {
+		items := []interface{}{}
+		for len(items) < 2 {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if d, err := ReceiveStructGob(conn); err == nil {
+				if batch, ok := d.(*MessageBatch); ok {
+					items = append(items, batch.Items...)
+				}
+			}
+			conn.Close()
+		}
+		received <- items
+	}()
+	if err := b.Close(); err != nil {
+		t.Errorf("b.Close(): %v", err)
+	}
+	select {
+	case items := <-received:
+		if len(items) != 2 || items[0].(*Sps30Data).Pm2p5 != 1 || items[1].(*Sps30Data).Pm2p5 != 2 {
+			t.Errorf("expected both records in order, got %v", items)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("timed out waiting for the kept records")
+	}
+}
+
+func TestHandleStructGobBatchErrors(t *testing.T) {
+	frame := new(bytes.Buffer)
+	encoder := gob.NewEncoder(frame)
+	encoder.Encode(DATA_TYPE_BATCH)
+	encoder.Encode(DATA_TYPE_TEENSY)
+	encoder.Encode([]*NewTeensyData{{UnixSec: 1}, {UnixSec: 2}, {UnixSec: 3}})
+
+	/* A record the handler fails on does not drop the ones after it */
+	handled := []uint32{}
+	err := HandleStructGob(frame, func(d interface{}) error {
+		unix := d.(*NewTeensyData).UnixSec
+		handled = append(handled, unix)
+		if unix != 3 {
+			return fmt.Errorf("bad record %d", unix)
+		}
+		return nil
+	})
+	if len(handled) != 3 {
+		t.Errorf("handler was called for %v, expected every record", handled)
+	}
+	if err == nil || !strings.Contains(err.Error(), "bad record 1") || !strings.Contains(err.Error(), "bad record 2") {
+		t.Errorf("expected both failures to be reported, got %v", err)
+	}
+}
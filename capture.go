@@ -0,0 +1,166 @@
+package operadatatypes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+/* Capture Files */
+
+// A capture file starts with CAPTURE_FILE_MAGIC followed by records of:
+// unix nanoseconds (int64), source socket (string), data type (string) and the
+// gob frame exactly as it was received (uint32 length + bytes).
+const CAPTURE_FILE_MAGIC = "OPERACAP1"
+const CAPTURE_FILE_EXTENSION = ".cap"
+
+type CaptureRecord struct {
+	ReceivedAt time.Time
+	Source     string
+	DataType   string
+	Frame      []byte
+}
+
+func (c *CaptureRecord) String() string {
+	return fmt.Sprintf("[Capture| %s | %s | Type %s | %d Bytes]", c.ReceivedAt.Format(time.RFC3339Nano), c.Source, c.DataType, len(c.Frame))
+}
+
+// Decodes the captured frame as ReceiveStructGob would have.
+func (c *CaptureRecord) Decode() (interface{}, error) {
+	return ReceiveStructGob(bytes.NewReader(c.Frame))
+}
+
+// Returns the data type identifier of a gob frame, or "" if the frame does not
+// decode. Batches are reported as DATA_TYPE_BATCH followed by the item type.
+func FrameDataType(frame []byte) string {
+	d, err := ReceiveStructGob(bytes.NewReader(frame))
+	if err != nil {
+		return ""
+	}
+	if b, ok := d.(*MessageBatch); ok {
+		return DATA_TYPE_BATCH + b.DataType
+	}
+	return dataTypeOf(d)
+}
+
+func dataTypeOf(d interface{}) string {
+	switch d.(type) {
+	case *Sps30Data:
+		return DATA_TYPE_SPS30
+	case *M4SensorMeasurement:
+		return DATA_TYPE_M4_SENSORS
+	case *NewTeensyData:
+		return DATA_TYPE_TEENSY
+	case *MlTempHumOutputData:
+		return DATA_TYPE_ML_TEMP_RH
+	case *MlPrimaryDataOutput:
+		return DATA_TYPE_ML_PRIMARY
+	case *CsvFileWriteJob:
+		return DATA_TYPE_CSV_FILE
+	case *BinaryFileWriteJob:
+		return DATA_TYPE_BIN_FILE
+	case *CsvRowsFileWriteJob:
+		return DATA_TYPE_CSV_ROWS
+	case *JsonlFileWriteJob:
+		return DATA_TYPE_JSONL
+	default:
+		return ""
+	}
+}
+
+// Re-sends a frame captured off a socket without re-encoding it.
+func SendGobFrame(frame []byte, unixSocketPath string) error {
+	conn, err := DefaultTransport.Dial(unixSocketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to socket, %s: %v", unixSocketPath, err)
+	}
+	if _, err := conn.Write(frame); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to send frame: %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		return fmt.Errorf("failed to close connection to socket, %s: %v", unixSocketPath, err)
+	}
+	return nil
+}
+
+// Safe for concurrent use by several taps sharing one capture file.
+type CaptureWriter struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	c := &CaptureWriter{w: bufio.NewWriter(w)}
+	if _, err := c.w.WriteString(CAPTURE_FILE_MAGIC); err != nil {
+		return nil, fmt.Errorf("failed to write capture header: %v", err)
+	}
+	return c, nil
+}
+
+func (c *CaptureWriter) Write(r *CaptureRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	binary.Write(c.w, binary.LittleEndian, r.ReceivedAt.UnixNano())
+	writeStringToBinary(c.w, r.Source)
+	writeStringToBinary(c.w, r.DataType)
+	binary.Write(c.w, binary.LittleEndian, uint32(len(r.Frame)))
+	if _, err := c.w.Write(r.Frame); err != nil {
+		return fmt.Errorf("failed to write capture record: %v", err)
+	}
+	return nil
+}
+
+func (c *CaptureWriter) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.w.Flush()
+}
+
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	c := &CaptureReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(CAPTURE_FILE_MAGIC))
+	if _, err := io.ReadFull(c.r, magic); err != nil || string(magic) != CAPTURE_FILE_MAGIC {
+		return nil, fmt.Errorf("not a capture file, header is %q", magic)
+	}
+	return c, nil
+}
+
+// Returns io.EOF once the capture ends on a record boundary.
+func (c *CaptureReader) Next() (*CaptureRecord, error) {
+	var nanos int64
+	if err := binary.Read(c.r, binary.LittleEndian, &nanos); err != nil {
+		return nil, err
+	}
+	r := &CaptureRecord{ReceivedAt: time.Unix(0, nanos)}
+	var err error
+	if r.Source, err = readStringFromBinary(c.r); err != nil {
+		return nil, fmt.Errorf("failed to read capture source: %v", err)
+	}
+	if r.DataType, err = readStringFromBinary(c.r); err != nil {
+		return nil, fmt.Errorf("failed to read capture data type: %v", err)
+	}
+	var n uint32
+	if err := binary.Read(c.r, binary.LittleEndian, &n); err != nil {
+		return nil, fmt.Errorf("failed to read capture frame length: %v", err)
+	}
+	r.Frame = make([]byte, n)
+	if _, err := io.ReadFull(c.r, r.Frame); err != nil {
+		return nil, fmt.Errorf("failed to read capture frame: %v", err)
+	}
+	return r, nil
+}
+
+// Returns true if r starts with CAPTURE_FILE_MAGIC, without consuming it.
+func IsCaptureFile(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(CAPTURE_FILE_MAGIC))
+	return err == nil && string(magic) == CAPTURE_FILE_MAGIC
+}
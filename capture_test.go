@@ -0,0 +1,62 @@
+package operadatatypes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCaptureRoundTrip(t *testing.T) {
+	frame := new(bytes.Buffer)
+	encoder := gob.NewEncoder(frame)
+	encoder.Encode(DATA_TYPE_SPS30)
+	encoder.Encode(&Sps30Data{Pm10: 42})
+
+	buffer := new(bytes.Buffer)
+	w, err := NewCaptureWriter(buffer)
+	if err != nil {
+		t.Errorf("NewCaptureWriter(): %v", err)
+		return
+	}
+	original := &CaptureRecord{
+		ReceivedAt: time.Unix(1760000000, 123456789),
+		Source:     MAIN_SD_UNIX_SOCKET,
+		DataType:   FrameDataType(frame.Bytes()),
+		Frame:      frame.Bytes(),
+	}
+	if original.DataType != DATA_TYPE_SPS30 {
+		t.Errorf("FrameDataType() returned '%s', expected '%s'", original.DataType, DATA_TYPE_SPS30)
+	}
+	w.Write(original)
+	w.Flush()
+
+	r := bufio.NewReader(buffer)
+	if !IsCaptureFile(r) {
+		t.Errorf("IsCaptureFile() did not recognise a capture")
+		return
+	}
+	reader, err := NewCaptureReader(r)
+	if err != nil {
+		t.Errorf("NewCaptureReader(): %v", err)
+		return
+	}
+	record, err := reader.Next()
+	if err != nil {
+		t.Errorf("reader.Next(): %v", err)
+		return
+	}
+	if !record.ReceivedAt.Equal(original.ReceivedAt) || record.Source != original.Source || !bytes.Equal(record.Frame, original.Frame) {
+		t.Errorf("capture record changed in round trip: %v vs %v", original, record)
+	}
+	if d, err := record.Decode(); err != nil {
+		t.Errorf("record.Decode(): %v", err)
+	} else if s, ok := d.(*Sps30Data); !ok || s.Pm10 != 42 {
+		t.Errorf("record.Decode() returned %v", d)
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF at end of capture, got %v", err)
+	}
+}
@@ -0,0 +1,382 @@
+package operadatatypes
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CATALOG_FILE_NAME             = ".opera_catalog.json"
+	DEFAULT_CATALOG_SAVE_INTERVAL = 10 * time.Second
+)
+
+// What the catalog knows about one data file under its root.
+type CatalogEntry struct {
+	Filename       string `json:"file"` // Relative to the root
+	DataLabel      string `json:"label"`
+	PortentaSerial string `json:"serial"`
+	FirstUnix      uint32 `json:"first_unix"`
+	LastUnix       uint32 `json:"last_unix"`
+	Records        int    `json:"records"`
+	Size           int64  `json:"size"`
+	Compressed     bool   `json:"compressed"`
+	Sha256         string `json:"sha256,omitempty"` // Once the file is complete
+	ExportedUnix   int64  `json:"exported_unix,omitempty"`
+}
+
+func (e CatalogEntry) Exported() bool {
+	return e.ExportedUnix > 0
+}
+
+// Entries matching every set field.
+type CatalogQuery struct {
+	DataLabel      string
+	PortentaSerial string
+	FromUnix       uint32 // Files with records at or after this
+	ToUnix         uint32 // Files with records at or before this
+	Unexported     bool
+}
+
+func (q CatalogQuery) matches(e *CatalogEntry) bool {
+	return (q.DataLabel == "" || e.DataLabel == q.DataLabel) &&
+		(q.PortentaSerial == "" || e.PortentaSerial == q.PortentaSerial) &&
+		(q.FromUnix == 0 || e.LastUnix >= q.FromUnix) &&
+		(q.ToUnix == 0 || e.FirstUnix <= q.ToUnix) &&
+		(!q.Unexported || !e.Exported())
+}
+
+// Index of the OPERA data files under Root, kept in CATALOG_FILE_NAME. The
+// FileSink, Compressor, RetentionManager and UsbExporter keep it current when
+// given it, so tools can look files up without listing and parsing the root.
+type Catalog struct {
+	Root string
+	// How long the FileSink lets changes gather before saving them, rather
+	// than rewriting the catalog on every commit. Saved on every commit if 0.
+	SaveInterval time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*CatalogEntry
+	dirty     bool
+	saveTimer *time.Timer
+}
+
+// Loads the catalog under root, building it from the files there if it does
+// not exist yet.
+func OpenCatalog(root string) (*Catalog, error) {
+	c := &Catalog{Root: root, SaveInterval: DEFAULT_CATALOG_SAVE_INTERVAL, entries: map[string]*CatalogEntry{}}
+	path := filepath.Join(root, CATALOG_FILE_NAME)
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, c.Rebuild()
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read catalog, '%s': %v", path, err)
+	}
+	entries := []CatalogEntry{}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("failed to read json contents of catalog, '%s': %v", path, err)
+	}
+	for i := range entries {
+		c.entries[entries[i].Filename] = &entries[i]
+	}
+	return c, nil
+}
+
+// Writes the catalog if it changed since it was last saved.
+func (c *Catalog) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.saveTimer != nil {
+		c.saveTimer.Stop()
+		c.saveTimer = nil
+	}
+	if !c.dirty {
+		return nil
+	}
+	entries := make([]CatalogEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Filename < entries[j].Filename })
+	b, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to convert catalog to json: %v", err)
+	}
+	if err := writeFileAtomic(filepath.Join(c.Root, CATALOG_FILE_NAME), b); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// Saves the catalog SaveInterval from now, once for every change made
+// meanwhile, or right away without a SaveInterval.
+func (c *Catalog) saveSoon() error {
+	c.mu.Lock()
+	if c.SaveInterval <= 0 {
+		c.mu.Unlock()
+		return c.Save()
+	}
+	if c.saveTimer == nil {
+		c.saveTimer = time.AfterFunc(c.SaveInterval, func() {
+			if err := c.Save(); err != nil {
+				log.Printf("failed to save catalog: %v", err) // Still dirty, saved with the next change
+			}
+		})
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// Replaces the catalog with the files now under Root, keeping what is known
+// of files whose size has not changed.
+func (c *Catalog) Rebuild() error {
+	entries := map[string]*CatalogEntry{}
+	err := filepath.WalkDir(c.Root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := ParseFileName(d.Name())
+		if err != nil {
+			return nil
+		}
+		stat, err := d.Info()
+		if err != nil {
+			return nil // Removed since listing
+		}
+		rel, err := filepath.Rel(c.Root, path)
+		if err != nil {
+			return nil
+		}
+
+		c.mu.Lock()
+		known, ok := c.entries[rel]
+		c.mu.Unlock()
+		if ok && known.Size == stat.Size() {
+			entries[rel] = known
+			return nil
+		}
+		e := &CatalogEntry{
+			Filename:       rel,
+			DataLabel:      info.DataLabel,
+			PortentaSerial: info.PortentaSerial,
+			Size:           stat.Size(),
+			Compressed:     info.Compressed,
+		}
+		e.Records, e.FirstUnix, e.LastUnix, _ = summarizeDataFile(path) // Keeps the records before any damage
+		entries[rel] = e
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rebuild catalog of '%s': %v", c.Root, err)
+	}
+
+	c.mu.Lock()
+	c.entries = entries
+	c.dirty = true
+	c.mu.Unlock()
+	return c.Save()
+}
+
+func (c *Catalog) Get(filename string) (CatalogEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[filepath.Clean(filename)]
+	if !ok {
+		return CatalogEntry{}, false
+	}
+	return *e, true
+}
+
+// Returns the matching entries, oldest first.
+func (c *Catalog) Query(q CatalogQuery) []CatalogEntry {
+	c.mu.Lock()
+	ret := []CatalogEntry{}
+	for _, e := range c.entries {
+		if q.matches(e) {
+			ret = append(ret, *e)
+		}
+	}
+	c.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].FirstUnix != ret[j].FirstUnix {
+			return ret[i].FirstUnix < ret[j].FirstUnix
+		}
+		return fileNameLess(ret[i].Filename, ret[j].Filename)
+	})
+	return ret
+}
+
+// Returns filename's entry, adding it if new. Caller must hold mu.
+func (c *Catalog) entry(filename string) *CatalogEntry {
+	e, ok := c.entries[filename]
+	if !ok {
+		e = &CatalogEntry{Filename: filename}
+		if info, err := ParseFileName(filename); err == nil {
+			e.DataLabel, e.PortentaSerial = info.DataLabel, info.PortentaSerial
+		}
+		c.entries[filename] = e
+	}
+	return e
+}
+
+// Notes records appended to filename, which is now size bytes.
+func (c *Catalog) recordWrite(filename string, first, last uint32, records int, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entry(filename)
+	if records > 0 {
+		if e.Records == 0 || first < e.FirstUnix {
+			e.FirstUnix = first
+		}
+		if last > e.LastUnix {
+			e.LastUnix = last
+		}
+		e.Records += records
+	}
+	e.Size = size
+	e.Sha256 = ""
+	e.ExportedUnix = 0 // Changed since
+	c.dirty = true
+}
+
+// Notes that filename, now size bytes, holds records from first to last in
+// all, as after a copy the sink did not see record by record.
+func (c *Catalog) recordFile(filename string, first, last uint32, records int, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entry(filename)
+	e.FirstUnix, e.LastUnix, e.Records = first, last, records
+	e.Size = size
+	e.Sha256 = ""
+	e.ExportedUnix = 0
+	c.dirty = true
+}
+
+// Moves filename's entry to its compressed file, now compressedSize bytes,
+// merging it into an entry the compressed file already has.
+func (c *Catalog) recordCompressed(filename string, compressedSize int64, sha256 string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[filename]
+	if !ok {
+		return
+	}
+	delete(c.entries, filename)
+	gzName := filename + COMPRESSED_FILE_EXTENSION
+	if earlier, ok := c.entries[gzName]; ok {
+		e.FirstUnix = min(e.FirstUnix, earlier.FirstUnix)
+		e.LastUnix = max(e.LastUnix, earlier.LastUnix)
+		e.Records += earlier.Records
+	}
+	e.Filename = gzName
+	e.Size = compressedSize
+	e.Compressed = true
+	e.Sha256 = sha256
+	e.ExportedUnix = 0
+	c.entries[gzName] = e
+	c.dirty = true
+}
+
+func (c *Catalog) recordExported(filename, sha256 string, exportedUnix int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[filename]; ok {
+		e.Sha256 = sha256
+		e.ExportedUnix = exportedUnix
+		c.dirty = true
+	}
+}
+
+func (c *Catalog) recordRemoved(filename string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[filename]; ok {
+		delete(c.entries, filename)
+		c.dirty = true
+	}
+}
+
+// Returns the unix times of the first and last record in a job, and how many
+// it holds. CSV rows start with the unix time; binary records with their type
+// indicator and then the unix time; JSON lines hold it as "unix_sec".
+func jobRecords(job FileWriteJob) (first, last uint32, records int) {
+	rowUnix := func(row string) uint32 {
+		unix, _, _ := strings.Cut(row, ",")
+		n, _ := strconv.ParseUint(unix, 10, 32)
+		return uint32(n)
+	}
+	switch j := job.(type) {
+	case CsvFileWriteJob:
+		return jobRecords(&j)
+	case *CsvFileWriteJob:
+		unix := rowUnix(j.Content)
+		return unix, unix, 1
+	case CsvRowsFileWriteJob:
+		return jobRecords(&j)
+	case *CsvRowsFileWriteJob:
+		if len(j.Rows) == 0 {
+			return 0, 0, 0
+		}
+		return rowUnix(j.Rows[0]), rowUnix(j.Rows[len(j.Rows)-1]), len(j.Rows)
+	case JsonlFileWriteJob:
+		return jobRecords(&j)
+	case *JsonlFileWriteJob:
+		if len(j.Lines) == 0 {
+			return 0, 0, 0
+		}
+		first, _ := jsonlLineUnix([]byte(j.Lines[0]))
+		last, _ := jsonlLineUnix([]byte(j.Lines[len(j.Lines)-1]))
+		return first, last, len(j.Lines)
+	case BinaryFileWriteJob:
+		return jobRecords(&j)
+	case *BinaryFileWriteJob:
+		if len(j.Content) < 5 {
+			return 0, 0, 0
+		}
+		unix := binary.LittleEndian.Uint32(j.Content[1:5])
+		return unix, unix, 1
+	default:
+		return 0, 0, 0
+	}
+}
+
+// Returns the unix time of a JSON Lines record, or false for a line that is
+// not a record, such as a torn last line.
+// PrimaryRaw lines hold it in their "teensy_data".
+func jsonlLineUnix(line []byte) (uint32, bool) {
+	var record struct {
+		UnixSec    *uint32 `json:"unix_sec"`
+		TeensyData struct {
+			UnixSec *uint32 `json:"unix_sec"`
+		} `json:"teensy_data"`
+	}
+	if err := json.Unmarshal(line, &record); err != nil {
+		return 0, false
+	}
+	if record.UnixSec == nil {
+		record.UnixSec = record.TeensyData.UnixSec
+	}
+	if record.UnixSec == nil {
+		return 0, false
+	}
+	return *record.UnixSec, true
+}
+
+// Caller must hold s.mu.
+func (s *FileSink) catalogWrite(job FileWriteJob) {
+	e, ok := s.files[s.lastFile]
+	if s.Catalog == nil || !ok {
+		return
+	}
+	first, last, records := jobRecords(job)
+	s.Catalog.recordWrite(s.lastFile, first, last, records, e.Value.(*sinkFile).size())
+}
@@ -0,0 +1,128 @@
+package operadatatypes
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCatalogFollowsSink(t *testing.T) {
+	root, usb := t.TempDir(), t.TempDir()
+	catalog, err := OpenCatalog(root)
+	if err != nil {
+		t.Errorf("OpenCatalog(): %v", err)
+		return
+	}
+	sink := NewFileSink(root, 0)
+	sink.Catalog = catalog
+
+	csvName, rawName := "OPERA_abc_Output_20261016.csv", "OPERA_abc_SecondaryRaw_20261016.raw"
+	sink.Write(CsvRowsFileWriteJob{Filename: csvName, Headers: "unix,x", Rows: []string{"100,1", "105,2"}})
+	sink.Write(CsvFileWriteJob{Filename: csvName, Headers: "unix,x", Content: "110,3"})
+	for _, unix := range []uint32{200, 210} {
+		for _, job := range (&SecondaryData{UnixSec: unix, PortentaSerial: "abc"}).BinaryFileWriteJob("abc") {
+			job.Filename = rawName
+			sink.Write(job)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Errorf("sink.Close(): %v", err)
+		return
+	}
+
+	e, ok := catalog.Get(csvName)
+	if !ok || e.Records != 3 || e.FirstUnix != 100 || e.LastUnix != 110 || e.DataLabel != DATA_LABEL_OUTPUT || e.Size != int64(len("unix,x\n100,1\n105,2\n110,3\n")) {
+		t.Errorf("catalog entry for %s is %+v", csvName, e)
+	}
+	if found := catalog.Query(CatalogQuery{FromUnix: 150}); len(found) != 1 || found[0].Filename != rawName || found[0].Records != 2 {
+		t.Errorf("query from 150 returned %v", found)
+	}
+
+	/* Compression and export are recorded */
+	compressor := NewCompressor(root, nil)
+	compressor.Catalog = catalog
+	if _, err := compressor.CompressCompleted(); err != nil {
+		t.Errorf("CompressCompleted(): %v", err)
+	}
+	exporter := NewUsbExporter(root, usb)
+	exporter.Catalog = catalog
+	if done, err := exporter.Export(); err != nil || len(done) != 2 {
+		t.Errorf("Export() exported %v (err %v), expected both files", done, err)
+	}
+
+	reopened, err := OpenCatalog(root)
+	if err != nil {
+		t.Errorf("OpenCatalog(): %v", err)
+		return
+	}
+	entries := reopened.Query(CatalogQuery{})
+	if len(entries) != 2 {
+		t.Errorf("reopened catalog has %v, expected 2 entries", entries)
+		return
+	}
+	for _, e := range entries {
+		stat, _ := os.Stat(filepath.Join(root, e.Filename))
+		if !e.Compressed || !e.Exported() || len(e.Sha256) != 64 || stat == nil || stat.Size() != e.Size {
+			t.Errorf("entry after compression and export is %+v", e)
+		}
+	}
+	if len(reopened.Query(CatalogQuery{Unexported: true})) != 0 {
+		t.Errorf("unexported query returned exported files")
+	}
+	if !exporter.IsExported(filepath.Join(root, csvName+COMPRESSED_FILE_EXTENSION)) {
+		t.Errorf("exporter does not report the exported file as exported")
+	}
+
+	/* Without a catalog one is built from the files */
+	os.Remove(filepath.Join(root, CATALOG_FILE_NAME))
+	rebuilt, err := OpenCatalog(root)
+	if err != nil {
+		t.Errorf("OpenCatalog() without a catalog: %v", err)
+		return
+	}
+	if e, ok := rebuilt.Get(csvName + COMPRESSED_FILE_EXTENSION); !ok || e.Records != 3 || e.FirstUnix != 100 || e.LastUnix != 110 {
+		t.Errorf("rebuilt entry is %+v", e)
+	}
+}
+
+func TestCatalogSaveInterval(t *testing.T) {
+	root := t.TempDir()
+	catalog, err := OpenCatalog(root)
+	if err != nil {
+		t.Errorf("OpenCatalog(): %v", err)
+		return
+	}
+	catalog.SaveInterval = 50 * time.Millisecond
+	sink := NewFileSink(root, 0)
+	sink.Catalog = catalog
+	defer sink.Close()
+	if err := sink.EnableDurability(DurabilityPolicy{SyncEveryWrite: true}); err != nil {
+		t.Errorf("sink.EnableDurability(): %v", err)
+		return
+	}
+	saved := func() bool {
+		b, _ := os.ReadFile(filepath.Join(root, CATALOG_FILE_NAME))
+		return strings.Contains(string(b), "OPERA_abc_Output_20261016.csv")
+	}
+
+	/* Commits of many writes are saved together once the interval has passed */
+	for i := 0; i < 5; i++ {
+		sink.Write(CsvFileWriteJob{Filename: "OPERA_abc_Output_20261016.csv", Headers: "unix,x", Content: "100,1"})
+	}
+	if saved() {
+		t.Errorf("catalog was saved on the commit")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !saved() {
+		t.Errorf("catalog was not saved after its SaveInterval")
+	}
+
+	/* Flush saves at once */
+	sink.Write(CsvFileWriteJob{Filename: "OPERA_abc_Output_20261017.csv", Headers: "unix,x", Content: "200,1"})
+	sink.Flush()
+	if b, _ := os.ReadFile(filepath.Join(root, CATALOG_FILE_NAME)); !strings.Contains(string(b), "OPERA_abc_Output_20261017.csv") {
+		t.Errorf("catalog was not saved on Flush: %s", b)
+	}
+}
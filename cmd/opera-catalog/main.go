@@ -0,0 +1,75 @@
+// Command opera-catalog lists the data files on a device from the catalog the
+// sink keeps under the data root, building the catalog first if there is none.
+//
+//	opera-catalog -root /media/sd -label PrimaryRaw -from 2026-10-01 -unexported
+//
+// With -rebuild the catalog is rebuilt from the files under the root first.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	opera "github.com/Potsdam-Sensors/OPERA-Data-Types"
+)
+
+func parseDay(s string) (uint32, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.UTC)
+	if err != nil {
+		return 0, fmt.Errorf("expected a date like 2026-10-01, got '%s'", s)
+	}
+	return uint32(t.Unix()), nil
+}
+
+func main() {
+	root := flag.String("root", ".", "data root holding the catalog")
+	q := opera.CatalogQuery{}
+	flag.StringVar(&q.DataLabel, "label", "", "only files of this data label")
+	flag.StringVar(&q.PortentaSerial, "serial", "", "only files from this serial")
+	from := flag.String("from", "", "only files with records on or after this UTC date")
+	to := flag.String("to", "", "only files with records before this UTC date")
+	flag.BoolVar(&q.Unexported, "unexported", false, "only files not exported yet")
+	rebuild := flag.Bool("rebuild", false, "rebuild the catalog from the files under the root first")
+	flag.Parse()
+
+	var err error
+	if q.FromUnix, err = parseDay(*from); err != nil {
+		log.Fatal(err)
+	}
+	if q.ToUnix, err = parseDay(*to); err != nil {
+		log.Fatal(err)
+	}
+	if q.ToUnix > 0 {
+		q.ToUnix--
+	}
+
+	catalog, err := opera.OpenCatalog(*root)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *rebuild {
+		if err := catalog.Rebuild(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tLABEL\tSERIAL\tFIRST\tLAST\tRECORDS\tSIZE\tGZ\tEXPORTED")
+	for _, e := range catalog.Query(q) {
+		exported := "-"
+		if e.Exported() {
+			exported = time.Unix(e.ExportedUnix, 0).UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%v\t%s\n", e.Filename, e.DataLabel, e.PortentaSerial,
+			time.Unix(int64(e.FirstUnix), 0).UTC().Format(time.RFC3339), time.Unix(int64(e.LastUnix), 0).UTC().Format(time.RFC3339),
+			e.Records, e.Size, e.Compressed, exported)
+	}
+	w.Flush()
+}
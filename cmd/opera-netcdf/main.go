@@ -0,0 +1,90 @@
+// Command opera-netcdf converts the Output and SecondaryRaw data of one device
+// to a CF-convention NetCDF-3 classic file.
+//
+//	opera-netcdf -root /media/sd -serial 2A0F -from 2026-10-01 -to 2026-10-08 -o week.nc
+//
+// Files are found through the catalog under -root, or given as arguments:
+//
+//	opera-netcdf -serial 2A0F -o day.nc OPERA_2A0F_Output_20261001.raw OPERA_2A0F_SecondaryRaw_20261001.csv.gz
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	opera "github.com/Potsdam-Sensors/OPERA-Data-Types"
+)
+
+func parseTime(s string) (uint32, error) {
+	if s == "" {
+		return 0, nil
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return uint32(t.Unix()), nil
+		}
+	}
+	return 0, fmt.Errorf("expected a date like 2026-10-01 or a time like 2026-10-01T12:00:00Z, got '%s'", s)
+}
+
+func main() {
+	root := flag.String("root", ".", "data root holding the catalog, when no files are given")
+	serial := flag.String("serial", "", "device serial to export (required)")
+	from := flag.String("from", "", "export records at or after this UTC date or time")
+	to := flag.String("to", "", "export records before this UTC date or time")
+	out := flag.String("o", "", "NetCDF file to write (required)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -serial serial -o out.nc [flags] [file...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *serial == "" || *out == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	fromUnix, err := parseTime(*from)
+	if err != nil {
+		log.Fatal(err)
+	}
+	toUnix, err := parseTime(*to)
+	if err != nil {
+		log.Fatal(err)
+	}
+	e := opera.NewNetcdfExport(*serial, fromUnix, toUnix)
+	if flag.NArg() > 0 {
+		for _, path := range flag.Args() {
+			if err := e.ReadFile(path); err != nil {
+				log.Println(err) // Keeps the records before the damage
+			}
+		}
+	} else {
+		catalog, err := opera.OpenCatalog(*root)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := e.ReadCatalog(catalog); err != nil {
+			log.Println(err) // Damaged files are skipped past
+		}
+	}
+	if e.Len() == 0 {
+		log.Fatalf("no records from %s in the given range", *serial)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := e.Write(f); err != nil {
+		f.Close()
+		os.Remove(*out)
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %d times to %s", e.Len(), *out)
+}
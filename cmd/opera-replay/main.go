@@ -0,0 +1,224 @@
+// Command opera-replay re-emits recorded data onto the live sockets in
+// timestamp order. PrimaryRaw/SecondaryRaw .raw archives are sent as
+// NewTeensyData, Sps30Data and M4SensorMeasurement messages, and opera-tap
+// capture files are re-sent byte for byte to the socket they were captured on
+// (or -capture-socket). An archive whose records have no socket given is
+// refused, as are archives of other records, e.g. Output.
+//
+//	opera-replay -speed 10 -teensy /var/run/teensy.sock OPERA_*_PrimaryRaw_20261018.raw
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	opera "github.com/Potsdam-Sensors/OPERA-Data-Types"
+)
+
+type sockets struct {
+	teensy, sps30, m4, capture string
+}
+
+// One input file, positioned at the next record to send.
+type source interface {
+	name() string
+	at() time.Time
+	// Returns an error if the file's records have no socket to go to.
+	check(s sockets) error
+	send(s sockets) error
+	advance() bool
+	close() error
+}
+
+/* Raw Archives */
+
+type archiveSource struct {
+	file   string
+	f      io.Closer
+	reader *opera.RawArchiveReader
+	head   opera.OutputData
+}
+
+func (a *archiveSource) name() string { return a.file }
+
+func (a *archiveSource) at() time.Time {
+	return time.Unix(int64(opera.OutputDataUnixSec(a.head)), 0)
+}
+
+func (a *archiveSource) check(s sockets) error {
+	switch a.head.(type) {
+	case *opera.PrimaryData:
+		if s.teensy == "" {
+			return fmt.Errorf("%s holds PrimaryRaw records, give -teensy to replay them", a.file)
+		}
+	case *opera.SecondaryData:
+		if s.sps30 == "" && s.m4 == "" {
+			return fmt.Errorf("%s holds SecondaryRaw records, give -sps30 and/or -m4 to replay them", a.file)
+		}
+	default:
+		return fmt.Errorf("%s holds %T records, which have no socket to replay to", a.file, a.head)
+	}
+	return nil
+}
+
+func (a *archiveSource) send(s sockets) error {
+	if err := a.check(s); err != nil {
+		return err
+	}
+	switch v := a.head.(type) {
+	case *opera.PrimaryData:
+		return v.TeensyData.SendGob(s.teensy)
+	case *opera.SecondaryData:
+		var err error
+		if s.sps30 != "" {
+			err = v.Sps30Data().SendGob(s.sps30)
+		}
+		if s.m4 != "" {
+			err = errors.Join(err, v.M4SensorMeasurement().SendGob(s.m4))
+		}
+		return err
+	}
+	return nil
+}
+
+func (a *archiveSource) advance() bool {
+	d, err := a.reader.Next()
+	if err != nil {
+		if err != io.EOF {
+			log.Printf("stopping %s: %v", a.file, err)
+		}
+		return false
+	}
+	a.head = d
+	return true
+}
+
+func (a *archiveSource) close() error { return a.f.Close() }
+
+/* Tap Captures */
+
+type captureSource struct {
+	file   string
+	f      io.Closer
+	reader *opera.CaptureReader
+	head   *opera.CaptureRecord
+}
+
+func (c *captureSource) name() string { return c.file }
+
+func (c *captureSource) at() time.Time { return c.head.ReceivedAt }
+
+func (c *captureSource) check(s sockets) error { return nil } // Frames go where they were captured
+
+func (c *captureSource) send(s sockets) error {
+	target := c.head.Source
+	if s.capture != "" {
+		target = s.capture
+	}
+	return opera.SendGobFrame(c.head.Frame, target)
+}
+
+func (c *captureSource) advance() bool {
+	r, err := c.reader.Next()
+	if err != nil {
+		if err != io.EOF {
+			log.Printf("stopping %s: %v", c.file, err)
+		}
+		return false
+	}
+	c.head = r
+	return true
+}
+
+func (c *captureSource) close() error { return c.f.Close() }
+
+func openSource(file string) (source, error) {
+	f, err := opera.OpenDataFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	if opera.IsCaptureFile(r) {
+		reader, err := opera.NewCaptureReader(r)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to read capture, '%s': %v", file, err)
+		}
+		return &captureSource{file: file, f: f, reader: reader}, nil
+	}
+	return &archiveSource{file: file, f: f, reader: opera.NewRawArchiveReader(r)}, nil
+}
+
+func main() {
+	speed := flag.Float64("speed", 1, "playback speed relative to real time, 0 sends as fast as possible")
+	s := sockets{}
+	flag.StringVar(&s.teensy, "teensy", "", "socket to send NewTeensyData from PrimaryRaw records to")
+	flag.StringVar(&s.sps30, "sps30", "", "socket to send Sps30Data from SecondaryRaw records to")
+	flag.StringVar(&s.m4, "m4", "", "socket to send M4SensorMeasurement from SecondaryRaw records to")
+	flag.StringVar(&s.capture, "capture-socket", "", "socket to send captured frames to instead of the one they were captured on")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] file.raw|file.cap...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || *speed < 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	sources := []source{}
+	for _, file := range flag.Args() {
+		src, err := openSource(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !src.advance() {
+			src.close()
+			continue
+		}
+		if err := src.check(s); err != nil {
+			fmt.Fprintln(flag.CommandLine.Output(), err)
+			flag.Usage()
+			os.Exit(2)
+		}
+		sources = append(sources, src)
+	}
+
+	var first, start time.Time
+	started, sent := false, 0
+	for len(sources) > 0 {
+		/* Pick the oldest pending record across all files */
+		next := 0
+		for i, src := range sources {
+			if src.at().Before(sources[next].at()) {
+				next = i
+			}
+		}
+		src := sources[next]
+
+		if !started {
+			first, start, started = src.at(), time.Now(), true
+		} else if *speed > 0 {
+			offset := time.Duration(float64(src.at().Sub(first)) / *speed)
+			time.Sleep(time.Until(start.Add(offset)))
+		}
+
+		if err := src.send(s); err != nil {
+			log.Printf("failed to send record from %s at %s: %v", src.name(), src.at(), err)
+		} else {
+			sent++
+		}
+
+		if !src.advance() {
+			src.close()
+			sources = append(sources[:next], sources[next+1:]...)
+		}
+	}
+	log.Printf("replayed %d records", sent)
+}
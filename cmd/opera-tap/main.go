@@ -0,0 +1,165 @@
+// Command opera-tap listens on a socket in place of its real receiver, forwards
+// every message to the receiver unchanged and records it with its receive time
+// to a capture file that opera-replay can play back.
+//
+//	opera-tap -o main_sd.cap -tap /var/run/main_sd.sock=/var/run/main_sd.real.sock
+//
+// The real receiver must be started on the upstream path. Several -tap flags
+// record into one capture so ordering between daemons is preserved.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	opera "github.com/Potsdam-Sensors/OPERA-Data-Types"
+)
+
+type tap struct {
+	listen, upstream string
+}
+
+type tapFlags []tap
+
+func (t *tapFlags) String() string {
+	return fmt.Sprint(*t)
+}
+
+func (t *tapFlags) Set(s string) error {
+	listen, upstream, ok := strings.Cut(s, "=")
+	if !ok || listen == "" || upstream == "" {
+		return fmt.Errorf("expected listen=upstream, got '%s'", s)
+	}
+	*t = append(*t, tap{listen, upstream})
+	return nil
+}
+
+func (t tap) serve(l net.Listener, capture *opera.CaptureWriter, verbose bool) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		frame, err := io.ReadAll(conn)
+		receivedAt := time.Now()
+		conn.Close()
+		if err != nil {
+			log.Printf("%s: failed to read message: %v", t.listen, err)
+			continue
+		}
+		if len(frame) == 0 {
+			continue
+		}
+
+		if err := opera.SendGobFrame(frame, t.upstream); err != nil {
+			log.Printf("%s: failed to forward message: %v", t.listen, err)
+		}
+
+		record := &opera.CaptureRecord{
+			ReceivedAt: receivedAt,
+			Source:     t.listen,
+			DataType:   opera.FrameDataType(frame),
+			Frame:      frame,
+		}
+		if record.DataType == "" {
+			log.Printf("%s: recording message that does not decode (%d bytes)", t.listen, len(frame))
+		}
+		if err := capture.Write(record); err != nil {
+			log.Printf("%s: %v", t.listen, err)
+		}
+		if verbose {
+			log.Println(record)
+		}
+	}
+}
+
+// Removes a socket left at path by a previous run. Refuses if something still
+// answers on it, as that is a live service the tap would otherwise cut off.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to stat socket, %s: %v", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to replace %s, it is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("refusing to replace socket %s, something is listening on it", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale socket, %s: %v", path, err)
+	}
+	return nil
+}
+
+func main() {
+	taps := tapFlags{}
+	flag.Var(&taps, "tap", "listen=upstream socket pair, may be repeated")
+	output := flag.String("o", "opera"+opera.CAPTURE_FILE_EXTENSION, "capture file to write")
+	verbose := flag.Bool("v", false, "log every recorded message")
+	flag.Parse()
+	if len(taps) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	for _, t := range taps {
+		if err := removeStaleSocket(t.listen); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		log.Fatalf("failed to create capture file, '%s': %v", *output, err)
+	}
+	capture, err := opera.NewCaptureWriter(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listeners := []net.Listener{}
+	for _, t := range taps {
+		l, err := net.Listen("unix", t.listen)
+		if err != nil {
+			log.Fatalf("failed to listen on socket, %s: %v", t.listen, err)
+		}
+		listeners = append(listeners, l)
+		go t.serve(l, capture, *verbose)
+		log.Printf("tapping %s -> %s", t.listen, t.upstream)
+	}
+
+	/* Flush the capture periodically and on shutdown */
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := capture.Flush(); err != nil {
+				log.Printf("failed to flush capture file: %v", err)
+			}
+		case <-signals:
+			for _, l := range listeners {
+				l.Close()
+			}
+			if err := capture.Flush(); err != nil {
+				log.Printf("failed to flush capture file: %v", err)
+			}
+			f.Close()
+			return
+		}
+	}
+}
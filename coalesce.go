@@ -0,0 +1,93 @@
+package operadatatypes
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DEFAULT_COALESCE_MAX_ROWS    = 256
+	DEFAULT_COALESCE_MAX_BYTES   = 64 << 10
+	DEFAULT_COALESCE_MAX_LATENCY = time.Second
+)
+
+// Buffers CSV rows bound for one socket, sending the rows of each file as one
+// CsvRowsFileWriteJob once MaxRows or MaxBytes are pending for it or its oldest
+// pending row is MaxLatency old. Rows of a failed send are kept, up to
+// DEFAULT_BATCH_MAX_PENDING_BATCHES times MaxRows per file, and sent with the
+// next.
+type CsvCoalescer struct {
+	UnixSocketPath string
+	MaxRows        int
+	MaxBytes       int
+	MaxLatency     time.Duration
+
+	queue *batchQueue[csvRowsKey, string]
+}
+
+type csvRowsKey struct {
+	filename string
+	headers  string
+}
+
+func NewCsvCoalescer(unixSocketPath string, maxRows, maxBytes int, maxLatency time.Duration) *CsvCoalescer {
+	if maxRows <= 0 {
+		maxRows = DEFAULT_COALESCE_MAX_ROWS
+	}
+	if maxBytes <= 0 {
+		maxBytes = DEFAULT_COALESCE_MAX_BYTES
+	}
+	if maxLatency <= 0 {
+		maxLatency = DEFAULT_COALESCE_MAX_LATENCY
+	}
+	c := &CsvCoalescer{
+		UnixSocketPath: unixSocketPath,
+		MaxRows:        maxRows,
+		MaxBytes:       maxBytes,
+		MaxLatency:     maxLatency,
+	}
+	c.queue = newBatchQueue(maxLatency, maxRows*DEFAULT_BATCH_MAX_PENDING_BATCHES, c.full, c.send)
+	return c
+}
+
+func (c *CsvCoalescer) full(rows []string) bool {
+	if len(rows) >= c.MaxRows {
+		return true
+	}
+	bytes := 0
+	for _, row := range rows {
+		bytes += len(row) + 1
+	}
+	return bytes >= c.MaxBytes
+}
+
+func (c *CsvCoalescer) send(key csvRowsKey, rows []string) error {
+	job := CsvRowsFileWriteJob{Filename: key.filename, Headers: key.headers, Rows: rows}
+	return job.SendGob(c.UnixSocketPath)
+}
+
+func (c *CsvCoalescer) Add(job CsvFileWriteJob) error {
+	return c.AddRows(CsvRowsFileWriteJob{Filename: job.Filename, Headers: job.Headers, Rows: []string{job.Content}})
+}
+
+// Queues the job's rows behind any pending for the same file. Any error from a
+// send triggered by the latency timer is returned by the next AddRows or Close,
+// after the job's rows are queued.
+func (c *CsvCoalescer) AddRows(job CsvRowsFileWriteJob) error {
+	err := c.queue.add(csvRowsKey{job.Filename, job.Headers}, job.Rows...)
+	if err == errBatchQueueClosed {
+		return fmt.Errorf("csv coalescer for %s is closed", c.UnixSocketPath)
+	}
+	return err
+}
+
+// Sends everything pending regardless of count, size or age. Rows of a failed
+// send stay queued.
+func (c *CsvCoalescer) Flush() error {
+	return c.queue.flush()
+}
+
+// Flushes and refuses further rows.
+func (c *CsvCoalescer) Close() error {
+	return c.queue.close()
+}
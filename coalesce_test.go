@@ -0,0 +1,143 @@
+package operadatatypes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCsvCoalescer(t *testing.T) {
+	original := DefaultTransport
+	DefaultTransport = NewChannelTransport()
+	defer func() { DefaultTransport = original }()
+
+	l, err := DefaultTransport.Listen(MAIN_SD_UNIX_SOCKET)
+	if err != nil {
+		t.Errorf("Listen(): %v", err)
+		return
+	}
+	received := make(chan *CsvRowsFileWriteJob, 8)
+	go ServeStructGob(l, func(d interface{}) error {
+		if job, ok := d.(*CsvRowsFileWriteJob); ok {
+			received <- job
+		}
+		return nil
+	}, nil)
+	defer l.Close()
+
+	primary := &PrimaryData{
+		PortentaSerial: "abc",
+		TeensyData:     NewTeensyData{UnixSec: 100, Counts: []*NewTeensyCounts{{NumPulses: 1}, {NumPulses: 2}, {NumPulses: 3}}},
+	}
+	jobs := NewCsvRowsFileWriteJobs(primary.CsvFileWriteJob("abc"))
+	if len(jobs) != 1 || len(jobs[0].Rows) != 3 {
+		t.Errorf("NewCsvRowsFileWriteJobs() returned %v, expected one job of 3 rows", jobs)
+		return
+	}
+
+	c := NewCsvCoalescer(MAIN_SD_UNIX_SOCKET, 4, 0, time.Hour)
+	c.AddRows(jobs[0])
+	c.Add(CsvFileWriteJob{Filename: jobs[0].Filename, Headers: jobs[0].Headers, Content: "row 4"}) // Reaches MaxRows
+	c.Add(CsvFileWriteJob{Filename: "other.csv", Headers: "x", Content: "1"})
+	if err := c.Close(); err != nil {
+		t.Errorf("c.Close(): %v", err)
+	}
+
+	sink := NewFileSink(t.TempDir(), 0)
+	for _, expectedRows := range []int{4, 1} {
+		select {
+		case job := <-received:
+			if len(job.Rows) != expectedRows {
+				t.Errorf("received %v, expected %d rows", job, expectedRows)
+			}
+			if err := sink.Write(job); err != nil {
+				t.Errorf("sink.Write(): %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("timed out waiting for rows")
+			return
+		}
+	}
+	sink.Close()
+
+	content, err := os.ReadFile(filepath.Join(sink.Root, jobs[0].Filename))
+	if err != nil {
+		t.Errorf("failed to read sink output: %v", err)
+		return
+	}
+	expected := jobs[0].Headers + "\n" + jobs[0].content() + "row 4\n"
+	if string(content) != expected {
+		t.Errorf("sink wrote '%s', expected '%s'", content, expected)
+	}
+}
+
+func TestCsvCoalescerLatency(t *testing.T) {
+	original := DefaultTransport
+	DefaultTransport = NewChannelTransport()
+	defer func() { DefaultTransport = original }()
+
+	l, _ := DefaultTransport.Listen(MAIN_SD_UNIX_SOCKET)
+	received := make(chan interface{}, 1)
+	go ServeStructGob(l, func(d interface{}) error {
+		received <- d
+		return nil
+	}, nil)
+	defer l.Close()
+
+	c := NewCsvCoalescer(MAIN_SD_UNIX_SOCKET, 0, 0, 10*time.Millisecond)
+	c.Add(CsvFileWriteJob{Filename: "a.csv", Content: "1"})
+	select {
+	case d := <-received:
+		if job, ok := d.(*CsvRowsFileWriteJob); !ok || len(job.Rows) != 1 {
+			t.Errorf("received %v, expected one row", d)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("rows were not sent after MaxLatency")
+	}
+}
+
+func TestCsvCoalescerKeepsFailedRows(t *testing.T) {
+	original := DefaultTransport
+	DefaultTransport = NewChannelTransport()
+	defer func() { DefaultTransport = original }()
+
+	c := NewCsvCoalescer(MAIN_SD_UNIX_SOCKET, 0, 0, 10*time.Millisecond)
+	c.Add(CsvFileWriteJob{Filename: "a.csv", Headers: "x", Content: "1"})
+	time.Sleep(50 * time.Millisecond) // Timer send fails, nothing listens yet
+	if err := c.Add(CsvFileWriteJob{Filename: "a.csv", Headers: "x", Content: "2"}); err == nil {
+		t.Errorf("expected the failed timer send to be reported")
+	}
+
+	l, err := DefaultTransport.Listen(MAIN_SD_UNIX_SOCKET)
+	if err != nil {
+		t.Errorf("Listen(): %v", err)
+		return
+	}
+	defer l.Close()
+	received := make(chan *CsvRowsFileWriteJob, 4)
+	go ServeStructGob(l, func(d interface{}) error {
+		if job, ok := d.(*CsvRowsFileWriteJob); ok {
+			received <- job
+		}
+		return nil
+	}, nil)
+	if err := c.Close(); err != nil {
+		t.Errorf("c.Close(): %v", err)
+	}
+
+	/* A retry on the timer may send part of them before Close sends the rest */
+	rows := []string{}
+	for len(rows) < 2 {
+		select {
+		case job := <-received:
+			rows = append(rows, job.Rows...)
+		case <-time.After(time.Second):
+			t.Errorf("timed out waiting for the kept rows, received %v", rows)
+			return
+		}
+	}
+	if len(rows) != 2 || rows[0] != "1" || rows[1] != "2" {
+		t.Errorf("received %v, expected both rows in order", rows)
+	}
+}
@@ -0,0 +1,324 @@
+package operadatatypes
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const DEFAULT_COMPRESS_DELAY = 5 * time.Minute
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Compresses data files under Root once their rotation period has ended, so
+// the SD card holds several times as much.
+type Compressor struct {
+	Root string
+
+	// How long after a file's period ends to wait for late records.
+	Delay time.Duration
+	// Files still open in the sink are closed before compressing, if set.
+	Sink *FileSink
+	// Updated with each compressed file, if set.
+	Catalog *Catalog
+
+	OnCompress func(path string, size, compressedSize int64)
+}
+
+func NewCompressor(root string, sink *FileSink) *Compressor {
+	return &Compressor{Root: root, Delay: DEFAULT_COMPRESS_DELAY, Sink: sink}
+}
+
+// Compresses every completed file that is not compressed yet, returning the
+// paths of the compressed files.
+func (c *Compressor) CompressCompleted() ([]string, error) {
+	ret := []string{}
+	completed := []string{}
+	now := time.Now()
+	err := filepath.WalkDir(c.Root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := ParseFileName(d.Name())
+		if err != nil || info.Compressed || now.Before(info.End().Add(c.Delay)) {
+			return nil
+		}
+		completed = append(completed, path)
+		return nil
+	})
+	if err != nil {
+		return ret, fmt.Errorf("failed to list files to compress: %v", err)
+	}
+
+	for _, path := range completed {
+		rel, err := filepath.Rel(c.Root, path)
+		if err != nil {
+			return ret, err
+		}
+		if c.Sink != nil {
+			if err := c.Sink.CloseFile(rel); err != nil {
+				return ret, err
+			}
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			return ret, fmt.Errorf("failed to stat file, '%s': %v", path, err)
+		}
+		finish := func(fn func() error) error { return fn() }
+		if c.Sink != nil {
+			finish = func(fn func() error) error { return c.Sink.whileClosed(rel, fn) }
+		}
+		compressedSize, err := gzipFile(path, finish)
+		if errors.Is(err, errFileChanged) {
+			continue // Written to while compressing, retried next time
+		} else if err != nil {
+			return ret, err
+		}
+		if c.Catalog != nil {
+			if err := catalogCompressed(c.Catalog, rel, path); err != nil {
+				return ret, err
+			}
+		}
+		if c.OnCompress != nil {
+			c.OnCompress(path, stat.Size(), compressedSize)
+		}
+		ret = append(ret, path+COMPRESSED_FILE_EXTENSION)
+	}
+	return ret, nil
+}
+
+// Calls CompressCompleted every interval until stop is closed. Errors go to
+// onError.
+func (c *Compressor) Run(interval time.Duration, stop <-chan struct{}, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := c.CompressCompleted(); err != nil && onError != nil {
+			onError(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+var errFileChanged = errors.New("file changed while compressing")
+
+// Replaces path with path.gz, returning the compressed size. The compressed
+// file is read back and checked against the original, which is only removed
+// once the compressed file is complete on disk. If path.gz already exists
+// (records arrived after the file was compressed) path is added to it as
+// another gzip member, without the header line it repeats.
+//
+// The final check that path is unchanged, the rename and the removal run
+// inside finish, which holds off writers to path; if path was written to
+// while compressing, the error is errFileChanged and path is left as is.
+func gzipFile(path string, finish func(func() error) error) (int64, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file, '%s': %v", path, err)
+	}
+	defer src.Close()
+	before, err := src.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat file, '%s': %v", path, err)
+	}
+
+	dstPath := path + COMPRESSED_FILE_EXTENSION
+	tmpPath := dstPath + ".tmp"
+	dst, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file, '%s': %v", tmpPath, err)
+	}
+	fail := func(err error) (int64, error) {
+		dst.Close()
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("failed to compress '%s': %v", path, err)
+	}
+
+	var memberStart, skipped int64
+	if existing, err := os.Open(dstPath); err == nil {
+		memberStart, err = io.Copy(dst, existing)
+		existing.Close()
+		if err != nil {
+			return fail(err)
+		}
+		if skipped, err = repeatedHeaderLen(path); err != nil {
+			return fail(err)
+		}
+		if _, err := src.Seek(skipped, io.SeekStart); err != nil {
+			return fail(err)
+		}
+	}
+
+	h := sha256.New()
+	zw := gzip.NewWriter(dst)
+	zw.Name = filepath.Base(path)
+	n, err := io.Copy(zw, io.TeeReader(src, h))
+	if err != nil {
+		return fail(err)
+	}
+	if err := zw.Close(); err != nil {
+		return fail(err)
+	}
+	if err := dst.Sync(); err != nil {
+		return fail(err)
+	}
+	info, err := dst.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	if err := dst.Close(); err != nil {
+		return fail(err)
+	}
+
+	/* Integrity check */
+	if err := verifyGzipMember(tmpPath, memberStart, n, h.Sum(nil)); err != nil {
+		return fail(err)
+	}
+
+	err = finish(func() error {
+		stat, err := os.Stat(path)
+		if err != nil || stat.Size() != skipped+n || !stat.ModTime().Equal(before.ModTime()) {
+			return errFileChanged
+		}
+		if err := os.Rename(tmpPath, dstPath); err != nil {
+			return fmt.Errorf("failed to rename '%s': %v", tmpPath, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove '%s' after compressing: %v", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return info.Size() - memberStart, nil
+}
+
+// Returns the length of the header line of the CSV file at path if it repeats
+// the header of path.gz, which path continues, or 0.
+func repeatedHeaderLen(path string) (int64, error) {
+	if filepath.Ext(path) != CSV_FILE_EXTENSION {
+		return 0, nil
+	}
+	header, err := firstLine(path)
+	if err != nil || header == "" {
+		return 0, err
+	}
+	compressedHeader, err := firstLine(path + COMPRESSED_FILE_EXTENSION)
+	if err != nil || compressedHeader != header {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file, '%s': %v", path, err)
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	return int64(len(line)), nil
+}
+
+// Returns the first line of the data file at path without its line ending,
+// or "" if it does not exist or is empty.
+func firstLine(path string) (string, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return "", nil
+	}
+	f, err := OpenDataFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && line == "" {
+		return "", nil
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Moves filename's catalog entry to the compressed file at path.gz.
+func catalogCompressed(catalog *Catalog, filename, path string) error {
+	size, sum, err := fileSha256(path + COMPRESSED_FILE_EXTENSION)
+	if err != nil {
+		return err
+	}
+	catalog.recordCompressed(filename, size, sum)
+	return catalog.Save()
+}
+
+// Checks that the gzip member at offset in path decompresses to size bytes
+// with the given SHA-256.
+func verifyGzipMember(path string, offset, size int64, sum []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("compressed data is unreadable: %v", err)
+	}
+	zr.Multistream(false)
+	h := sha256.New()
+	n, err := io.Copy(h, zr)
+	if err != nil {
+		return fmt.Errorf("compressed data is unreadable: %v", err)
+	}
+	if n != size || !bytes.Equal(h.Sum(nil), sum) {
+		return fmt.Errorf("compressed data does not match the original")
+	}
+	return nil
+}
+
+/* Reading */
+
+// Returns r, decompressing it if it starts with a gzip header.
+func maybeGunzip(r *bufio.Reader) (io.Reader, error) {
+	if magic, err := r.Peek(len(gzipMagic)); err != nil || !bytes.Equal(magic, gzipMagic) {
+		return r, nil
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gzip header: %v", err)
+	}
+	return zr, nil
+}
+
+type dataFile struct {
+	io.Reader
+	f *os.File
+}
+
+func (d *dataFile) Close() error {
+	return d.f.Close()
+}
+
+// Opens a data file for reading, decompressing .gz files (or any starting with
+// a gzip header) transparently.
+func OpenDataFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file, '%s': %v", path, err)
+	}
+	r, err := maybeGunzip(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open file, '%s': %v", path, err)
+	}
+	return &dataFile{Reader: r, f: f}, nil
+}
@@ -0,0 +1,119 @@
+package operadatatypes
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressorCompletedFiles(t *testing.T) {
+	root := t.TempDir()
+	sink := NewFileSink(root, 0)
+	defer sink.Close()
+
+	secondary := &SecondaryData{UnixSec: 100, PortentaSerial: "abc", Co2: 410}
+	rawName, csvName := "OPERA_abc_SecondaryRaw_20261016.raw", "OPERA_abc_Output_20261016.csv"
+	for _, job := range secondary.BinaryFileWriteJob("abc") {
+		job.Filename = rawName
+		sink.Write(job)
+	}
+	sink.Write(CsvFileWriteJob{Filename: csvName, Headers: "unix,x", Content: "100,1"})
+	os.WriteFile(filepath.Join(root, "OPERA_abc_Output_29991231.csv"), []byte("unix,x\n"), 0644)
+
+	c := NewCompressor(root, sink)
+	compressed, err := c.CompressCompleted()
+	if err != nil {
+		t.Errorf("c.CompressCompleted(): %v", err)
+		return
+	}
+	if len(compressed) != 2 {
+		t.Errorf("compressed %v, expected the two completed files", compressed)
+	}
+	if _, err := os.Stat(filepath.Join(root, "OPERA_abc_Output_29991231.csv")); err != nil {
+		t.Errorf("file of a period that has not ended was compressed")
+	}
+
+	/* Readers see through the compression */
+	f, err := OpenDataFile(filepath.Join(root, csvName+COMPRESSED_FILE_EXTENSION))
+	if err != nil {
+		t.Errorf("OpenDataFile(): %v", err)
+		return
+	}
+	content, _ := io.ReadAll(f)
+	f.Close()
+	if string(content) != "unix,x\n100,1\n" {
+		t.Errorf("decompressed csv is '%s'", content)
+	}
+	f, _ = os.Open(filepath.Join(root, rawName+COMPRESSED_FILE_EXTENSION))
+	defer f.Close()
+	reader := NewRawArchiveReader(f)
+	if d, err := reader.Next(); err != nil || OutputDataUnixSec(d) != 100 {
+		t.Errorf("reader.Next() on compressed archive returned %v, %v", d, err)
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF after the only record, got %v", err)
+	}
+	if info, err := ParseFileName(rawName + COMPRESSED_FILE_EXTENSION); err != nil || !info.Compressed || info.Extension != BINARY_FILE_EXTENSION {
+		t.Errorf("ParseFileName() of compressed file returned %+v, %v", info, err)
+	}
+
+	/* A late record is added to the compressed file rather than replacing it */
+	sink.Write(CsvFileWriteJob{Filename: csvName, Headers: "unix,x", Content: "101,2"})
+	sink.Flush()
+	if b, _ := os.ReadFile(filepath.Join(root, csvName)); string(b) != "unix,x\n101,2\n" {
+		t.Errorf("late record went to a file holding '%s', expected it to have the header", b)
+	}
+	if _, err := c.CompressCompleted(); err != nil {
+		t.Errorf("c.CompressCompleted(): %v", err)
+	}
+	f, _ = OpenDataFile(filepath.Join(root, csvName+COMPRESSED_FILE_EXTENSION))
+	content, _ = io.ReadAll(f)
+	f.Close()
+	if string(content) != "unix,x\n100,1\n101,2\n" {
+		t.Errorf("decompressed csv after late record is '%s'", content)
+	}
+
+	/* A late record with other headers is told apart from the compressed file */
+	if err := sink.Write(CsvFileWriteJob{Filename: csvName, Headers: "unix,x,y", Content: "102,3,4"}); err != nil {
+		t.Errorf("sink.Write(): %v", err)
+	}
+	sink.Flush()
+	if _, err := os.Stat(filepath.Join(root, csvName)); !os.IsNotExist(err) {
+		t.Errorf("late record with other headers was added to %s", csvName)
+	}
+	if b, _ := os.ReadFile(filepath.Join(root, versionedFileName(csvName, 2))); string(b) != "unix,x,y\n102,3,4\n" {
+		t.Errorf("late record with other headers went to a file holding '%s'", b)
+	}
+}
+
+func TestCompressLateWrite(t *testing.T) {
+	root := t.TempDir()
+	sink := NewFileSink(root, 0)
+	defer sink.Close()
+	name := "OPERA_abc_Output_20261016.csv"
+	path := filepath.Join(root, name)
+	sink.Write(CsvFileWriteJob{Filename: name, Headers: "unix,x", Content: "100,1"})
+	sink.CloseFile(name)
+
+	/* A record written between closing the file and removing it */
+	_, err := gzipFile(path, func(fn func() error) error {
+		sink.Write(CsvFileWriteJob{Filename: name, Headers: "unix,x", Content: "101,2"})
+		return sink.whileClosed(name, fn)
+	})
+	if err != errFileChanged {
+		t.Errorf("gzipFile() returned %v, expected errFileChanged", err)
+	}
+	sink.Flush()
+	if b, err := os.ReadFile(path); err != nil || string(b) != "unix,x\n100,1\n101,2\n" {
+		t.Errorf("file after the late write is '%s' (err %v)", b, err)
+	}
+	if _, err := os.Stat(path + COMPRESSED_FILE_EXTENSION); !os.IsNotExist(err) {
+		t.Errorf("compressed file was kept although the original changed")
+	}
+
+	/* Compressed on the next pass once the sink has closed it */
+	if compressed, err := NewCompressor(root, sink).CompressCompleted(); err != nil || len(compressed) != 1 {
+		t.Errorf("CompressCompleted() returned %v, %v", compressed, err)
+	}
+}
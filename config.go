@@ -10,18 +10,44 @@ import (
 const CONFIG_FILE_LOCATION = "/etc/telosair/opera.conf"
 
 type ConfigStruct struct {
-	OutputToCsv bool `json:"output_to_csv"`
-	OutputToRaw bool `json:"output_to_raw"`
+	OutputToCsv   bool `json:"output_to_csv"`
+	OutputToRaw   bool `json:"output_to_raw"`
+	OutputToJsonl bool `json:"output_to_jsonl"`
+	// Also write PrimaryData.PulsesCsvFileWriteJob, one row per pulse.
+	OutputPulsesToCsv bool `json:"output_pulses_to_csv"`
+
+	// Keyed by data label, e.g. "PrimaryRaw". Pass to SetRotationPolicies, or
+	// to FileSink.SetRotationPolicies for one sink.
+	Rotation map[string]RotationPolicy `json:"rotation,omitempty"`
+	// Pass to SetNamingPolicy, or to FileSink.SetNamingPolicy for one sink.
+	Naming NamingPolicy `json:"naming"`
+	// Pass to SetCsvFormatPolicy. Columns given in the file are added to the
+	// default ones.
+	CsvFormat CsvFormatPolicy `json:"csv_format"`
+
+	Retention  RetentionPolicy  `json:"retention"`
+	Durability DurabilityPolicy `json:"durability"`
+	// Pass to NewInfluxWriter when Influx.Enabled().
+	Influx InfluxConfig `json:"influx"`
 }
 
 func GetDefaultConfig() ConfigStruct {
 	return ConfigStruct{
-		true, true,
+		OutputToCsv: true,
+		OutputToRaw: true,
+		Naming:      GetDefaultNamingPolicy(),
+		CsvFormat:   GetDefaultCsvFormatPolicy(),
+		Retention:   GetDefaultRetentionPolicy(),
+		Durability:  GetDefaultDurabilityPolicy(),
+		Influx:      GetDefaultInfluxConfig(),
 	}
 }
 
+// Settings missing from the file keep their GetDefaultConfig values, except
+// output_to_csv and output_to_raw, which stay false as they always have.
 func readConfigFile(filepath string) (ConfigStruct, error) {
-	ret := ConfigStruct{}
+	ret := GetDefaultConfig()
+	ret.OutputToCsv, ret.OutputToRaw = false, false
 
 	f, err := os.Open(filepath)
 	if err != nil {
@@ -31,6 +31,17 @@ func TestReadConfigFile(t *testing.T) {
 		return
 	}
 	if (c.OutputToCsv != false) || (c.OutputToRaw != true) {
-		t.Errorf("ConfigStruct was expected like %v, got %v", ConfigStruct{false, true}, c)
+		t.Errorf("ConfigStruct was expected like %v, got %v", ConfigStruct{OutputToCsv: false, OutputToRaw: true}, c)
+	}
+
+	/* A file without the output keys leaves them off but fills in the new sections */
+	os.WriteFile(TEST_CONFIG_LOCATION, []byte("{}"), 0677)
+	c, err = readConfigFile(TEST_CONFIG_LOCATION)
+	if err != nil {
+		t.Errorf("readConfigFile(): %v", err)
+		return
+	}
+	if c.OutputToCsv || c.OutputToRaw || c.Durability != GetDefaultDurabilityPolicy() {
+		t.Errorf("ConfigStruct of an empty file is %+v", c)
 	}
 }
@@ -0,0 +1,87 @@
+package operadatatypes
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Returns fields as one RFC 4180 CSV row, without the line ending. Fields are
+// quoted only where needed, e.g. when they hold a comma or a quote.
+func csvRecord(fields ...string) string {
+	var sb strings.Builder
+	w := csv.NewWriter(&sb)
+	w.Write(fields) // Only fails on write errors, which strings.Builder has none of
+	w.Flush()
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// Splits one CSV row into its fields.
+func parseCsvRecord(row string) ([]string, error) {
+	r := csv.NewReader(strings.NewReader(row))
+	r.FieldsPerRecord = -1
+	return r.Read()
+}
+
+/* List encoding */
+
+// Array-valued fields are encoded as JSON lists: ["dust","smoke"] for strings
+// and [0.1,0.8,0.1] for numbers, each in the column's ColumnFormat. JSON has no
+// NaN or infinity, so those are written as null and null reads back as NaN. An
+// empty list is [].
+
+func csvStringList(items []string) string {
+	if len(items) == 0 {
+		return "[]"
+	}
+	b, _ := json.Marshal(items)
+	return string(b)
+}
+
+func parseCsvStringList(field string) ([]string, error) {
+	ret := []string{}
+	if field == "" {
+		return ret, nil
+	}
+	if err := json.Unmarshal([]byte(field), &ret); err != nil {
+		return nil, fmt.Errorf("bad string list '%s': %v", field, err)
+	}
+	return ret, nil
+}
+
+func csvFloatList(items []float32, format ColumnFormat) string {
+	parts := make([]string, len(items))
+	for i, v := range items {
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			parts[i] = "null"
+		} else {
+			parts[i] = format.format(v)
+		}
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+func parseCsvFloatList(field string) ([]float32, error) {
+	ret := []float32{}
+	field = strings.TrimSpace(field)
+	if field == "" {
+		return ret, nil
+	}
+	if !strings.HasPrefix(field, "[") || !strings.HasSuffix(field, "]") {
+		return nil, fmt.Errorf("bad number list '%s'", field)
+	}
+	inner := field[1 : len(field)-1]
+	if strings.TrimSpace(inner) == "" {
+		return ret, nil
+	}
+	for _, part := range strings.Split(inner, ",") {
+		v, err := parseCsvFloat(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("bad number list '%s': %v", field, err)
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
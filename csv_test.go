@@ -0,0 +1,186 @@
+package operadatatypes
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+// Parses a job's headers and content with encoding/csv, mapping each column
+// to its value.
+func parseCsvJob(t *testing.T, job CsvFileWriteJob) map[string]string {
+	rows, err := csv.NewReader(strings.NewReader(job.Headers + "\n" + job.Content + "\n")).ReadAll()
+	if err != nil {
+		t.Errorf("encoding/csv failed to read %s: %v", job.Filename, err)
+		return nil
+	}
+	if len(rows) != 2 {
+		t.Errorf("%s parsed into %d rows, expected 2", job.Filename, len(rows))
+		return nil
+	}
+	ret := map[string]string{}
+	for i, column := range rows[0] {
+		ret[column] = rows[1][i]
+	}
+	return ret
+}
+
+func TestCsvRoundTrip(t *testing.T) {
+	serial := `ab,"c"`
+	opera := &OperaData{
+		UnixSec:        100,
+		PortentaSerial: serial,
+		ClassLabel:     "smoke, wood",
+		ClassLabels:    []string{"dust", "smoke, wood", `say "hi"`},
+		ClassProbs:     []float32{0.1, 0.8, 0.1},
+		Co2:            410,
+	}
+	row := parseCsvJob(t, opera.CsvFileWriteJob("abc")[0])
+	if row == nil {
+		return
+	}
+	if row["portenta"] != serial || row["class_label"] != opera.ClassLabel || row["co2"] != "410" {
+		t.Errorf("output row has unexpected values: %v", row)
+	}
+	labels, err := parseCsvStringList(row["class_labels"])
+	if err != nil || len(labels) != 3 || labels[1] != "smoke, wood" || labels[2] != `say "hi"` {
+		t.Errorf("class_labels '%s' parsed to %v (err %v)", row["class_labels"], labels, err)
+	}
+	probs, err := parseCsvFloatList(row["class_probs"])
+	if err != nil || len(probs) != 3 || probs[1] != 0.8 {
+		t.Errorf("class_probs '%s' parsed to %v (err %v)", row["class_probs"], probs, err)
+	}
+
+	secondary := &SecondaryData{UnixSec: 101, PortentaSerial: serial, Monitor5vMean: 4.98766}
+	if row := parseCsvJob(t, secondary.CsvFileWriteJob("abc")[0]); row != nil && (row["portenta"] != serial || row["mean_5v_monitor"] != "4.9877") {
+		t.Errorf("secondary row has unexpected values: %v", row)
+	}
+
+	primary := &PrimaryData{
+		PortentaSerial: serial,
+		TeensyData: NewTeensyData{UnixSec: 102, Counts: []*NewTeensyCounts{{
+			NumPulses: 2,
+			Pulses:    []NewPulse{{RawPeak: 25, SidePeak: 20, Indices: [8]uint16{1, 2, 3, 4, 5, 6, 7, 8}}, {RawPeak: 3}},
+		}, {}}},
+	}
+	jobs := primary.CsvFileWriteJob("abc")
+	if row := parseCsvJob(t, jobs[0]); row != nil && row["pulses"] != "[(25,20,[1,2,3,4,5,6,7,8]),(3,0,[0,0,0,0,0,0,0,0])]" {
+		t.Errorf("pulses column is '%s'", row["pulses"])
+	}
+	if row := parseCsvJob(t, jobs[1]); row != nil && (row["pulses"] != "" || row["portenta"] != serial) {
+		t.Errorf("row without pulses has unexpected values: %v", row)
+	}
+}
+
+func TestCsvListEncoding(t *testing.T) {
+	if s := csvStringList(nil); s != "[]" {
+		t.Errorf("empty string list encoded as '%s'", s)
+	}
+	if l, err := parseCsvFloatList("[]"); err != nil || len(l) != 0 {
+		t.Errorf("parseCsvFloatList([]) returned %v, %v", l, err)
+	}
+	if l, err := parseCsvFloatList("[NaN, 1.5]"); err != nil || len(l) != 2 || l[0] == l[0] || l[1] != 1.5 {
+		t.Errorf("parseCsvFloatList([NaN, 1.5]) returned %v, %v", l, err)
+	}
+
+	/* NaN and infinity are written as null so the list stays valid JSON */
+	encoded := csvFloatList([]float32{float32(math.NaN()), 0.5, float32(math.Inf(1))}, ColumnFormat{Decimals: 2, NaN: "NA"})
+	if encoded != "[null,0.50,null]" {
+		t.Errorf("list with NaN encoded as '%s'", encoded)
+	}
+	var decoded []*float64
+	if err := json.Unmarshal([]byte(encoded), &decoded); err != nil {
+		t.Errorf("list '%s' is not valid JSON: %v", encoded, err)
+	}
+	if l, err := parseCsvFloatList(encoded); err != nil || len(l) != 3 || l[0] == l[0] || l[1] != 0.5 || l[2] == l[2] {
+		t.Errorf("parseCsvFloatList(%s) returned %v, %v", encoded, l, err)
+	}
+	if _, err := parseCsvFloatList("0.1 0.8"); err == nil {
+		t.Errorf("expected an error for the old space separated list format")
+	}
+}
+
+func TestCsvFormatPolicy(t *testing.T) {
+	defer SetCsvFormatPolicy(GetDefaultCsvFormatPolicy())
+
+	secondary := &SecondaryData{UnixSec: 100, Sps30: Sps30Data{Pm2p5: 0.37, Pn0p5: 1234.56}, FlowRate: float32(math.NaN())}
+	row := parseCsvJob(t, secondary.CsvFileWriteJob("abc")[0])
+	if row["sps30_pm2p5"] != "0.37" || row["sps30_pn0p5"] != "1234.56" || row["flow_rate"] != "NaN" {
+		t.Errorf("default formats gave %v", row)
+	}
+
+	policy := GetDefaultCsvFormatPolicy()
+	policy.Default.NaN = "NA"
+	policy.Columns["sps30_pn0p5"] = ColumnFormat{Decimals: 2, Scientific: true}
+	policy.Columns["PM2_5"] = ColumnFormat{Decimals: -1}
+	if err := SetCsvFormatPolicy(policy); err != nil {
+		t.Errorf("SetCsvFormatPolicy(): %v", err)
+		return
+	}
+	row = parseCsvJob(t, secondary.CsvFileWriteJob("abc")[0])
+	if row["sps30_pn0p5"] != "1.23e+03" || row["flow_rate"] != "NA" {
+		t.Errorf("configured formats gave %v", row)
+	}
+	opera := &OperaData{ClassProbs: []float32{float32(math.NaN()), 0.25}}
+	opera.Concentrations.PM2p5 = 1.0 / 3
+	row = parseCsvJob(t, opera.CsvFileWriteJob("abc")[0])
+	if row["PM2_5"] != "0.33333334" || row["class_probs"] != "[null,0.250]" {
+		t.Errorf("configured formats gave %v", row)
+	}
+
+	/* The readers take the configured NaN back */
+	r, _ := NewSecondaryCsvReader(strings.NewReader("unix,flow_rate\n100,NA\n"))
+	if d, err := r.Next(); err != nil || !math.IsNaN(float64(d.FlowRate)) {
+		t.Errorf("reading NA gave %+v, %v", d, err)
+	}
+
+	if err := SetCsvFormatPolicy(CsvFormatPolicy{Default: ColumnFormat{Decimals: 11}}); err == nil {
+		t.Errorf("expected an error for 11 decimals")
+	}
+	if err := SetCsvFormatPolicy(CsvFormatPolicy{Columns: map[string]ColumnFormat{"co2": {NaN: "n,a"}}}); err == nil {
+		t.Errorf("expected an error for a NaN representation with a comma")
+	}
+	for _, nan := range []string{"0", "-1", "1e3", "Inf"} {
+		if err := SetCsvFormatPolicy(CsvFormatPolicy{Default: ColumnFormat{NaN: nan}}); err == nil {
+			t.Errorf("expected an error for the NaN representation '%s', a number", nan)
+		}
+	}
+
+	/* NA from a file written under the earlier policy still reads back as NaN */
+	SetCsvFormatPolicy(GetDefaultCsvFormatPolicy())
+	for _, nan := range []string{"NA", "NaN", "", "null"} {
+		if v, err := parseCsvFloat(nan); err != nil || !math.IsNaN(float64(v)) {
+			t.Errorf("parseCsvFloat(%q) returned %v, %v", nan, v, err)
+		}
+	}
+}
+
+func TestPulsesCsv(t *testing.T) {
+	primary := &PrimaryData{PortentaSerial: "abc", TeensyData: NewTeensyData{UnixSec: 102, MilliSec: 250, Counts: []*NewTeensyCounts{
+		{PinLaser: 1, Baseline0: 10.5, Pulses: []NewPulse{{RawPeak: 25, SidePeak: 20, Indices: [8]uint16{1, 2, 3, 4, 5, 6, 7, 8}}, {RawPeak: 3}}},
+		{PinLaser: 2},
+		{PinLaser: 3, Pulses: []NewPulse{{RawPeak: 7}}},
+	}}}
+	jobs := primary.PulsesCsvFileWriteJob("abc")
+	if len(jobs) != 1 || !strings.Contains(jobs[0].Filename, "_"+DATA_LABEL_PULSES+"_") {
+		t.Errorf("expected one Pulses job, got %v", jobs)
+		return
+	}
+	rows, err := csv.NewReader(strings.NewReader(jobs[0].Headers + "\n" + jobs[0].content())).ReadAll()
+	if err != nil || len(rows) != 4 {
+		t.Errorf("pulses job parsed into %v (err %v), expected a header and 3 rows", rows, err)
+		return
+	}
+	if strings.Join(rows[0], ",") != "unix,ms,portenta,pd0,pd1,laser,baseline0,baseline1,raw_peak,side_peak,index0,index1,index2,index3,index4,index5,index6,index7" {
+		t.Errorf("pulses header is %v", rows[0])
+	}
+	if strings.Join(rows[1], ",") != "102,250,abc,0,0,1,10.5,0.0,25,20,1,2,3,4,5,6,7,8" || rows[3][5] != "3" || rows[3][8] != "7" {
+		t.Errorf("pulses rows are %v", rows[1:])
+	}
+
+	if jobs := (&PrimaryData{TeensyData: NewTeensyData{Counts: []*NewTeensyCounts{{}}}}).PulsesCsvFileWriteJob("abc"); len(jobs) != 0 {
+		t.Errorf("expected no job without pulses, got %v", jobs)
+	}
+}
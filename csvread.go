@@ -0,0 +1,399 @@
+package operadatatypes
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Reads CSV rows and looks their fields up by column name. Conversion errors
+// are collected per row and reported with the row's line number by rowErr.
+type csvRowReader struct {
+	r       *csv.Reader
+	header  []string // Lower case
+	columns map[string]int
+	row     []string
+	line    int
+	err     error
+}
+
+func newCsvRowReader(r io.Reader, required ...string) (*csvRowReader, error) {
+	zr, err := maybeGunzip(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	c := &csvRowReader{r: csv.NewReader(zr), columns: map[string]int{}}
+	c.r.FieldsPerRecord = -1
+	header, err := c.r.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("csv has no header")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read csv header: %v", err)
+	}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		c.header = append(c.header, name)
+		c.columns[name] = i
+	}
+	for _, name := range required {
+		if _, ok := c.columns[name]; !ok {
+			return nil, fmt.Errorf("csv header is missing column '%s'", name)
+		}
+	}
+	return c, nil
+}
+
+// Reads the next row. Returns io.EOF at the end.
+func (c *csvRowReader) next() error {
+	row, err := c.r.Read()
+	if err == io.EOF {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("failed to read csv: %v", err)
+	}
+	c.row = row
+	c.line, _ = c.r.FieldPos(0)
+	c.err = nil
+	return nil
+}
+
+// Returns the field of the first of names (current name first, then older
+// ones) the header has, and whether the row has it; "" and false if it has
+// none of them.
+func (c *csvRowReader) field(names ...string) (string, string, bool) {
+	for _, name := range names {
+		if i, ok := c.columns[strings.ToLower(name)]; ok && i < len(c.row) {
+			return name, strings.TrimSpace(c.row[i]), true
+		}
+	}
+	return names[0], "", false
+}
+
+func (c *csvRowReader) fail(column string, err error) {
+	if c.err == nil {
+		c.err = fmt.Errorf("line %d: column %s: %v", c.line, column, err)
+	}
+}
+
+// Returns the first conversion error in the current row.
+func (c *csvRowReader) rowErr() error {
+	return c.err
+}
+
+func (c *csvRowReader) str(names ...string) string {
+	_, v, _ := c.field(names...)
+	return v
+}
+
+// Reads a number, giving NaN for an empty field or a column the header does
+// not have, as for a value that was never measured.
+func (c *csvRowReader) float(names ...string) float32 {
+	column, v, ok := c.field(names...)
+	if !ok {
+		return float32(math.NaN())
+	}
+	f, err := parseCsvFloat(v)
+	if err != nil {
+		c.fail(column, err)
+	}
+	return f
+}
+
+func (c *csvRowReader) uint(bits int, names ...string) uint64 {
+	column, v, _ := c.field(names...)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.ParseUint(v, 10, bits)
+	if err != nil {
+		c.fail(column, err)
+	}
+	return n
+}
+
+func (c *csvRowReader) int(bits int, names ...string) int64 {
+	column, v, _ := c.field(names...)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.ParseInt(v, 10, bits)
+	if err != nil {
+		c.fail(column, err)
+	}
+	return n
+}
+
+func (c *csvRowReader) bool(names ...string) bool {
+	column, v, _ := c.field(names...)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		c.fail(column, err)
+	}
+	return b
+}
+
+// Reads a list column, also accepting the space separated lists older files
+// have, e.g. [dust smoke pollen].
+func (c *csvRowReader) stringList(names ...string) []string {
+	column, v, _ := c.field(names...)
+	l, err := parseCsvStringList(v)
+	if err == nil {
+		return l
+	}
+	if legacy, ok := legacyCsvList(v); ok {
+		return legacy
+	}
+	c.fail(column, err)
+	return nil
+}
+
+func (c *csvRowReader) floatList(names ...string) []float32 {
+	column, v, _ := c.field(names...)
+	l, err := parseCsvFloatList(v)
+	if err == nil {
+		return l
+	}
+	if legacy, ok := legacyCsvList(v); ok {
+		l = make([]float32, len(legacy))
+		for i, s := range legacy {
+			f, err := parseCsvFloat(s)
+			if err != nil {
+				c.fail(column, err)
+				return nil
+			}
+			l[i] = f
+		}
+		return l
+	}
+	c.fail(column, err)
+	return nil
+}
+
+func legacyCsvList(field string) ([]string, bool) {
+	inner, ok := strings.CutPrefix(field, "[")
+	if !ok {
+		return nil, false
+	}
+	inner, ok = strings.CutSuffix(inner, "]")
+	if !ok || strings.ContainsAny(inner, `,"`) {
+		return nil, false
+	}
+	return strings.Fields(inner), true
+}
+
+var pulsePattern = regexp.MustCompile(`\((\d+),(\d+),\[([\d,]*)\]\)`)
+
+// Parses the pulses column written by pulsesCsvString.
+func parsePulses(field string) ([]NewPulse, error) {
+	ret := []NewPulse{}
+	if field == "" || field == "[]" {
+		return ret, nil
+	}
+	inner, ok := strings.CutPrefix(field, "[")
+	if inner, ok2 := strings.CutSuffix(inner, "]"); ok && ok2 {
+		field = inner
+	} else {
+		return nil, fmt.Errorf("bad pulses '%s'", field)
+	}
+
+	consumed := 0
+	for _, m := range pulsePattern.FindAllStringSubmatchIndex(field, -1) {
+		if m[0] != consumed && !(m[0] == consumed+1 && field[consumed] == ',') {
+			return nil, fmt.Errorf("bad pulse at '%s'", field[consumed:])
+		}
+		consumed = m[1]
+		p := NewPulse{}
+		raw, _ := strconv.ParseUint(field[m[2]:m[3]], 10, 16)
+		side, _ := strconv.ParseUint(field[m[4]:m[5]], 10, 16)
+		p.RawPeak, p.SidePeak = uint16(raw), uint16(side)
+		indices := strings.Split(field[m[6]:m[7]], ",")
+		if len(indices) != NUMBER_INDICES_PULSE {
+			return nil, fmt.Errorf("pulse has %d indices, expected %d", len(indices), NUMBER_INDICES_PULSE)
+		}
+		for i, s := range indices {
+			n, err := strconv.ParseUint(s, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("bad pulse index '%s': %v", s, err)
+			}
+			p.Indices[i] = uint16(n)
+		}
+		ret = append(ret, p)
+	}
+	if consumed != len(field) {
+		return nil, fmt.Errorf("bad pulse at '%s'", field[consumed:])
+	}
+	return ret, nil
+}
+
+func (c *csvRowReader) pulses(names ...string) []NewPulse {
+	column, v, _ := c.field(names...)
+	p, err := parsePulses(v)
+	if err != nil {
+		c.fail(column, err)
+	}
+	return p
+}
+
+/* SecondaryRaw */
+
+// Reads SecondaryData back from a SecondaryRaw CSV file, compressed or not.
+type SecondaryCsvReader struct {
+	c *csvRowReader
+}
+
+func NewSecondaryCsvReader(r io.Reader) (*SecondaryCsvReader, error) {
+	c, err := newCsvRowReader(r, "unix")
+	if err != nil {
+		return nil, err
+	}
+	return &SecondaryCsvReader{c: c}, nil
+}
+
+// Returns the next record, or io.EOF at the end of the file.
+func (r *SecondaryCsvReader) Next() (*SecondaryData, error) {
+	c := r.c
+	if err := c.next(); err != nil {
+		return nil, err
+	}
+	d := &SecondaryData{}
+	SecondaryRawSchema.read(c, d)
+	return d, c.rowErr()
+}
+
+/* Output */
+
+// Reads OperaData back from an Output CSV file, compressed or not.
+// Files with prob_<label> columns instead of class_probs read back with the
+// labels of the CsvFormatPolicy's ClassLabels the columns were named after.
+// Other columns give their name's label part, e.g. "wood_smoke" for
+// "Wood Smoke", as the column name does not keep the original label.
+type OperaCsvReader struct {
+	c           *csvRowReader
+	probColumns []string
+	probLabels  []string
+}
+
+func NewOperaCsvReader(r io.Reader) (*OperaCsvReader, error) {
+	c, err := newCsvRowReader(r, "unix")
+	if err != nil {
+		return nil, err
+	}
+	ret := &OperaCsvReader{c: c}
+	if _, packed := c.columns["class_probs"]; !packed {
+		known := map[string]string{}
+		labels := GetCsvFormatPolicy().ClassLabels
+		i := 0
+		for _, f := range wideOutputSchema(labels).Fields {
+			if f.Source == "ClassProbs" {
+				known[f.Name] = labels[i]
+				i++
+			}
+		}
+		for _, name := range c.header {
+			if strings.HasPrefix(name, CLASS_PROB_COLUMN_PREFIX) {
+				label, ok := known[name]
+				if !ok {
+					label = strings.TrimPrefix(name, CLASS_PROB_COLUMN_PREFIX)
+				}
+				ret.probColumns = append(ret.probColumns, name)
+				ret.probLabels = append(ret.probLabels, label)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Returns the next record, or io.EOF at the end of the file.
+func (r *OperaCsvReader) Next() (*OperaData, error) {
+	c := r.c
+	if err := c.next(); err != nil {
+		return nil, err
+	}
+	d := &OperaData{}
+	OutputSchema.read(c, d)
+	if len(r.probColumns) > 0 {
+		d.ClassLabels = make([]string, len(r.probColumns))
+		d.ClassProbs = make([]float32, len(r.probColumns))
+		for i, name := range r.probColumns {
+			d.ClassLabels[i] = r.probLabels[i]
+			d.ClassProbs[i] = c.float(name)
+		}
+	}
+	return d, c.rowErr()
+}
+
+/* PrimaryRaw */
+
+// Reads PrimaryData back from a PrimaryRaw CSV file, compressed or not.
+// Consecutive rows of the same reading (unix, ms and serial) are the counts of
+// one record. Values the CSV does not hold, e.g. the Teensy's MCU temperature,
+// are left zero.
+type PrimaryCsvReader struct {
+	c       *csvRowReader
+	pending *PrimaryData // Record whose first row has been read
+	err     error        // Of a row read after the record returned last
+}
+
+func NewPrimaryCsvReader(r io.Reader) (*PrimaryCsvReader, error) {
+	c, err := newCsvRowReader(r, "unix")
+	if err != nil {
+		return nil, err
+	}
+	return &PrimaryCsvReader{c: c}, nil
+}
+
+// Returns the record and its counts of the current row.
+func (r *PrimaryCsvReader) readRow() (*PrimaryData, *NewTeensyCounts, error) {
+	row := &PrimaryRawRow{Data: &PrimaryData{}, Counts: &NewTeensyCounts{}}
+	PrimaryRawSchema.read(r.c, row)
+	return row.Data, row.Counts, r.c.rowErr()
+}
+
+// Returns the next record, or io.EOF at the end of the file. A row that fails
+// to read ends the record collected so far, which is returned first; the
+// row's error comes with the following call, and reading goes on after it.
+func (r *PrimaryCsvReader) Next() (*PrimaryData, error) {
+	if err := r.err; err != nil {
+		r.err = nil
+		return nil, err
+	}
+	d := r.pending
+	r.pending = nil
+	for {
+		err := r.c.next()
+		if err == io.EOF && d != nil {
+			return d, nil
+		} else if err != nil {
+			return r.deferErr(d, err)
+		}
+		row, counts, err := r.readRow()
+		if err != nil {
+			return r.deferErr(d, err)
+		}
+		if d == nil {
+			d = row
+		} else if row.TeensyData.UnixSec != d.TeensyData.UnixSec || row.TeensyData.MilliSec != d.TeensyData.MilliSec || row.PortentaSerial != d.PortentaSerial {
+			row.TeensyData.Counts = []*NewTeensyCounts{counts}
+			r.pending = row
+			return d, nil
+		}
+		d.TeensyData.Counts = append(d.TeensyData.Counts, counts)
+	}
+}
+
+// Returns d, keeping err for the next call, or err now if there is no d.
+func (r *PrimaryCsvReader) deferErr(d *PrimaryData, err error) (*PrimaryData, error) {
+	if d == nil {
+		return nil, err
+	}
+	r.err = err
+	return d, nil
+}
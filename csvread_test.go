@@ -0,0 +1,219 @@
+package operadatatypes
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func csvFile(jobs []CsvFileWriteJob) string {
+	content := jobs[0].Headers + "\n"
+	for _, job := range jobs {
+		content += job.Content + "\n"
+	}
+	return content
+}
+
+func TestCsvReadersRoundTrip(t *testing.T) {
+	secondary := &SecondaryData{UnixSec: 101, PortentaSerial: "a,b", Sps30: Sps30Data{Pm2p5: 4.5}, Co2: 410, VocIndex: -3, OpticalTemperatures: [3]float32{1, 2, 3}, OmbHumidityScd: 40.5}
+	sr, err := NewSecondaryCsvReader(strings.NewReader(csvFile(secondary.CsvFileWriteJob("abc"))))
+	if err != nil {
+		t.Errorf("NewSecondaryCsvReader(): %v", err)
+		return
+	}
+	if d, err := sr.Next(); err != nil {
+		t.Errorf("sr.Next(): %v", err)
+	} else if err := checkSecondaryStructEquality(*secondary, *d); err != nil {
+		t.Errorf("secondary read back differs: %v", err)
+	}
+
+	opera := &OperaData{UnixSec: 102, PortentaSerial: "abc", ClassLabel: "dust", ClassLabels: []string{"dust", "smoke, wood"}, ClassProbs: []float32{0.2, 0.8}, Co2: 400}
+	opera.Concentrations.PM2p5 = 12.5
+	or, err := NewOperaCsvReader(strings.NewReader(csvFile(opera.CsvFileWriteJob("abc"))))
+	if err != nil {
+		t.Errorf("NewOperaCsvReader(): %v", err)
+		return
+	}
+	if d, err := or.Next(); err != nil {
+		t.Errorf("or.Next(): %v", err)
+	} else if d.UnixSec != 102 || d.ClassLabels[1] != "smoke, wood" || d.ClassProbs[1] != 0.8 || d.Concentrations.PM2p5 != 12.5 || d.Co2 != 400 {
+		t.Errorf("opera read back differs: %+v", d)
+	}
+
+	pulse := NewPulse{RawPeak: 25, SidePeak: 20, Indices: [8]uint16{1, 2, 3, 4, 5, 6, 7, 8}}
+	jobs := []CsvFileWriteJob{}
+	for unix := uint32(200); unix < 202; unix++ {
+		primary := &PrimaryData{PortentaSerial: "abc", TeensyData: NewTeensyData{UnixSec: unix, HvEnabled: true, Counts: []*NewTeensyCounts{
+			{PinLaser: 1, NumPulses: 2, Pulses: []NewPulse{pulse, pulse}},
+			{PinLaser: 2},
+		}}}
+		jobs = append(jobs, primary.CsvFileWriteJob("abc")...)
+	}
+	pr, err := NewPrimaryCsvReader(strings.NewReader(csvFile(jobs)))
+	if err != nil {
+		t.Errorf("NewPrimaryCsvReader(): %v", err)
+		return
+	}
+	for unix := uint32(200); unix < 202; unix++ {
+		d, err := pr.Next()
+		if err != nil {
+			t.Errorf("pr.Next(): %v", err)
+			return
+		}
+		counts := d.TeensyData.Counts
+		if d.TeensyData.UnixSec != unix || !d.TeensyData.HvEnabled || len(counts) != 2 || counts[1].PinLaser != 2 || len(counts[0].Pulses) != 2 || counts[0].Pulses[1] != pulse {
+			t.Errorf("primary record %d read back as %+v", unix, d.TeensyData)
+		}
+	}
+	if _, err := pr.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF after the last record, got %v", err)
+	}
+}
+
+func TestCsvReadersOlderFiles(t *testing.T) {
+	/* Reordered columns, the old typo'd header and the old list format */
+	r, _ := NewSecondaryCsvReader(strings.NewReader("co2,omg_hum_scd,unix\n410,40.5,100\n"))
+	if d, err := r.Next(); err != nil || d.Co2 != 410 || d.OmbHumidityScd != 40.5 || d.UnixSec != 100 {
+		t.Errorf("reordered secondary row read as %+v, %v", d, err)
+	}
+	o, _ := NewOperaCsvReader(strings.NewReader("unix,class_labels,class_probs\n100,\"[dust smoke]\",\"[0.2 0.8]\"\n"))
+	if d, err := o.Next(); err != nil || len(d.ClassLabels) != 2 || d.ClassLabels[1] != "smoke" || d.ClassProbs[1] != 0.8 {
+		t.Errorf("old output row read as %+v, %v", d, err)
+	}
+
+	/* Errors name the line and column */
+	r, _ = NewSecondaryCsvReader(strings.NewReader("unix,co2\n100,1\n101,lots\n"))
+	r.Next()
+	if _, err := r.Next(); err == nil || !strings.Contains(err.Error(), "line 3") || !strings.Contains(err.Error(), "co2") {
+		t.Errorf("expected an error naming line 3 and co2, got %v", err)
+	}
+
+	/* A bad row keeps the counts read before it and is reported after them */
+	pr, _ := NewPrimaryCsvReader(strings.NewReader("unix,ms,portenta,num_pulse\n100,0,abc,1\n100,0,abc,2\n100,0,abc,lots\n101,0,abc,3\n"))
+	if d, err := pr.Next(); err != nil || d.TeensyData.UnixSec != 100 || len(d.TeensyData.Counts) != 2 || d.TeensyData.Counts[1].NumPulses != 2 {
+		t.Errorf("record before the bad row read as %+v, %v", d, err)
+	}
+	if _, err := pr.Next(); err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Errorf("expected an error naming line 4, got %v", err)
+	}
+	if d, err := pr.Next(); err != nil || d.TeensyData.UnixSec != 101 || len(d.TeensyData.Counts) != 1 {
+		t.Errorf("record after the bad row read as %+v, %v", d, err)
+	}
+	if _, err := pr.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+	if _, err := NewPrimaryCsvReader(strings.NewReader("ms,portenta\n")); err == nil {
+		t.Errorf("expected an error for a header without unix")
+	}
+}
+
+func TestCsvReadersMissingValues(t *testing.T) {
+	r, _ := NewSecondaryCsvReader(strings.NewReader("unix,portenta,pressure,flow_rate,co2\n100,abc,,NA,410\n101,abc,null,1.5,\n"))
+	d, err := r.Next()
+	if err != nil {
+		t.Errorf("r.Next(): %v", err)
+		return
+	}
+	if !math.IsNaN(float64(d.Pressure)) || !math.IsNaN(float64(d.FlowRate)) || d.Co2 != 410 {
+		t.Errorf("empty and NA fields read as pressure %v, flow_rate %v", d.Pressure, d.FlowRate)
+	}
+
+	/* A column the header does not have is NaN too, not a measured zero */
+	if !math.IsNaN(float64(d.OmbTemperatureHtu)) || !math.IsNaN(float64(d.Sps30.Pm2p5)) {
+		t.Errorf("missing columns read as temp_htu %v, sps30_pm2p5 %v", d.OmbTemperatureHtu, d.Sps30.Pm2p5)
+	}
+	if d, err := r.Next(); err != nil || !math.IsNaN(float64(d.Pressure)) || d.FlowRate != 1.5 {
+		t.Errorf("second row read as %+v, %v", d, err)
+	}
+}
+
+func TestWideClassProbs(t *testing.T) {
+	defer SetCsvFormatPolicy(GetDefaultCsvFormatPolicy())
+	policy := GetDefaultCsvFormatPolicy()
+	policy.ClassProbs = CLASS_PROBS_WIDE
+	if err := SetCsvFormatPolicy(policy); err != nil {
+		t.Errorf("SetCsvFormatPolicy(): %v", err)
+		return
+	}
+
+	root := t.TempDir()
+	sink := NewFileSink(root, 0)
+	records := []*OperaData{
+		{UnixSec: 100, ClassLabels: []string{"Dust", "Wood Smoke"}, ClassProbs: []float32{0.25, 0.75}},
+		{UnixSec: 101, ClassLabels: []string{"Dust", "Wood Smoke"}, ClassProbs: []float32{0.5}},
+		{UnixSec: 102, ClassLabels: []string{"Wood Smoke", "Dust"}, ClassProbs: []float32{0.9, 0.1}},
+		{UnixSec: 103, ClassProbs: []float32{0.3, 0.7}},
+		{UnixSec: 104, ClassLabels: []string{"Dust", "Pollen", "dust!"}, ClassProbs: []float32{0.1, 0.2, 0.7}},
+	}
+	var filename string
+	for _, d := range records {
+		job := d.CsvFileWriteJob("abc")[0]
+		filename = job.Filename
+		if err := sink.Write(job); err != nil {
+			t.Errorf("sink.Write(): %v", err)
+			return
+		}
+	}
+	sink.Close()
+
+	f, err := os.Open(filepath.Join(root, filename))
+	if err != nil {
+		t.Errorf("failed to open %s: %v", filename, err)
+		return
+	}
+	defer f.Close()
+	r, err := NewOperaCsvReader(f)
+	if err != nil {
+		t.Errorf("NewOperaCsvReader(): %v", err)
+		return
+	}
+	if header := r.c.header; !strings.Contains(strings.Join(header, ","), ",class_label,prob_dust,prob_wood_smoke,temp,") {
+		t.Errorf("wide header is %v", header)
+	}
+	d, err := r.Next()
+	if err != nil || len(d.ClassLabels) != 2 || d.ClassLabels[1] != "wood_smoke" || d.ClassProbs[1] != 0.75 {
+		t.Errorf("first wide row read as %+v, %v", d, err)
+	}
+	if d, err := r.Next(); err != nil || d.ClassProbs[0] != 0.5 || !math.IsNaN(float64(d.ClassProbs[1])) {
+		t.Errorf("row with a missing probability read as %+v, %v", d, err)
+	}
+
+	/* Reordered and missing labels keep the columns */
+	if d, err := r.Next(); err != nil || d.ClassProbs[0] != 0.1 || d.ClassProbs[1] != 0.9 {
+		t.Errorf("row with reordered labels read as %+v, %v", d, err)
+	}
+	if d, err := r.Next(); err != nil || d.ClassProbs[0] != 0.3 || d.ClassProbs[1] != 0.7 {
+		t.Errorf("row without labels read as %+v, %v", d, err)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("expected the new label set in another file, got %v", err)
+	}
+
+	/* A new label set goes to a new version of the file */
+	b, err := os.ReadFile(filepath.Join(root, strings.TrimSuffix(filename, CSV_FILE_EXTENSION)+"_v2"+CSV_FILE_EXTENSION))
+	if err != nil || !strings.Contains(string(b), ",prob_dust,prob_pollen,prob_dust_2,") {
+		t.Errorf("expected a _v2 file with the new label set, got %q, %v", b, err)
+	}
+
+	/* Configured labels fix the columns and read back as they were */
+	policy.ClassLabels = []string{"Wood Smoke", "Dust"}
+	SetCsvFormatPolicy(policy)
+	var buf bytes.Buffer
+	for _, d := range records {
+		job := d.CsvFileWriteJob("abc")[0]
+		if buf.Len() == 0 {
+			buf.WriteString(job.Headers + "\n")
+		} else if !strings.HasPrefix(buf.String(), job.Headers+"\n") {
+			t.Errorf("record %d changed the header to %s", d.UnixSec, job.Headers)
+		}
+		buf.WriteString(job.Content + "\n")
+	}
+	r, _ = NewOperaCsvReader(&buf)
+	if d, err := r.Next(); err != nil || len(d.ClassLabels) != 2 || d.ClassLabels[0] != "Wood Smoke" || d.ClassProbs[0] != 0.75 {
+		t.Errorf("row under configured labels read as %+v, %v", d, err)
+	}
+}
@@ -3,7 +3,6 @@ package operadatatypes
 import (
 	"encoding/json"
 	"fmt"
-	"net"
 )
 
 var DISPLAY_DATA_KEYS = struct {
@@ -83,8 +82,17 @@ func (t *TeensyData) DisplayData() interface{} {
 }
 
 func GetDisplayData(m4 *M4SensorMeasurement, teensy *TeensyData, imx8Temp float32) interface{} {
+	return deviceStatus(imx8Temp, teensy.McuTemp, teensy.FlowRate, [3]float32{m4.OpticalTemp0, m4.OpticalTemp1, m4.OpticalTemp2})
+}
+
+// The health flags GetDisplayData gives, from the values d holds.
+func (d *SecondaryData) DisplayDeviceStatus() *DisplayDeviceStatus {
+	return deviceStatus(d.PortentaImx8Temp, d.TeensyMcuTemp, d.FlowRate, d.OpticalTemperatures)
+}
+
+func deviceStatus(imx8Temp, mcuTemp, flowRate float32, opticalTemps [3]float32) *DisplayDeviceStatus {
 	laserTempOk := true
-	for _, tmp := range []float32{m4.OpticalTemp0, m4.OpticalTemp1, m4.OpticalTemp2} {
+	for _, tmp := range opticalTemps {
 		if tmp > OK_LASER_TEMP_MAX_C {
 			laserTempOk = false
 			break
@@ -93,9 +101,9 @@ func GetDisplayData(m4 *M4SensorMeasurement, teensy *TeensyData, imx8Temp float3
 
 	return &DisplayDeviceStatus{
 		Imx8Temp:        imx8Temp <= OK_IMX8_TEMP_MAX_C,
-		TeensyMcuTemp:   teensy.McuTemp <= OK_TEENSY_TEMP_MAX_C,
+		TeensyMcuTemp:   mcuTemp <= OK_TEENSY_TEMP_MAX_C,
 		LaserTemps:      laserTempOk,
-		OpticalFlowRate: teensy.FlowRate >= OK_FLOW_RATE_MIN,
+		OpticalFlowRate: flowRate >= OK_FLOW_RATE_MIN,
 	}
 }
 
@@ -105,14 +113,17 @@ func SendDisplayData(data interface{}, unixSocketPath string) error {
 		return fmt.Errorf("failed to convert to json: %v", err)
 	}
 
-	conn, err := net.Dial("unix", unixSocketPath)
+	conn, err := DefaultTransport.Dial(unixSocketPath)
 	if err != nil {
 		return fmt.Errorf("failed to connect to unix socket: %v", err)
 	}
-	defer conn.Close()
 
 	if _, err := conn.Write(jsonBytes); err != nil {
+		conn.Close()
 		return fmt.Errorf("failed to write bytes to socket conn: %v", err)
 	}
+	if err := conn.Close(); err != nil {
+		return fmt.Errorf("failed to close socket conn: %v", err)
+	}
 	return nil
 }
@@ -0,0 +1,352 @@
+package operadatatypes
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	SINK_JOURNAL_FILE_NAME       = ".opera_journal"
+	SINK_JOURNAL_MAX_ENTRY_BYTES = 256 << 20
+)
+
+// When the FileSink writes pending records to disk and syncs them. With no
+// field set, records are only written on Flush, Close or when the pending
+// buffer fills, and are never synced.
+type DurabilityPolicy struct {
+	SyncEveryWrite   bool  `json:"sync_every_write"`
+	SyncEveryRecords int   `json:"sync_every_records"`
+	SyncIntervalMs   int64 `json:"sync_interval_ms"`
+}
+
+func GetDefaultDurabilityPolicy() DurabilityPolicy {
+	return DurabilityPolicy{SyncIntervalMs: 5000}
+}
+
+func (p DurabilityPolicy) enabled() bool {
+	return p.SyncEveryWrite || p.SyncEveryRecords > 0 || p.SyncIntervalMs > 0
+}
+
+func (p DurabilityPolicy) commitDue(pendingRecords int) bool {
+	return p.SyncEveryWrite || (p.SyncEveryRecords > 0 && pendingRecords >= p.SyncEveryRecords)
+}
+
+// Recovers files under Root from an interrupted commit, then journals and syncs
+// every commit from here on according to p. Call before the first Write.
+func (s *FileSink) EnableDurability(p DurabilityPolicy) error {
+	if err := s.Recover(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.durability = p
+	if !p.enabled() {
+		return nil
+	}
+	path := filepath.Join(s.Root, SINK_JOURNAL_FILE_NAME)
+	journal, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open journal, '%s': %v", path, err)
+	}
+	s.journal = journal
+
+	if p.SyncIntervalMs > 0 {
+		s.stopSync = make(chan struct{})
+		go s.syncEvery(time.Duration(p.SyncIntervalMs)*time.Millisecond, s.stopSync)
+	}
+	return nil
+}
+
+func (s *FileSink) syncEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			err, onErr := s.commit(), s.OnCommitError
+			s.mu.Unlock()
+			if err != nil && onErr != nil {
+				onErr(err) // Records stay pending and are retried by the next commit
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Completes records left half written by a crash using the journal under Root,
+// then cuts the files that could have been open at the crash back to their
+// last whole record: CSV and JSON Lines files to their last newline, .raw
+// files to the end of their last whole record. Those are the files the journal
+// names and the newest file of each data label and serial; files whose names
+// the naming policy does not parse are always checked.
+func (s *FileSink) Recover() error {
+	check := map[string]bool{}
+	path := filepath.Join(s.Root, SINK_JOURNAL_FILE_NAME)
+	journal, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to open journal, '%s': %v", path, err)
+	}
+	if err == nil {
+		defer journal.Close()
+		for _, entry := range readJournal(journal) {
+			if err := s.replayJournalEntry(entry); err != nil {
+				return err
+			}
+			check[filepath.Join(s.Root, entry.filename)] = true
+		}
+		if err := clearJournal(journal); err != nil {
+			return err
+		}
+	}
+
+	newest, err := s.newestFiles()
+	if err != nil {
+		return err
+	}
+	for _, path := range newest {
+		check[path] = true
+	}
+	for path := range check {
+		var err error
+		switch {
+		case strings.HasSuffix(path, CSV_FILE_EXTENSION) || strings.HasSuffix(path, JSONL_FILE_EXTENSION):
+			err = truncateToLastLine(path)
+		case strings.HasSuffix(path, BINARY_FILE_EXTENSION):
+			err = truncateToLastRecord(path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the paths of the newest uncompressed data file of each directory,
+// data label, serial and extension under Root, and of every data file whose
+// name does not parse.
+func (s *FileSink) newestFiles() ([]string, error) {
+	ret := []string{}
+	newest := map[string]FileNameInfo{}
+	newestPath := map[string]string{}
+	err := filepath.WalkDir(s.Root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		ext := filepath.Ext(path)
+		if ext != CSV_FILE_EXTENSION && ext != JSONL_FILE_EXTENSION && ext != BINARY_FILE_EXTENSION {
+			return nil
+		}
+		info, err := s.parseFileName(d.Name())
+		if err != nil {
+			ret = append(ret, path)
+			return nil
+		}
+		key := strings.Join([]string{filepath.Dir(path), info.DataLabel, info.PortentaSerial, info.Extension}, "\x00")
+		if current, ok := newest[key]; !ok || newerFile(info, current) {
+			newest[key], newestPath[key] = info, path
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files to recover under '%s': %v", s.Root, err)
+	}
+	for _, path := range newestPath {
+		ret = append(ret, path)
+	}
+	return ret, nil
+}
+
+func newerFile(a, b FileNameInfo) bool {
+	switch {
+	case !a.Start.Equal(b.Start):
+		return a.Start.After(b.Start)
+	case a.Part != b.Part:
+		return a.Part > b.Part
+	}
+	return a.Version > b.Version
+}
+
+func (s *FileSink) replayJournalEntry(entry journalEntry) error {
+	if !filepath.IsLocal(entry.filename) {
+		return fmt.Errorf("journal names a file outside the sink root: '%s'", entry.filename)
+	}
+	path := filepath.Join(s.Root, entry.filename)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file, '%s': %v", path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file, '%s': %v", path, err)
+	}
+	if info.Size() >= entry.offset+int64(len(entry.data)) {
+		return nil // Commit completed (or the entry is stale)
+	}
+	if err := f.Truncate(entry.offset); err != nil {
+		return fmt.Errorf("failed to truncate '%s': %v", path, err)
+	}
+	if _, err := f.WriteAt(entry.data, entry.offset); err != nil {
+		return fmt.Errorf("failed to complete '%s' from journal: %v", path, err)
+	}
+	return f.Sync()
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Cuts a .raw file whose last record was cut short back to the end of the
+// record before it. A file that cannot be read further with data left after
+// the damage is left alone, as the damage is not a torn write.
+func truncateToLastRecord(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open file, '%s': %v", path, err)
+	}
+	defer f.Close()
+
+	counter := &countingReader{r: f}
+	reader := NewRawArchiveReader(counter)
+	end := int64(0)
+	for {
+		if _, err := reader.Next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			break
+		}
+		end = counter.n - int64(reader.r.Buffered())
+	}
+	if _, err := reader.r.Peek(1); err != io.EOF {
+		return nil
+	}
+	return truncateAndSync(f, end)
+}
+
+func truncateToLastLine(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open file, '%s': %v", path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file, '%s': %v", path, err)
+	}
+
+	/* Scan back from the end for the last newline */
+	end := info.Size()
+	buf := make([]byte, 4096)
+	for end > 0 {
+		start := max(end-int64(len(buf)), 0)
+		chunk := buf[:end-start]
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return fmt.Errorf("failed to read '%s': %v", path, err)
+		}
+		if end == info.Size() && chunk[len(chunk)-1] == '\n' {
+			return nil
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if chunk[i] == '\n' {
+				return truncateAndSync(f, start+int64(i)+1)
+			}
+		}
+		end = start
+	}
+	return truncateAndSync(f, 0)
+}
+
+func truncateAndSync(f *os.File, size int64) error {
+	if err := f.Truncate(size); err != nil {
+		return fmt.Errorf("failed to truncate '%s': %v", f.Name(), err)
+	}
+	return f.Sync()
+}
+
+/* Journal */
+
+// Each entry is the file name (string), offset the data starts at (int64),
+// the data (uint32 length + bytes) and a CRC-32 of everything before it.
+type journalEntry struct {
+	filename string
+	offset   int64
+	data     []byte
+}
+
+func writeJournal(f *os.File, entries []journalEntry) error {
+	w := bufio.NewWriter(f)
+	for _, e := range entries {
+		h := crc32.NewIEEE()
+		mw := io.MultiWriter(w, h)
+		writeStringToBinary(mw, e.filename)
+		binary.Write(mw, binary.LittleEndian, e.offset)
+		binary.Write(mw, binary.LittleEndian, uint32(len(e.data)))
+		mw.Write(e.data)
+		binary.Write(w, binary.LittleEndian, h.Sum32())
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %v", err)
+	}
+	return nil
+}
+
+// Returns the entries up to the first incomplete or corrupt one.
+func readJournal(r io.Reader) []journalEntry {
+	ret := []journalEntry{}
+	br := bufio.NewReader(r)
+	for {
+		h := crc32.NewIEEE()
+		tr := io.TeeReader(br, h)
+		e := journalEntry{}
+		var err error
+		if e.filename, err = readStringFromBinary(tr); err != nil {
+			return ret
+		}
+		if err := binary.Read(tr, binary.LittleEndian, &e.offset); err != nil {
+			return ret
+		}
+		var n uint32
+		if err := binary.Read(tr, binary.LittleEndian, &n); err != nil || n > SINK_JOURNAL_MAX_ENTRY_BYTES {
+			return ret
+		}
+		e.data = make([]byte, n)
+		if _, err := io.ReadFull(tr, e.data); err != nil {
+			return ret
+		}
+		var sum uint32
+		if err := binary.Read(br, binary.LittleEndian, &sum); err != nil || sum != h.Sum32() {
+			return ret
+		}
+		ret = append(ret, e)
+	}
+}
+
+func clearJournal(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to clear journal: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to clear journal: %v", err)
+	}
+	return nil
+}
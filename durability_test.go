@@ -0,0 +1,113 @@
+package operadatatypes
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSinkRecover(t *testing.T) {
+	root := t.TempDir()
+
+	/* A commit cut off after the journal was synced but mid-way through the data */
+	journal, err := os.Create(filepath.Join(root, SINK_JOURNAL_FILE_NAME))
+	if err != nil {
+		t.Errorf("failed to create journal: %v", err)
+		return
+	}
+	writeJournal(journal, []journalEntry{{filename: "a.raw", offset: 2, data: []byte{3, 4, 5}}})
+	journal.Close()
+	os.WriteFile(filepath.Join(root, "a.raw"), []byte{1, 2, 3}, 0644)
+
+	/* A CSV written without a journal, ending in a partial row */
+	os.WriteFile(filepath.Join(root, "b.csv"), []byte("unix,a\n1,a\n2,"), 0644)
+
+	sink := NewFileSink(root, 0)
+	if err := sink.EnableDurability(DurabilityPolicy{SyncEveryWrite: true}); err != nil {
+		t.Errorf("sink.EnableDurability(): %v", err)
+		return
+	}
+	defer sink.Close()
+
+	for name, expected := range map[string]string{
+		"a.raw":                "\x01\x02\x03\x04\x05",
+		"b.csv":                "unix,a\n1,a\n",
+		SINK_JOURNAL_FILE_NAME: "",
+	} {
+		b, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Errorf("failed to read %s: %v", name, err)
+		} else if string(b) != expected {
+			t.Errorf("%s holds %q after recovery, expected %q", name, b, expected)
+		}
+	}
+
+	/* With SyncEveryWrite rows are on disk as soon as Write returns */
+	if err := sink.Write(&CsvFileWriteJob{Filename: "b.csv", Headers: "unix,a", Content: "3,c"}); err != nil {
+		t.Errorf("sink.Write(): %v", err)
+		return
+	}
+	if b, _ := os.ReadFile(filepath.Join(root, "b.csv")); string(b) != "unix,a\n1,a\n3,c\n" {
+		t.Errorf("b.csv holds %q after a synced write", b)
+	}
+}
+
+func TestReadJournalStopsAtCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), SINK_JOURNAL_FILE_NAME)
+	f, _ := os.Create(path)
+	writeJournal(f, []journalEntry{{filename: "a", offset: 0, data: []byte("ok")}, {filename: "b", offset: 1, data: []byte("torn")}})
+	f.Close()
+
+	b, _ := os.ReadFile(path)
+	os.WriteFile(path, b[:len(b)-3], 0644)
+	f, _ = os.Open(path)
+	defer f.Close()
+	if entries := readJournal(f); len(entries) != 1 || entries[0].filename != "a" {
+		t.Errorf("readJournal() returned %v, expected only the first entry", entries)
+	}
+}
+
+func TestRecoverRawTornRecord(t *testing.T) {
+	root := t.TempDir()
+	secondary := &SecondaryData{UnixSec: 101, PortentaSerial: "abcdefg12345", Co2: 410}
+	record := secondary.BinaryFileWriteJob("abcdefg12345")[0].Content
+
+	/* Two whole records followed by part of a third, as left by a crash */
+	oldName, newName := "OPERA_abcdefg12345_SecondaryRaw_20261017.raw", "OPERA_abcdefg12345_SecondaryRaw_20261018.raw"
+	content := append(append(append([]byte{}, record...), record...), record[:10]...)
+	os.WriteFile(filepath.Join(root, oldName), content, 0644)
+	os.WriteFile(filepath.Join(root, newName), content, 0644)
+
+	sink := NewFileSink(root, 0)
+	if err := sink.EnableDurability(DurabilityPolicy{}); err != nil {
+		t.Errorf("sink.EnableDurability(): %v", err)
+		return
+	}
+	defer sink.Close()
+
+	/* Only the newest file could have been open, older ones are not read */
+	if b, _ := os.ReadFile(filepath.Join(root, oldName)); len(b) != len(content) {
+		t.Errorf("%s holds %d bytes after recovery, expected it untouched", oldName, len(b))
+	}
+	b, err := os.ReadFile(filepath.Join(root, newName))
+	if err != nil {
+		t.Errorf("failed to read %s: %v", newName, err)
+		return
+	}
+	if len(b) != 2*len(record) {
+		t.Errorf("%s holds %d bytes after recovery, expected %d", newName, len(b), 2*len(record))
+		return
+	}
+	reader := NewRawArchiveReader(bytes.NewReader(b))
+	for idx := 0; idx < 2; idx++ {
+		if _, err := reader.Next(); err != nil {
+			t.Errorf("reader.Next() for record #%d: %v", idx, err)
+			return
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF after the whole records, got %v", err)
+	}
+}
@@ -0,0 +1,454 @@
+package operadatatypes
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EXPORT_MANIFEST_FILE_NAME = "OPERA_MANIFEST.csv"
+	EXPORT_MANIFEST_HEADERS   = "file,size,sha256,first_unix,last_unix,records,exported_unix"
+	EXPORT_STATE_FILE_NAME    = ".opera_exported.json"
+	EXPORT_PARTIAL_EXTENSION  = ".part"
+)
+
+// One exported file, as listed in the USB manifest.
+type ExportedFile struct {
+	Filename     string `json:"file"`
+	Size         int64  `json:"size"`
+	Sha256       string `json:"sha256"`
+	FirstUnix    uint32 `json:"first_unix"`
+	LastUnix     uint32 `json:"last_unix"`
+	Records      int    `json:"records"`
+	ExportedUnix int64  `json:"exported_unix"`
+}
+
+func (e ExportedFile) csvRow() string {
+	return fmt.Sprintf("%s,%d,%s,%d,%d,%d,%d", e.Filename, e.Size, e.Sha256, e.FirstUnix, e.LastUnix, e.Records, e.ExportedUnix)
+}
+
+// Copies completed data files from SourceRoot (the SD card) to DestRoot (the
+// USB stick). Each copy is verified against the source's SHA-256 before it is
+// listed in the manifest and marked exported. A copy interrupted by the stick
+// being pulled is resumed on the next Export.
+type UsbExporter struct {
+	SourceRoot string
+	DestRoot   string
+
+	// Files the sink still has open are never exported, if set.
+	Sink *FileSink
+	// Lists the files to export and records what was exported, in place of
+	// EXPORT_STATE_FILE_NAME, if set.
+	Catalog *Catalog
+
+	mu       sync.Mutex
+	exported map[string]ExportedFile // Relative file name to export record
+	loaded   bool
+}
+
+func NewUsbExporter(sourceRoot, destRoot string) *UsbExporter {
+	return &UsbExporter{
+		SourceRoot: sourceRoot,
+		DestRoot:   destRoot,
+		exported:   map[string]ExportedFile{},
+	}
+}
+
+// Caller must hold mu.
+func (x *UsbExporter) loadState() error {
+	if x.loaded {
+		return nil
+	}
+	path := filepath.Join(x.SourceRoot, EXPORT_STATE_FILE_NAME)
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read export state, '%s': %v", path, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &x.exported); err != nil {
+			return fmt.Errorf("failed to read json contents of export state, '%s': %v", path, err)
+		}
+	}
+	x.loaded = true
+	return nil
+}
+
+// Caller must hold mu.
+func (x *UsbExporter) saveState() error {
+	b, err := json.Marshal(x.exported)
+	if err != nil {
+		return fmt.Errorf("failed to convert export state to json: %v", err)
+	}
+	return writeFileAtomic(filepath.Join(x.SourceRoot, EXPORT_STATE_FILE_NAME), b)
+}
+
+// Returns true if path (under SourceRoot) has been exported and has not
+// changed size since. Usable as RetentionManager.IsExported.
+func (x *UsbExporter) IsExported(path string) bool {
+	rel, err := filepath.Rel(x.SourceRoot, path)
+	if err != nil {
+		return false
+	}
+	if x.Catalog != nil {
+		e, ok := x.Catalog.Get(rel)
+		return ok && e.Exported()
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.loadState() != nil {
+		return false
+	}
+	e, ok := x.exported[rel]
+	if !ok {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Size() == e.Size
+}
+
+// Returns data files under SourceRoot whose rotation period is over and that
+// have not been exported yet, oldest first.
+func (x *UsbExporter) pending() ([]string, error) {
+	ret := []string{}
+	now := time.Now()
+	if x.Catalog != nil {
+		for _, e := range x.Catalog.Query(CatalogQuery{Unexported: true}) {
+			info, err := ParseFileName(e.Filename)
+			if err != nil || now.Before(info.End()) || (x.Sink != nil && x.Sink.IsOpen(e.Filename)) {
+				continue
+			}
+			ret = append(ret, e.Filename)
+		}
+		sort.Slice(ret, func(i, j int) bool { return fileNameLess(ret[i], ret[j]) })
+		return ret, nil
+	}
+
+	err := filepath.WalkDir(x.SourceRoot, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := ParseFileName(d.Name())
+		if err != nil || now.Before(info.End()) {
+			return nil
+		}
+		rel, err := filepath.Rel(x.SourceRoot, path)
+		if err != nil {
+			return nil
+		}
+		if x.Sink != nil && x.Sink.IsOpen(rel) {
+			return nil
+		}
+		if e, ok := x.exported[rel]; ok {
+			if stat, err := d.Info(); err == nil && stat.Size() == e.Size {
+				return nil
+			}
+		}
+		ret = append(ret, rel)
+		return nil
+	})
+	sort.Slice(ret, func(i, j int) bool { return fileNameLess(ret[i], ret[j]) })
+	return ret, err
+}
+
+// Exports every pending file. Returns the files exported by this call. A file
+// that fails to export is retried next time and does not hold back the files
+// after it; the errors of all such files are returned together. Errors writing
+// the manifest or export state stop the export.
+func (x *UsbExporter) Export() ([]ExportedFile, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	done := []ExportedFile{}
+
+	if info, err := os.Stat(x.DestRoot); err != nil || !info.IsDir() {
+		return done, fmt.Errorf("usb destination is not available, '%s'", x.DestRoot)
+	}
+	if err := x.loadState(); err != nil {
+		return done, err
+	}
+	files, err := x.pending()
+	if err != nil {
+		return done, fmt.Errorf("failed to list files to export: %v", err)
+	}
+
+	fileErrs := []error{}
+	for _, rel := range files {
+		e, err := x.exportFile(rel)
+		if err != nil {
+			fileErrs = append(fileErrs, err)
+			continue
+		}
+		if err := appendManifest(filepath.Join(x.DestRoot, EXPORT_MANIFEST_FILE_NAME), e); err != nil {
+			return done, err
+		}
+		if x.Catalog != nil {
+			x.Catalog.recordExported(rel, e.Sha256, e.ExportedUnix)
+			if err := x.Catalog.Save(); err != nil {
+				return done, err
+			}
+		} else {
+			x.exported[rel] = e
+			if err := x.saveState(); err != nil {
+				return done, err
+			}
+		}
+		done = append(done, e)
+	}
+	return done, errors.Join(fileErrs...)
+}
+
+// Calls Export every interval until stop is closed. Errors, including the stick
+// being absent, go to onError.
+func (x *UsbExporter) Run(interval time.Duration, stop <-chan struct{}, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := x.Export(); err != nil && onError != nil {
+			onError(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (x *UsbExporter) exportFile(rel string) (ExportedFile, error) {
+	e := ExportedFile{Filename: rel}
+	src := filepath.Join(x.SourceRoot, rel)
+	dst := filepath.Join(x.DestRoot, rel)
+	partial := dst + EXPORT_PARTIAL_EXTENSION
+
+	var err error
+	if e.Size, e.Sha256, err = fileSha256(src); err != nil {
+		return e, err
+	}
+	/* A damaged tail is exported as is, the manifest counting the records before it */
+	e.Records, e.FirstUnix, e.LastUnix, _ = summarizeDataFile(src)
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return e, fmt.Errorf("failed to create directory for '%s': %v", dst, err)
+	}
+	if err := resumeCopy(src, partial); err != nil {
+		return e, err
+	}
+
+	/* Verify before the copy takes its final name */
+	size, sum, err := fileSha256(partial)
+	if err != nil {
+		return e, err
+	}
+	if size != e.Size || sum != e.Sha256 {
+		os.Remove(partial)
+		return e, fmt.Errorf("copy of '%s' does not match the source, sha256 %s vs %s", rel, sum, e.Sha256)
+	}
+	if err := os.Rename(partial, dst); err != nil {
+		return e, fmt.Errorf("failed to rename '%s': %v", partial, err)
+	}
+	e.ExportedUnix = time.Now().Unix()
+	return e, nil
+}
+
+// Copies src to dst, continuing from dst's current size if it exists.
+func resumeCopy(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open file, '%s': %v", src, err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file, '%s': %v", dst, err)
+	}
+	defer out.Close()
+
+	offset, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to seek '%s': %v", dst, err)
+	}
+	if info, err := in.Stat(); err == nil && offset > info.Size() {
+		if err := out.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate '%s': %v", dst, err)
+		}
+		offset, _ = out.Seek(0, io.SeekStart)
+	}
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek '%s': %v", src, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy '%s': %v", src, err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("failed to sync '%s': %v", dst, err)
+	}
+	return nil
+}
+
+func fileSha256(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open file, '%s': %v", path, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read '%s': %v", path, err)
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns the number of records in a .raw, .csv or .jsonl data file,
+// compressed or not, and the unix times of the first and last. Records after a
+// truncated or corrupt one are not counted; the error then says where the file
+// is damaged, along with the summary of the records before it. Lines whose unix
+// time does not parse, such as a torn last line, are not counted.
+func summarizeDataFile(path string) (records int, first, last uint32, err error) {
+	info, err := ParseFileName(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	f, err := OpenDataFile(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+
+	note := func(unix uint32) {
+		if records == 0 {
+			first = unix
+		}
+		last = unix
+		records++
+	}
+
+	switch info.Extension {
+	case BINARY_FILE_EXTENSION:
+		reader := NewRawArchiveReader(f)
+		for {
+			d, err := reader.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return records, first, last, fmt.Errorf("failed to read '%s': %v", path, err)
+			}
+			note(OutputDataUnixSec(d))
+		}
+	case CSV_FILE_EXTENSION:
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, SINK_MAX_PENDING_BYTES)
+		for line := 0; scanner.Scan(); line++ {
+			if line == 0 || scanner.Text() == "" {
+				continue // Headers
+			}
+			unix, _, _ := strings.Cut(scanner.Text(), ",")
+			if n, err := strconv.ParseUint(unix, 10, 32); err == nil {
+				note(uint32(n))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return records, first, last, fmt.Errorf("failed to read '%s': %v", path, err)
+		}
+	case JSONL_FILE_EXTENSION:
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, SINK_MAX_PENDING_BYTES)
+		for scanner.Scan() {
+			if unix, ok := jsonlLineUnix(scanner.Bytes()); ok {
+				note(unix)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return records, first, last, fmt.Errorf("failed to read '%s': %v", path, err)
+		}
+	}
+	return records, first, last, nil
+}
+
+func appendManifest(path string, e ExportedFile) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest, '%s': %v", path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat manifest, '%s': %v", path, err)
+	}
+	content := e.csvRow() + "\n"
+	if info.Size() == 0 {
+		content = EXPORT_MANIFEST_HEADERS + "\n" + content
+	}
+	if _, err := f.WriteString(content); err != nil {
+		return fmt.Errorf("failed to write manifest, '%s': %v", path, err)
+	}
+	return f.Sync()
+}
+
+// Reads the manifest on a USB stick.
+func ReadExportManifest(path string) ([]ExportedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest, '%s': %v", path, err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest, '%s': %v", path, err)
+	}
+	ret := []ExportedFile{}
+	for i, row := range rows {
+		if i == 0 {
+			continue
+		}
+		if len(row) != 7 {
+			return ret, fmt.Errorf("manifest line %d has %d fields, expected 7", i+1, len(row))
+		}
+		e := ExportedFile{Filename: row[0], Sha256: row[2]}
+		e.Size, _ = strconv.ParseInt(row[1], 10, 64)
+		first, _ := strconv.ParseUint(row[3], 10, 32)
+		last, _ := strconv.ParseUint(row[4], 10, 32)
+		e.FirstUnix, e.LastUnix = uint32(first), uint32(last)
+		e.Records, _ = strconv.Atoi(row[5])
+		e.ExportedUnix, _ = strconv.ParseInt(row[6], 10, 64)
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+// Replaces path with data without ever leaving it half written.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create file, '%s': %v", tmpPath, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write '%s': %v", tmpPath, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync '%s': %v", tmpPath, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close '%s': %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename '%s': %v", tmpPath, err)
+	}
+	return nil
+}
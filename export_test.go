@@ -0,0 +1,134 @@
+package operadatatypes
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUsbExporter(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	secondary := func(unix uint32) *SecondaryData {
+		return &SecondaryData{UnixSec: unix, PortentaSerial: "abc", Co2: 410}
+	}
+	raw := new(bytes.Buffer)
+	for _, d := range []OutputData{secondary(100), secondary(105), secondary(110)} {
+		for _, job := range d.BinaryFileWriteJob("abc") {
+			raw.Write(job.Content)
+		}
+	}
+	files := map[string][]byte{
+		"OPERA_abc_SecondaryRaw_20261016.raw": raw.Bytes(),
+		"OPERA_abc_Output_20261016.csv":       []byte("unix,x\n200,1\n201,2\n"),
+		"notes.txt":                           []byte("not data"),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(src, name), content, 0644); err != nil {
+			t.Errorf("failed to write test file: %v", err)
+			return
+		}
+	}
+	/* A copy cut short by the stick being removed */
+	partial := filepath.Join(dst, "OPERA_abc_SecondaryRaw_20261016.raw"+EXPORT_PARTIAL_EXTENSION)
+	os.WriteFile(partial, raw.Bytes()[:raw.Len()/2], 0644)
+
+	x := NewUsbExporter(src, dst)
+	done, err := x.Export()
+	if err != nil {
+		t.Errorf("x.Export(): %v", err)
+		return
+	}
+	if len(done) != 2 {
+		t.Errorf("exported %d files, expected 2: %v", len(done), done)
+		return
+	}
+	for name, content := range files {
+		if name == "notes.txt" {
+			continue
+		}
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("exported %s does not match the source (err %v)", name, err)
+		}
+		if !x.IsExported(filepath.Join(src, name)) {
+			t.Errorf("%s is not marked exported", name)
+		}
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("partial copy was left behind")
+	}
+
+	manifest, err := ReadExportManifest(filepath.Join(dst, EXPORT_MANIFEST_FILE_NAME))
+	if err != nil {
+		t.Errorf("ReadExportManifest(): %v", err)
+		return
+	}
+	expected := map[string][3]int{
+		"OPERA_abc_Output_20261016.csv":       {2, 200, 201},
+		"OPERA_abc_SecondaryRaw_20261016.raw": {3, 100, 110},
+	}
+	if len(manifest) != len(expected) {
+		t.Errorf("manifest has %d rows, expected %d", len(manifest), len(expected))
+	}
+	for _, e := range manifest {
+		want := expected[e.Filename]
+		if e.Records != want[0] || int(e.FirstUnix) != want[1] || int(e.LastUnix) != want[2] || len(e.Sha256) != 64 {
+			t.Errorf("manifest row for %s is %+v, expected records/first/last %v", e.Filename, e, want)
+		}
+	}
+
+	/* Nothing new to export, and state survives a new exporter */
+	if done, err := NewUsbExporter(src, dst).Export(); err != nil || len(done) != 0 {
+		t.Errorf("second Export() exported %v (err %v), expected nothing", done, err)
+	}
+
+	/* A changed file is no longer exported */
+	path := filepath.Join(src, "OPERA_abc_Output_20261016.csv")
+	os.WriteFile(path, []byte("unix,x\n200,1\n201,2\n202,3\n"), 0644)
+	if x.IsExported(path) {
+		t.Errorf("file that grew since export is still marked exported")
+	}
+}
+
+func TestUsbExporterMissingDestination(t *testing.T) {
+	x := NewUsbExporter(t.TempDir(), filepath.Join(t.TempDir(), "unplugged"))
+	if _, err := x.Export(); err == nil {
+		t.Errorf("Export() to a missing destination succeeded")
+	}
+}
+
+func TestUsbExporterDamagedFile(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	raw := new(bytes.Buffer)
+	for _, unix := range []uint32{100, 105, 110} {
+		d := &SecondaryData{UnixSec: unix, PortentaSerial: "abc", Co2: 410}
+		for _, job := range d.BinaryFileWriteJob("abc") {
+			raw.Write(job.Content)
+		}
+	}
+	/* A half written last record, then a good file after it */
+	torn := raw.Bytes()[:raw.Len()-raw.Len()/6]
+	os.WriteFile(filepath.Join(src, "OPERA_abc_SecondaryRaw_20261015.raw"), torn, 0644)
+	os.WriteFile(filepath.Join(src, "OPERA_abc_SecondaryRaw_20261016.raw"), raw.Bytes(), 0644)
+
+	x := NewUsbExporter(src, dst)
+	done, err := x.Export()
+	if err != nil {
+		t.Errorf("x.Export(): %v", err)
+		return
+	}
+	if len(done) != 2 {
+		t.Errorf("exported %v, expected both files", done)
+		return
+	}
+	if e := done[0]; e.Records != 2 || e.FirstUnix != 100 || e.LastUnix != 105 || e.Size != int64(len(torn)) {
+		t.Errorf("damaged file exported as %+v, expected its 2 complete records", e)
+	}
+	if e := done[1]; e.Records != 3 || e.LastUnix != 110 {
+		t.Errorf("good file exported as %+v", e)
+	}
+	if got, err := os.ReadFile(filepath.Join(dst, "OPERA_abc_SecondaryRaw_20261015.raw")); err != nil || !bytes.Equal(got, torn) {
+		t.Errorf("damaged file was not copied as is (err %v)", err)
+	}
+}
@@ -0,0 +1,193 @@
+package operadatatypes
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* CSV Number Formatting */
+
+const DEFAULT_CSV_NAN = "NaN"
+
+// How one CSV column's numbers are written. Decimals is the number of digits
+// after the decimal point (after the first digit when Scientific), or -1 for
+// the fewest digits that read back to the same float32. NaN is written as NaN,
+// or "NaN" if empty; it must not read as a number. Inside list columns NaN is
+// written as null instead.
+type ColumnFormat struct {
+	Decimals   int    `json:"decimals"`
+	Scientific bool   `json:"scientific,omitempty"`
+	NaN        string `json:"nan,omitempty"`
+}
+
+func (f ColumnFormat) Validate() error {
+	if f.Decimals < -1 || f.Decimals > 10 {
+		return fmt.Errorf("decimals must be between -1 and 10, got %d", f.Decimals)
+	}
+	if strings.ContainsAny(f.NaN, ",\"\r\n") {
+		return fmt.Errorf("nan representation '%s' must not hold a comma, quote or line break", f.NaN)
+	}
+	if v, err := strconv.ParseFloat(f.NaN, 32); err == nil && !math.IsNaN(v) {
+		return fmt.Errorf("nan representation '%s' must not read as a number", f.NaN)
+	}
+	return nil
+}
+
+func (f ColumnFormat) format(v float32) string {
+	switch {
+	case math.IsNaN(float64(v)):
+		if f.NaN == "" {
+			return DEFAULT_CSV_NAN
+		}
+		return f.NaN
+	case math.IsInf(float64(v), 1):
+		return "+Inf"
+	case math.IsInf(float64(v), -1):
+		return "-Inf"
+	case f.Scientific:
+		return strconv.FormatFloat(float64(v), 'e', f.Decimals, 32)
+	default:
+		return strconv.FormatFloat(float64(v), 'f', f.Decimals, 32)
+	}
+}
+
+const (
+	CLASS_PROBS_PACKED = "packed"
+	CLASS_PROBS_WIDE   = "wide"
+)
+
+// Number formats for the CSV outputs. Columns is keyed by header name, e.g.
+// "sps30_pn0p5" or "PM2_5", and overrides Default. A column entry replaces
+// Default's decimals and notation, so give both; without a NaN of its own it
+// uses Default's.
+//
+// ClassProbs sets how the Output CSV holds the class probabilities:
+// CLASS_PROBS_PACKED (the default) writes the class_labels and class_probs
+// lists, CLASS_PROBS_WIDE one prob_<label> column per label instead, formatted
+// as class_probs. The wide columns follow ClassLabels, the model's labels in
+// order, or the labels of the first record if it is empty.
+type CsvFormatPolicy struct {
+	Default     ColumnFormat            `json:"default"`
+	Columns     map[string]ColumnFormat `json:"columns,omitempty"`
+	ClassProbs  string                  `json:"class_probs,omitempty"`
+	ClassLabels []string                `json:"class_labels,omitempty"`
+}
+
+// Defaults keep the resolution the sensors report: the SPS30 gives mass and
+// number concentrations to hundredths, the ML concentrations are small and
+// need five decimals, and the thresholds and 5V monitor need more than the
+// single decimal that is enough for the raw scalars.
+func GetDefaultCsvFormatPolicy() CsvFormatPolicy {
+	columns := map[string]ColumnFormat{}
+	set := func(decimals int, names ...string) {
+		for _, name := range names {
+			columns[name] = ColumnFormat{Decimals: decimals}
+		}
+	}
+	set(2, "sps30_pm1", "sps30_pm2p5", "sps30_pm4", "sps30_pm10",
+		"sps30_pn0p5", "sps30_pn1", "sps30_pn2p5", "sps30_pn4", "sps30_pn10")
+	set(3, "sps30_tps", "flow_rate", "class_probs", "diff_upper_th0", "diff_upper_th1")
+	set(4, "mean_5v_monitor", "std_dev_5v_monitor")
+	set(5, strings.Split(ML_CONCENTRATION_CSV_HEADER, ",")...)
+	set(1, "raw_scalar0", "raw_scalar1", "diff_scalar0", "diff_scalar1",
+		"baseline0", "baseline1", "raw_upper_th0", "raw_upper_th1")
+	return CsvFormatPolicy{Default: ColumnFormat{Decimals: 2}, Columns: columns}
+}
+
+func (p CsvFormatPolicy) Validate() error {
+	if err := p.Default.Validate(); err != nil {
+		return fmt.Errorf("default: %v", err)
+	}
+	for name, f := range p.Columns {
+		if err := f.Validate(); err != nil {
+			return fmt.Errorf("column %s: %v", name, err)
+		}
+	}
+	switch p.ClassProbs {
+	case "", CLASS_PROBS_PACKED, CLASS_PROBS_WIDE:
+	default:
+		return fmt.Errorf("class_probs must be %s or %s, got '%s'", CLASS_PROBS_PACKED, CLASS_PROBS_WIDE, p.ClassProbs)
+	}
+	return nil
+}
+
+// Returns the format of column.
+func (p CsvFormatPolicy) column(name string) ColumnFormat {
+	f, ok := p.Columns[name]
+	if !ok {
+		return p.Default
+	}
+	if f.NaN == "" {
+		f.NaN = p.Default.NaN
+	}
+	return f
+}
+
+// Formats v as column.
+func (p CsvFormatPolicy) float(column string, v float32) string {
+	return p.column(column).format(v)
+}
+
+var (
+	csvFormatMu     sync.RWMutex
+	csvFormatPolicy = GetDefaultCsvFormatPolicy()
+)
+
+// Sets how the CSV file write jobs format numbers.
+func SetCsvFormatPolicy(p CsvFormatPolicy) error {
+	if err := p.Validate(); err != nil {
+		return fmt.Errorf("invalid csv format: %v", err)
+	}
+	columns := map[string]ColumnFormat{}
+	for name, f := range p.Columns {
+		columns[name] = f
+	}
+	p.Columns = columns
+	p.ClassLabels = slices.Clone(p.ClassLabels)
+	csvFormatMu.Lock()
+	defer csvFormatMu.Unlock()
+	csvFormatPolicy = p
+
+	wideLabelsMu.Lock()
+	wideLabels = nil // Taken again from the next record
+	wideLabelsMu.Unlock()
+	return nil
+}
+
+// The returned policy must not be modified; its Columns map and ClassLabels
+// are shared.
+func GetCsvFormatPolicy() CsvFormatPolicy {
+	csvFormatMu.RLock()
+	defer csvFormatMu.RUnlock()
+	return csvFormatPolicy
+}
+
+// NaN representations read back whatever the policy, so files written under an
+// earlier one still parse.
+var csvNaNs = map[string]bool{"": true, "NA": true, "N/A": true, "null": true}
+
+// Parses a number written by ColumnFormat, accepting NaN as NaN, NA, N/A, null
+// or an empty field, and any NaN representation the current policy uses.
+func parseCsvFloat(v string) (float32, error) {
+	f, err := strconv.ParseFloat(v, 32)
+	if err == nil {
+		return float32(f), nil
+	}
+	if csvNaNs[v] {
+		return float32(math.NaN()), nil
+	}
+	p := GetCsvFormatPolicy()
+	if p.Default.NaN != "" && v == p.Default.NaN {
+		return float32(math.NaN()), nil
+	}
+	for _, format := range p.Columns {
+		if format.NaN != "" && v == format.NaN {
+			return float32(math.NaN()), nil
+		}
+	}
+	return 0, err
+}
@@ -2,29 +2,61 @@ package operadatatypes
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
-	"net"
+	"reflect"
 )
 
 func sendStructGob(d interface{}, dataIdentifier string, unixSocketPath string) error {
-	conn, err := net.Dial("unix", unixSocketPath)
+	conn, err := DefaultTransport.Dial(unixSocketPath)
 	if err != nil {
 		return fmt.Errorf("failed to connect to socket, %s: %v", unixSocketPath, err)
 	}
-	defer conn.Close()
 
 	encoder := gob.NewEncoder(conn)
 	if err := encoder.Encode(dataIdentifier); err != nil {
+		conn.Close()
 		return fmt.Errorf("failed to send data type: %v", err)
 	}
 	if err := encoder.Encode(d); err != nil {
+		conn.Close()
 		return fmt.Errorf("failed to send data: %v", err)
 	}
+	if err := conn.Close(); err != nil {
+		return fmt.Errorf("failed to close connection to socket, %s: %v", unixSocketPath, err)
+	}
 	return nil
 }
 
-func ReceiveStructGob(conn net.Conn) (interface{}, error) {
+// Returns an empty value to decode a message of type msgType into, along with a
+// human readable name for error messages.
+func newStructForDataType(msgType string) (interface{}, string, error) {
+	switch msgType {
+	case DATA_TYPE_SPS30:
+		return &Sps30Data{}, "sps30", nil
+	case DATA_TYPE_M4_SENSORS:
+		return &M4SensorMeasurement{}, "m4 sensor", nil
+	case DATA_TYPE_TEENSY:
+		return &NewTeensyData{}, "teensy raw", nil
+	case DATA_TYPE_ML_TEMP_RH:
+		return &MlTempHumOutputData{}, "ml temp/rh", nil
+	case DATA_TYPE_ML_PRIMARY:
+		return &MlPrimaryDataOutput{}, "ml primary", nil
+	case DATA_TYPE_CSV_FILE:
+		return &CsvFileWriteJob{}, "csv file write job", nil
+	case DATA_TYPE_BIN_FILE:
+		return &BinaryFileWriteJob{}, "binary file write job", nil
+	case DATA_TYPE_CSV_ROWS:
+		return &CsvRowsFileWriteJob{}, "csv rows file write job", nil
+	case DATA_TYPE_JSONL:
+		return &JsonlFileWriteJob{}, "jsonl file write job", nil
+	default:
+		return nil, "", fmt.Errorf("recieved unknown datatype: %v", msgType)
+	}
+}
+
+func ReceiveStructGob(conn io.Reader) (interface{}, error) {
 	decoder := gob.NewDecoder(conn)
 
 	/* Get message type */
@@ -36,34 +68,14 @@ func ReceiveStructGob(conn net.Conn) (interface{}, error) {
 		return nil, fmt.Errorf("failed to decode msg type: %v", err)
 	}
 
-	/* Interpret Data */
-	var data interface{}
-	var dataTypeName string
+	if msgType == DATA_TYPE_BATCH {
+		return receiveBatch(decoder)
+	}
 
-	switch msgType {
-	case DATA_TYPE_SPS30:
-		data = &Sps30Data{}
-		dataTypeName = "sps30"
-	case DATA_TYPE_M4_SENSORS:
-		data = &M4SensorMeasurement{}
-		dataTypeName = "m4 sensor"
-	case DATA_TYPE_TEENSY:
-		data = &NewTeensyData{}
-		dataTypeName = "teensy raw"
-	case DATA_TYPE_ML_TEMP_RH:
-		data = &MlTempHumOutputData{}
-		dataTypeName = "ml temp/rh"
-	case DATA_TYPE_ML_PRIMARY:
-		data = &MlPrimaryDataOutput{}
-		dataTypeName = "ml primary"
-	case DATA_TYPE_CSV_FILE:
-		data = &CsvFileWriteJob{}
-		dataTypeName = "csv file write job"
-	case DATA_TYPE_BIN_FILE:
-		data = &BinaryFileWriteJob{}
-		dataTypeName = "binary file write job"
-	default:
-		return nil, fmt.Errorf("recieved unknown datatype: %v", msgType)
+	/* Interpret Data */
+	data, dataTypeName, err := newStructForDataType(msgType)
+	if err != nil {
+		return nil, err
 	}
 
 	if err := decoder.Decode(data); err != nil {
@@ -71,3 +83,44 @@ func ReceiveStructGob(conn net.Conn) (interface{}, error) {
 	}
 	return data, nil
 }
+
+func receiveBatch(decoder *gob.Decoder) (*MessageBatch, error) {
+	var itemType string
+	if err := decoder.Decode(&itemType); err != nil {
+		return nil, fmt.Errorf("failed to decode batch item type: %v", err)
+	}
+	item, dataTypeName, err := newStructForDataType(itemType)
+	if err != nil {
+		return nil, err
+	}
+
+	items := reflect.New(reflect.SliceOf(reflect.TypeOf(item)))
+	if err := decoder.DecodeValue(items); err != nil {
+		return nil, fmt.Errorf("failed to decode %s batch: %v", dataTypeName, err)
+	}
+
+	ret := &MessageBatch{DataType: itemType, Items: make([]interface{}, items.Elem().Len())}
+	for i := range ret.Items {
+		ret.Items[i] = items.Elem().Index(i).Interface()
+	}
+	return ret, nil
+}
+
+// Receives one message from conn and calls handler with it. Batches are unrolled
+// so handler is called once per record, in the order they were sent; a record
+// the handler fails on does not stop the rest, and the failures are joined.
+func HandleStructGob(conn io.Reader, handler func(interface{}) error) error {
+	data, err := ReceiveStructGob(conn)
+	if err != nil {
+		return err
+	}
+	batch, ok := data.(*MessageBatch)
+	if !ok {
+		return handler(data)
+	}
+	var errs error
+	for _, item := range batch.Items {
+		errs = errors.Join(errs, handler(item))
+	}
+	return errs
+}
@@ -0,0 +1,387 @@
+package operadatatypes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* InfluxDB Line Protocol */
+
+const (
+	INFLUX_MEASUREMENT_OUTPUT    = "opera_output"
+	INFLUX_MEASUREMENT_SECONDARY = "opera_secondary"
+	INFLUX_MEASUREMENT_PRIMARY   = "opera_primary"
+	INFLUX_TAG_SERIAL            = "portenta"
+)
+
+// Data with an InfluxDB line protocol form.
+type InfluxData interface {
+	InfluxLine() string
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	influxStringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "\n", `\n`)
+)
+
+// Returns v as a line protocol field value, or false for values a field cannot
+// hold: NaN, Inf and lists.
+func influxFieldValue(v any) (string, bool) {
+	switch v := v.(type) {
+	case float32:
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(float64(v), 'g', -1, 32), true
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10) + "i", true
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10) + "i", true
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10) + "i", true
+	case int32:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int:
+		return strconv.Itoa(v) + "i", true
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return `"` + influxStringEscaper.Replace(v) + `"`, true
+	}
+	return "", false
+}
+
+// Collects the fields of one point, in order, skipping values a field cannot
+// hold.
+type influxFields []string
+
+func (f *influxFields) add(key string, v any) {
+	if value, ok := influxFieldValue(v); ok {
+		*f = append(*f, influxKeyEscaper.Replace(key)+"="+value)
+	}
+}
+
+// Adds the columns of d except unix, which is the timestamp, portenta, which
+// is the tag, and any others given.
+func addSchemaFields[T any](f *influxFields, fields []Field[T], d *T, skipped ...string) {
+	for _, field := range fields {
+		if field.Name == "unix" || field.Name == "portenta" || slices.Contains(skipped, field.Name) {
+			continue
+		}
+		f.add(field.Name, field.value(d))
+	}
+}
+
+// Returns one line, without the line ending, or "" when there are no fields,
+// which line protocol does not allow.
+func influxLine(measurement, serial string, f influxFields, unixNano int64) string {
+	if len(f) == 0 {
+		return ""
+	}
+	line := influxMeasurementEscaper.Replace(measurement)
+	if serial != "" {
+		line += "," + INFLUX_TAG_SERIAL + "=" + influxKeyEscaper.Replace(serial)
+	}
+	return line + " " + strings.Join(f, ",") + " " + strconv.FormatInt(unixNano, 10)
+}
+
+// The Output columns, with one prob_<label> field per class as in the wide CSV
+// layout.
+func (d *OperaData) InfluxLine() string {
+	f := influxFields{}
+	addSchemaFields(&f, wideOutputSchema(d.ClassLabels).Fields, d)
+	return influxLine(INFLUX_MEASUREMENT_OUTPUT, d.PortentaSerial, f, int64(d.UnixSec)*int64(time.Second))
+}
+
+// The SecondaryRaw columns.
+func (d *SecondaryData) InfluxLine() string {
+	f := influxFields{}
+	addSchemaFields(&f, SecondaryRawSchema.Fields, d)
+	return influxLine(INFLUX_MEASUREMENT_SECONDARY, d.PortentaSerial, f, int64(d.UnixSec)*int64(time.Second))
+}
+
+// PrimaryRaw columns summarized per laser, the pulses themselves left out.
+var influxPrimaryCountsColumns = []string{"num_pulse", "pulses_per_second", "baseline0", "baseline1", "max_laser_on"}
+
+// A summary of the reading: its PrimaryRaw columns, num_pulse and
+// pulses_per_second summed over the counts, and the influxPrimaryCountsColumns of
+// each count as laser<pin>_<column>. The timestamp is UnixSec and MilliSec.
+func (d *PrimaryData) InfluxLine() string {
+	f := influxFields{}
+	reading := []Field[PrimaryRawRow]{}
+	counts := map[string]Field[PrimaryRawRow]{}
+	for _, field := range PrimaryRawSchema.Fields {
+		if !strings.HasPrefix(field.Source, "TeensyData.Counts[].") {
+			reading = append(reading, field)
+		} else {
+			counts[field.Name] = field
+		}
+	}
+	addSchemaFields(&f, reading, &PrimaryRawRow{Data: d}, "ms")
+
+	var numPulses uint32
+	var pulsesPerSecond float32
+	for _, c := range d.TeensyData.Counts {
+		numPulses += c.NumPulses
+		pulsesPerSecond += c.PulsesPerSecond
+	}
+	f.add("num_counts", len(d.TeensyData.Counts))
+	f.add("num_pulse", numPulses)
+	f.add("pulses_per_second", pulsesPerSecond)
+	for _, c := range d.TeensyData.Counts {
+		row := &PrimaryRawRow{Data: d, Counts: c}
+		for _, name := range influxPrimaryCountsColumns {
+			f.add(fmt.Sprintf("laser%d_%s", c.PinLaser, name), counts[name].value(row))
+		}
+	}
+	unixNano := int64(d.TeensyData.UnixSec)*int64(time.Second) + int64(d.TeensyData.MilliSec)*int64(time.Millisecond)
+	return influxLine(INFLUX_MEASUREMENT_PRIMARY, d.PortentaSerial, f, unixNano)
+}
+
+/* InfluxDB HTTP Writer */
+
+const (
+	DEFAULT_INFLUX_MAX_POINTS     = 1000
+	DEFAULT_INFLUX_MAX_LATENCY_MS = 10000
+	DEFAULT_INFLUX_MAX_RETRIES    = 3
+	DEFAULT_INFLUX_RETRY_DELAY_MS = 1000
+	DEFAULT_INFLUX_TIMEOUT_MS     = 10000
+
+	DEFAULT_INFLUX_MAX_QUEUED_BATCHES = 8
+)
+
+// Where and how InfluxWriter posts points. Url is the full write endpoint,
+// e.g. "http://host:8086/api/v2/write?org=telosair&bucket=opera&precision=ns"
+// for InfluxDB 2 or "http://host:8086/write?db=opera" for InfluxDB 1. An empty
+// Url disables the writer.
+type InfluxConfig struct {
+	Url          string `json:"url"`
+	Token        string `json:"token"` // Sent as "Authorization: Token <token>" when set
+	MaxPoints    int    `json:"max_points"`
+	MaxLatencyMs int64  `json:"max_latency_ms"`
+	MaxRetries   int    `json:"max_retries"`    // Negative for none
+	RetryDelayMs int64  `json:"retry_delay_ms"` // Doubled after each retry
+	TimeoutMs    int64  `json:"timeout_ms"`
+	// Batches waiting to be posted, and kept while posts fail, before points
+	// are dropped.
+	MaxQueuedBatches int `json:"max_queued_batches"`
+}
+
+func GetDefaultInfluxConfig() InfluxConfig {
+	return InfluxConfig{
+		MaxPoints:    DEFAULT_INFLUX_MAX_POINTS,
+		MaxLatencyMs: DEFAULT_INFLUX_MAX_LATENCY_MS,
+		MaxRetries:   DEFAULT_INFLUX_MAX_RETRIES,
+		RetryDelayMs: DEFAULT_INFLUX_RETRY_DELAY_MS,
+		TimeoutMs:    DEFAULT_INFLUX_TIMEOUT_MS,
+
+		MaxQueuedBatches: DEFAULT_INFLUX_MAX_QUEUED_BATCHES,
+	}
+}
+
+func (c InfluxConfig) Enabled() bool {
+	return c.Url != ""
+}
+
+// Buffers points, posting them in one request once MaxPoints are pending or
+// the oldest is MaxLatencyMs old. Posts run on a background goroutine behind a
+// queue of MaxQueuedBatches batches, so Add never waits on the network. Failed
+// posts are retried MaxRetries times on network errors, 429 and 5xx responses;
+// the points are then put back to go with the next batch, up to
+// MaxQueuedBatches batches' worth. Points the server rejects are dropped.
+type InfluxWriter struct {
+	Config InfluxConfig
+	Client *http.Client
+
+	queue   *batchQueue[struct{}, string]
+	batches chan []string
+	done    chan struct{}
+
+	mu       sync.Mutex
+	idle     *sync.Cond // Signalled when inflight drops to 0
+	inflight int        // Batches queued or being posted
+	stopped  bool
+}
+
+var errInfluxStopped = errors.New("influx writer is closed")
+
+// Settings left at zero take their GetDefaultInfluxConfig values.
+func NewInfluxWriter(config InfluxConfig) *InfluxWriter {
+	defaults := GetDefaultInfluxConfig()
+	if config.MaxPoints <= 0 {
+		config.MaxPoints = defaults.MaxPoints
+	}
+	if config.MaxLatencyMs <= 0 {
+		config.MaxLatencyMs = defaults.MaxLatencyMs
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = defaults.MaxRetries
+	} else if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	if config.RetryDelayMs <= 0 {
+		config.RetryDelayMs = defaults.RetryDelayMs
+	}
+	if config.TimeoutMs <= 0 {
+		config.TimeoutMs = defaults.TimeoutMs
+	}
+	if config.MaxQueuedBatches <= 0 {
+		config.MaxQueuedBatches = defaults.MaxQueuedBatches
+	}
+	w := &InfluxWriter{
+		Config:  config,
+		Client:  &http.Client{Timeout: time.Duration(config.TimeoutMs) * time.Millisecond},
+		batches: make(chan []string, config.MaxQueuedBatches),
+		done:    make(chan struct{}),
+	}
+	w.idle = sync.NewCond(&w.mu)
+	w.queue = newBatchQueue(time.Duration(config.MaxLatencyMs)*time.Millisecond, config.MaxPoints*config.MaxQueuedBatches,
+		func(lines []string) bool { return len(lines) >= w.Config.MaxPoints },
+		w.enqueue)
+	go w.run()
+	return w
+}
+
+// Hands a batch to the background goroutine, without waiting.
+func (w *InfluxWriter) enqueue(_ struct{}, lines []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return errInfluxStopped
+	}
+	select {
+	case w.batches <- lines:
+		w.inflight++
+		return nil
+	default:
+		return fmt.Errorf("influx post queue for %s is full", w.Config.Url)
+	}
+}
+
+func (w *InfluxWriter) run() {
+	defer close(w.done)
+	for lines := range w.batches {
+		if retry, err := w.post(lines); err != nil {
+			if !retry {
+				lines = nil // Rejected by the server, only reported
+			}
+			w.queue.requeue(struct{}{}, lines, err, true)
+		}
+		w.mu.Lock()
+		if w.inflight--; w.inflight == 0 {
+			w.idle.Broadcast()
+		}
+		w.mu.Unlock()
+	}
+}
+
+// Queues the point of d. Any error from an earlier post is returned by the
+// next Add, Flush or Close, after d is queued.
+func (w *InfluxWriter) Add(d InfluxData) error {
+	line := d.InfluxLine()
+	if line == "" {
+		return w.queue.takeErr()
+	}
+	err := w.queue.add(struct{}{}, line)
+	if err == errBatchQueueClosed {
+		return fmt.Errorf("influx writer for %s is closed", w.Config.Url)
+	}
+	return err
+}
+
+// Posts lines, retrying as Config allows. Returns whether a failure is worth
+// trying again later.
+func (w *InfluxWriter) post(lines []string) (bool, error) {
+	if len(lines) == 0 {
+		return false, nil
+	}
+	body := []byte(strings.Join(lines, "\n") + "\n")
+	delay := time.Duration(w.Config.RetryDelayMs) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		retry, err := w.postOnce(body)
+		if err == nil {
+			return false, nil
+		}
+		if !retry || attempt >= w.Config.MaxRetries {
+			return retry, fmt.Errorf("failed to write %d points to '%s': %v", len(lines), w.Config.Url, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Posts body once, returning whether a failure is worth retrying.
+func (w *InfluxWriter) postOnce(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.Config.Url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.Config.Token != "" {
+		req.Header.Set("Authorization", "Token "+w.Config.Token)
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// Posts everything pending regardless of count or age, waiting for the posts
+// to finish. Points of a failed post stay queued.
+func (w *InfluxWriter) Flush() error {
+	err := w.queue.flush()
+	w.mu.Lock()
+	for w.inflight > 0 {
+		w.idle.Wait()
+	}
+	w.mu.Unlock()
+	return errors.Join(err, w.queue.takeErr())
+}
+
+// Flushes, stops the background goroutine and refuses further points. Points
+// still unsent are dropped, with the error saying how many.
+func (w *InfluxWriter) Close() error {
+	err := w.Flush()
+	w.mu.Lock()
+	if !w.stopped {
+		w.stopped = true
+		close(w.batches)
+	}
+	w.mu.Unlock()
+	<-w.done
+	return errors.Join(err, w.queue.close())
+}
+
+// Returns the lines of the given data, each with its line ending, for writing
+// to a file or posting by hand.
+func InfluxLines(data ...InfluxData) string {
+	var sb strings.Builder
+	for _, d := range data {
+		if line := d.InfluxLine(); line != "" {
+			sb.WriteString(line + "\n")
+		}
+	}
+	return sb.String()
+}
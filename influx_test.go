@@ -0,0 +1,155 @@
+package operadatatypes
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInfluxLine(t *testing.T) {
+	opera := &OperaData{UnixSec: 100, PortentaSerial: "a b,c", ClassLabel: `say "hi"`, ClassLabels: []string{"Dust", "Wood Smoke"}, ClassProbs: []float32{0.25, 0.75}, Temp: 21.5, RH: float32(math.NaN()), Co2: 400, VocIndex: -2}
+	line := opera.InfluxLine()
+	if !strings.HasPrefix(line, `opera_output,portenta=a\ b\,c PM0_3=0,`) || !strings.HasSuffix(line, " 100000000000") {
+		t.Errorf("output line is %s", line)
+	}
+	for _, field := range []string{`class_label="say \"hi\""`, "prob_dust=0.25", "prob_wood_smoke=0.75", "temp=21.5", "co2=400i", "voc_index=-2i"} {
+		if !strings.Contains(line, ","+field+",") && !strings.Contains(line, ","+field+" ") {
+			t.Errorf("output line %s is missing %s", line, field)
+		}
+	}
+	if strings.Contains(line, "rh=") || strings.Contains(line, "class_probs") || strings.Contains(line, "unix=") {
+		t.Errorf("output line %s holds NaN, list or timestamp fields", line)
+	}
+
+	secondary := &SecondaryData{UnixSec: 101, PortentaSerial: "abc", Co2: 410, FlowRate: 1.5}
+	if line := secondary.InfluxLine(); !strings.HasPrefix(line, "opera_secondary,portenta=abc ") || !strings.Contains(line, ",flow_rate=1.5,") || !strings.HasSuffix(line, " 101000000000") {
+		t.Errorf("secondary line is %s", line)
+	}
+
+	primary := &PrimaryData{PortentaSerial: "abc", TeensyData: NewTeensyData{UnixSec: 102, MilliSec: 250, HvEnabled: true, Counts: []*NewTeensyCounts{
+		{PinLaser: 3, NumPulses: 2, PulsesPerSecond: 1.5, Baseline0: 10, Pulses: []NewPulse{{RawPeak: 1}, {RawPeak: 2}}},
+		{PinLaser: 4, NumPulses: 1, PulsesPerSecond: 0.5},
+	}}}
+	line = primary.InfluxLine()
+	for _, field := range []string{"hv_enabled=true", "num_counts=2i", "num_pulse=3i", "pulses_per_second=2", "laser3_num_pulse=2i", "laser3_baseline0=10", "laser4_pulses_per_second=0.5"} {
+		if !strings.Contains(line, field) {
+			t.Errorf("primary line %s is missing %s", line, field)
+		}
+	}
+	if strings.Contains(line, "pulses=") || strings.Contains(line, "ms=") || !strings.HasSuffix(line, " 102250000000") {
+		t.Errorf("primary line is %s", line)
+	}
+
+	if lines := InfluxLines(opera, secondary); strings.Count(lines, "\n") != 2 {
+		t.Errorf("InfluxLines() gave %q", lines)
+	}
+}
+
+func TestInfluxWriter(t *testing.T) {
+	var mu sync.Mutex
+	bodies := []string{}
+	failures := 1
+	down := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if down || failures > 0 {
+			failures--
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	received := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, bodies...)
+	}
+
+	/* A full batch is posted, retried past the 503, and the rest once MaxLatencyMs has passed */
+	w := NewInfluxWriter(InfluxConfig{Url: server.URL, Token: "secret", MaxPoints: 2, MaxLatencyMs: 50, RetryDelayMs: 1})
+	for unix := uint32(100); unix < 103; unix++ {
+		if err := w.Add(&SecondaryData{UnixSec: unix, PortentaSerial: "abc", Co2: 400}); err != nil {
+			t.Errorf("w.Add(): %v", err)
+			return
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(received()) < 2 {
+		if time.Now().After(deadline) {
+			t.Errorf("timed out waiting for the posts, received %q", received())
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := received(); strings.Count(got[0], "\n") != 2 || strings.Count(got[1], "\n") != 1 {
+		t.Errorf("server received %q, expected batches of 2 and 1 points", got)
+	}
+
+	/* Points of a failed post are kept and go with the next one */
+	mu.Lock()
+	down = true
+	mu.Unlock()
+	w.Add(&SecondaryData{UnixSec: 103, PortentaSerial: "abc", Co2: 400})
+	if err := w.Flush(); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected the 503 from Flush(), got %v", err)
+	}
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	w.Add(&SecondaryData{UnixSec: 104, PortentaSerial: "abc", Co2: 400})
+	if err := w.Close(); err != nil {
+		t.Errorf("w.Close(): %v", err)
+	}
+	if got := received(); len(got) != 3 || !strings.Contains(got[2], " 103000000000\n") || !strings.Contains(got[2], " 104000000000\n") {
+		t.Errorf("server received %q, expected the kept point with the next", got)
+	}
+	if err := w.Add(&SecondaryData{UnixSec: 105, Co2: 1}); err == nil {
+		t.Errorf("expected an error adding to a closed writer")
+	}
+
+	/* Client errors are not retried */
+	bad := NewInfluxWriter(InfluxConfig{Url: server.URL, Token: "wrong", MaxRetries: 5, RetryDelayMs: 1000})
+	bad.Add(&SecondaryData{UnixSec: 100, Co2: 1})
+	start := time.Now()
+	if err := bad.Flush(); err == nil || !strings.Contains(err.Error(), "401") || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("expected a 401 without retries, got %v after %v", err, time.Since(start))
+	}
+	bad.Close()
+}
+
+func TestInfluxWriterDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	/* Adds go on while the server hangs, and fail once the queue is full */
+	w := NewInfluxWriter(InfluxConfig{Url: server.URL, MaxPoints: 1, MaxQueuedBatches: 2, MaxLatencyMs: 1000})
+	start := time.Now()
+	var err error
+	for unix := uint32(100); unix < 110 && err == nil; unix++ {
+		err = w.Add(&SecondaryData{UnixSec: unix, Co2: 1})
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Add() waited on the server for %v", time.Since(start))
+	}
+	if err == nil || !strings.Contains(err.Error(), "full") {
+		t.Errorf("expected a full queue error, got %v", err)
+	}
+}
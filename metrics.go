@@ -0,0 +1,356 @@
+package operadatatypes
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* OpenMetrics */
+
+const OPENMETRICS_CONTENT_TYPE = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Keeps the latest readings and health of each device, and counts of the
+// messages and write jobs seen, served as OpenMetrics gauges and counters
+// labeled by serial. Feed it with Observe, or wrap a ServeStructGob handler
+// with ObserveHandler.
+type Metrics struct {
+	// Serial of messages that do not carry one, e.g. *Sps30Data.
+	Serial string
+
+	mu        sync.Mutex
+	devices   map[string]*metricsDevice
+	messages  map[[2]string]uint64 // Serial and type
+	writeJobs map[[3]string]uint64 // Serial, data label and format
+}
+
+type metricsDevice struct {
+	opera       *OperaData
+	sps30       *Sps30Data
+	m4          *M4SensorMeasurement
+	secondary   *SecondaryData
+	status      *DisplayDeviceStatus
+	lastMessage time.Time
+}
+
+func NewMetrics(serial string) *Metrics {
+	return &Metrics{
+		Serial:    serial,
+		devices:   map[string]*metricsDevice{},
+		messages:  map[[2]string]uint64{},
+		writeJobs: map[[3]string]uint64{},
+	}
+}
+
+// Returns the device of serial. Caller must hold mu.
+func (m *Metrics) device(serial string) *metricsDevice {
+	dev, ok := m.devices[serial]
+	if !ok {
+		dev = &metricsDevice{}
+		m.devices[serial] = dev
+	}
+	return dev
+}
+
+// Counts d and keeps it as the latest reading of its kind. A *SecondaryData
+// also gives the SPS30, M4 and health values.
+func (m *Metrics) Observe(d interface{}) {
+	serial := m.Serial
+	switch d := d.(type) {
+	case *OperaData:
+		serial = d.PortentaSerial
+	case *SecondaryData:
+		serial = d.PortentaSerial
+	case *PrimaryData:
+		serial = d.PortentaSerial
+	case FileWriteJob:
+		if info, err := ParseFileName(d.FileName()); err == nil {
+			serial = info.PortentaSerial
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dev := m.device(serial)
+	dev.lastMessage = time.Now()
+	m.messages[[2]string{serial, metricsType(d)}]++
+
+	switch d := d.(type) {
+	case *OperaData:
+		copied := *d
+		dev.opera = &copied
+	case *Sps30Data:
+		copied := *d
+		dev.sps30 = &copied
+	case *M4SensorMeasurement:
+		copied := *d
+		dev.m4 = &copied
+	case *DisplayDeviceStatus:
+		copied := *d
+		dev.status = &copied
+	case *SecondaryData:
+		copied := *d
+		dev.secondary = &copied
+		dev.sps30 = d.Sps30Data()
+		dev.m4 = d.M4SensorMeasurement()
+		dev.status = d.DisplayDeviceStatus()
+	case FileWriteJob:
+		m.observeWriteJob(serial, d)
+	}
+}
+
+// Returns the name of d's type, e.g. "Sps30Data".
+func metricsType(d interface{}) string {
+	t := reflect.TypeOf(d)
+	if t == nil {
+		return "nil"
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// Counts job under serial, the one its file name gives if it parses. Caller
+// must hold mu.
+func (m *Metrics) observeWriteJob(serial string, job FileWriteJob) {
+	label, format := "unknown", "unknown"
+	if info, err := ParseFileName(job.FileName()); err == nil {
+		label, format = info.DataLabel, strings.TrimPrefix(info.Extension, ".")
+	}
+	m.writeJobs[[3]string{serial, label, format}]++
+}
+
+// Returns handler observing each message before passing it on.
+func (m *Metrics) ObserveHandler(handler func(interface{}) error) func(interface{}) error {
+	return func(d interface{}) error {
+		m.Observe(d)
+		return handler(d)
+	}
+}
+
+/* Families */
+
+type metricsGauge struct {
+	name  string
+	help  string
+	value func(dev *metricsDevice) (float64, bool)
+}
+
+// Returns v, a Field.value, as a sample value.
+func metricsFloat(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float32:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false // Inf, strings and lists
+}
+
+// Returns e.g. "Latest air pressure, kPa." from the column's NetCDF long name.
+func metricsHelp(column, unit string) string {
+	name := netcdfLongName(column)
+	if len(name) > 1 && 'A' <= name[0] && name[0] <= 'Z' && 'a' <= name[1] && name[1] <= 'z' {
+		name = strings.ToLower(name[:1]) + name[1:]
+	}
+	if unit == "" {
+		return "Latest " + name + "."
+	}
+	return "Latest " + name + ", " + unit + "."
+}
+
+// The SecondaryRaw columns of the M4 values, which M4SensorMeasurement gives
+// through SecondaryData.Populate.
+var metricsM4Columns = []string{
+	"pressure", "co2", "voc_index", "optical_temp0", "optical_temp1", "optical_temp2",
+	"omb_temp_htu", "omb_hum_htu", "omb_temp_scd", "omb_hum_scd", "mean_5v_monitor", "std_dev_5v_monitor",
+}
+
+// The SecondaryRaw columns of the health values behind DisplayDeviceStatus.
+var metricsHealthColumns = []string{"imx8_temp", "teensy_temp", "flow_rate"}
+
+// The gauges, named opera_<column> after the Output and SecondaryRaw columns.
+var metricsGauges = func() []metricsGauge {
+	ret := []metricsGauge{}
+	for _, f := range mlConcentrationFields() {
+		f := f
+		ret = append(ret, metricsGauge{"opera_" + strings.ToLower(f.Name), metricsHelp(f.Name, f.Unit), func(dev *metricsDevice) (float64, bool) {
+			if dev.opera == nil {
+				return 0, false
+			}
+			return metricsFloat(f.value(dev.opera))
+		}})
+	}
+
+	secondary := map[string]Field[SecondaryData]{}
+	for _, f := range SecondaryRawSchema.Fields {
+		secondary[f.Name] = f
+		if !strings.HasPrefix(f.Source, "Sps30.") {
+			continue
+		}
+		f := f
+		ret = append(ret, metricsGauge{"opera_" + f.Name, metricsHelp(f.Name, f.Unit), func(dev *metricsDevice) (float64, bool) {
+			if dev.sps30 == nil {
+				return 0, false
+			}
+			return metricsFloat(f.value(&SecondaryData{Sps30: *dev.sps30}))
+		}})
+	}
+	for _, column := range metricsM4Columns {
+		f := secondary[column]
+		ret = append(ret, metricsGauge{"opera_" + f.Name, metricsHelp(f.Name, f.Unit), func(dev *metricsDevice) (float64, bool) {
+			if dev.m4 == nil {
+				return 0, false
+			}
+			d := &SecondaryData{}
+			d.Populate("", 0, &NewTeensyData{}, &Sps30Data{}, dev.m4)
+			return metricsFloat(f.value(d))
+		}})
+	}
+	for _, column := range metricsHealthColumns {
+		f := secondary[column]
+		ret = append(ret, metricsGauge{"opera_" + f.Name, metricsHelp(f.Name, f.Unit), func(dev *metricsDevice) (float64, bool) {
+			if dev.secondary == nil {
+				return 0, false
+			}
+			return metricsFloat(f.value(dev.secondary))
+		}})
+	}
+	return ret
+}()
+
+// The DisplayDeviceStatus flags, as the check label of opera_device_ok.
+var metricsStatusChecks = []struct {
+	check string
+	ok    func(s *DisplayDeviceStatus) bool
+}{
+	{"imx8_temp", func(s *DisplayDeviceStatus) bool { return s.Imx8Temp }},
+	{"teensy_temp", func(s *DisplayDeviceStatus) bool { return s.TeensyMcuTemp }},
+	{"laser_temp", func(s *DisplayDeviceStatus) bool { return s.LaserTemps }},
+	{"flow_rate", func(s *DisplayDeviceStatus) bool { return s.OpticalFlowRate }},
+}
+
+/* Exposition */
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Returns {name="value",...} of the given name and value pairs.
+func metricsLabels(pairs ...string) string {
+	labels := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, pairs[i]+`="`+metricsLabelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func metricsValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Returns the OpenMetrics text exposition, families and samples in a stable
+// order, ending with # EOF.
+func (m *Metrics) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	serials := make([]string, 0, len(m.devices))
+	for serial := range m.devices {
+		serials = append(serials, serial)
+	}
+	sort.Strings(serials)
+
+	var sb strings.Builder
+	family := func(name, kind, help string) {
+		sb.WriteString("# TYPE " + name + " " + kind + "\n# HELP " + name + " " + help + "\n")
+	}
+	sample := func(name, labels string, v float64) {
+		sb.WriteString(name + labels + " " + metricsValue(v) + "\n")
+	}
+
+	for _, g := range metricsGauges {
+		family(g.name, "gauge", g.help)
+		for _, serial := range serials {
+			if v, ok := g.value(m.devices[serial]); ok {
+				sample(g.name, metricsLabels("serial", serial), v)
+			}
+		}
+	}
+
+	family("opera_device_ok", "gauge", "Latest device health checks, 1 when ok.")
+	for _, serial := range serials {
+		if status := m.devices[serial].status; status != nil {
+			for _, c := range metricsStatusChecks {
+				v := 0.0
+				if c.ok(status) {
+					v = 1
+				}
+				sample("opera_device_ok", metricsLabels("serial", serial, "check", c.check), v)
+			}
+		}
+	}
+
+	family("opera_last_message_timestamp_seconds", "gauge", "Unix time of the latest message observed.")
+	for _, serial := range serials {
+		if t := m.devices[serial].lastMessage; !t.IsZero() {
+			sample("opera_last_message_timestamp_seconds", metricsLabels("serial", serial), float64(t.UnixNano())/1e9)
+		}
+	}
+
+	family("opera_messages", "counter", "Messages observed, by type.")
+	messages := make([][2]string, 0, len(m.messages))
+	for key := range m.messages {
+		messages = append(messages, key)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i][0] < messages[j][0] || messages[i][0] == messages[j][0] && messages[i][1] < messages[j][1]
+	})
+	for _, key := range messages {
+		sample("opera_messages_total", metricsLabels("serial", key[0], "type", key[1]), float64(m.messages[key]))
+	}
+
+	family("opera_write_jobs", "counter", "File write jobs observed, by data label and format.")
+	jobs := make([][3]string, 0, len(m.writeJobs))
+	for key := range m.writeJobs {
+		jobs = append(jobs, key)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return strings.Join(jobs[i][:], "\x00") < strings.Join(jobs[j][:], "\x00")
+	})
+	for _, key := range jobs {
+		sample("opera_write_jobs_total", metricsLabels("serial", key[0], "label", key[1], "format", key[2]), float64(m.writeJobs[key]))
+	}
+
+	sb.WriteString("# EOF\n")
+	return sb.String()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", OPENMETRICS_CONTENT_TYPE)
+	fmt.Fprint(w, m.String())
+}
@@ -0,0 +1,93 @@
+package operadatatypes
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics("abc")
+	handler := m.ObserveHandler(func(d interface{}) error { return nil })
+	opera := &OperaData{UnixSec: 100, PortentaSerial: "abc"}
+	opera.Concentrations.PM2p5 = 3.25
+	for _, d := range []interface{}{
+		opera,
+		&Sps30Data{Pm2p5: 4.5},
+		&Sps30Data{Pm2p5: 5.5},
+		&M4SensorMeasurement{Co2: 410, VocIndex: -1, Pressure: 101.2},
+		&DisplayDeviceStatus{Imx8Temp: true, TeensyMcuTemp: true, LaserTemps: false, OpticalFlowRate: true},
+		&SecondaryData{UnixSec: 100, PortentaSerial: `x"y`, FlowRate: 1.5, TeensyMcuTemp: 95, Co2: 420},
+	} {
+		handler(d)
+	}
+	for _, job := range opera.CsvFileWriteJob("abc") {
+		handler(job)
+	}
+	for _, job := range opera.BinaryFileWriteJob("abc") {
+		handler(&job)
+	}
+
+	server := httptest.NewServer(m)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Errorf("http.Get(): %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	text := string(b)
+	if resp.Header.Get("Content-Type") != OPENMETRICS_CONTENT_TYPE || !strings.HasSuffix(text, "\n# EOF\n") {
+		t.Errorf("exposition has content type %s and ends %q", resp.Header.Get("Content-Type"), text[max(0, len(text)-20):])
+	}
+	for _, sample := range []string{
+		"# TYPE opera_pm2_5 gauge\n# HELP opera_pm2_5 Latest ML estimated PM2.5 mass concentration, ug/m3.\nopera_pm2_5{serial=\"abc\"} 3.25\n",
+		"\nopera_sps30_pm2p5{serial=\"abc\"} 5.5\n",
+		"\nopera_co2{serial=\"abc\"} 410\n",
+		"\nopera_co2{serial=\"x\\\"y\"} 420\n",
+		"\nopera_voc_index{serial=\"abc\"} -1\n",
+		"\nopera_flow_rate{serial=\"x\\\"y\"} 1.5\n",
+		"\nopera_device_ok{serial=\"abc\",check=\"laser_temp\"} 0\n",
+		"\nopera_device_ok{serial=\"x\\\"y\",check=\"teensy_temp\"} 0\n",
+		"\nopera_device_ok{serial=\"x\\\"y\",check=\"flow_rate\"} 1\n",
+		"\nopera_messages_total{serial=\"abc\",type=\"Sps30Data\"} 2\n",
+		"\nopera_messages_total{serial=\"abc\",type=\"CsvFileWriteJob\"} 1\n",
+		"\nopera_write_jobs_total{serial=\"abc\",label=\"Output\",format=\"csv\"} 1\n",
+		"\nopera_write_jobs_total{serial=\"abc\",label=\"Output\",format=\"raw\"} 1\n",
+		"\nopera_last_message_timestamp_seconds{serial=\"abc\"} ",
+	} {
+		if !strings.Contains(text, sample) {
+			t.Errorf("exposition is missing %q:\n%s", sample, text)
+		}
+	}
+	if strings.Contains(text, "opera_flow_rate{serial=\"abc\"}") {
+		t.Errorf("exposition has a flow rate for a device without SecondaryData")
+	}
+}
+
+func TestMetricsWriteJobSerial(t *testing.T) {
+	m := NewMetrics("")
+	for _, job := range (&OperaData{UnixSec: 100, PortentaSerial: "abc"}).CsvFileWriteJob("abc") {
+		m.Observe(job)
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	text := rec.Body.String()
+
+	/* Both counters and the last message time are under the file name's serial */
+	for _, sample := range []string{
+		"\nopera_messages_total{serial=\"abc\",type=\"CsvFileWriteJob\"} 1\n",
+		"\nopera_write_jobs_total{serial=\"abc\",label=\"Output\",format=\"csv\"} 1\n",
+		"\nopera_last_message_timestamp_seconds{serial=\"abc\"} ",
+	} {
+		if !strings.Contains(text, sample) {
+			t.Errorf("exposition is missing %q:\n%s", sample, text)
+		}
+	}
+	if strings.Contains(text, "serial=\"\"") {
+		t.Errorf("exposition has a device without a serial:\n%s", text)
+	}
+}
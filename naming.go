@@ -0,0 +1,480 @@
+package operadatatypes
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Rotation */
+
+const (
+	ROTATION_DAILY   = "daily"
+	ROTATION_HOURLY  = "hourly"
+	ROTATION_MINUTES = "minutes"
+)
+
+// How often a data label starts a new file. Interval picks the time based name
+// ("daily" if empty); MaxBytes, if set, makes the FileSink continue in numbered
+// parts once a file would grow past it.
+type RotationPolicy struct {
+	Interval string `json:"interval"`
+	Minutes  int    `json:"minutes,omitempty"`
+	MaxBytes int64  `json:"max_bytes,omitempty"`
+}
+
+func (p RotationPolicy) Validate() error {
+	switch p.Interval {
+	case "", ROTATION_DAILY, ROTATION_HOURLY:
+	case ROTATION_MINUTES:
+		if p.Minutes <= 0 || p.Minutes > 24*60 {
+			return fmt.Errorf("rotation every %d minutes is out of range", p.Minutes)
+		}
+	default:
+		return fmt.Errorf("unknown rotation interval: '%s'", p.Interval)
+	}
+	if p.MaxBytes < 0 {
+		return fmt.Errorf("rotation max bytes is negative: %d", p.MaxBytes)
+	}
+	return nil
+}
+
+// Returns the start of the rotation period t falls in, in t's location.
+func (p RotationPolicy) periodStart(t time.Time) time.Time {
+	switch p.Interval {
+	case ROTATION_HOURLY:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case ROTATION_MINUTES:
+		minute := (t.Hour()*60 + t.Minute()) / p.Minutes * p.Minutes
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, minute, 0, 0, t.Location())
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+}
+
+// Returns the number of the period starting at start within its day, and the
+// number of digits needed for the last period of a day.
+func (p RotationPolicy) periodIndex(start time.Time) (int, int) {
+	switch p.Interval {
+	case ROTATION_HOURLY:
+		return start.Hour(), 2
+	case ROTATION_MINUTES:
+		return (start.Hour()*60 + start.Minute()) / p.Minutes, len(strconv.Itoa((24*60 - 1) / p.Minutes))
+	default:
+		return 0, 1
+	}
+}
+
+// Date part of a file name: 20261018, 20261018T14 or 20261018T1430, which all
+// sort chronologically.
+func (p RotationPolicy) fileTimestamp(start time.Time) string {
+	switch p.Interval {
+	case ROTATION_HOURLY:
+		return start.Format("20060102T15")
+	case ROTATION_MINUTES:
+		return start.Format("20060102T1504")
+	default:
+		return start.Format("20060102")
+	}
+}
+
+var (
+	rotationMu       sync.RWMutex
+	rotationPolicies = map[string]RotationPolicy{}
+)
+
+// Sets the rotation used by generateFileName and FileSink, keyed by data label
+// (e.g. DATA_LABEL_PRIMARY_RAW). Labels not present rotate daily.
+func SetRotationPolicies(policies map[string]RotationPolicy) error {
+	for label, p := range policies {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("invalid rotation for %s: %v", label, err)
+		}
+	}
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+	rotationPolicies = map[string]RotationPolicy{}
+	for label, p := range policies {
+		rotationPolicies[label] = p
+	}
+	return nil
+}
+
+func GetRotationPolicy(dataLabel string) RotationPolicy {
+	rotationMu.RLock()
+	defer rotationMu.RUnlock()
+	return rotationPolicies[dataLabel]
+}
+
+/* Naming */
+
+const DEFAULT_FILE_NAME_TEMPLATE = "OPERA_{serial}_{label}_{timestamp}{ext}"
+
+// How data file names are built. Template may use {serial}, {label}, {year},
+// {month}, {day}, {hour}, {minute}, {timestamp} (20261018, 20261018T14 or
+// 20261018T1430 depending on the rotation), {index} (the rotation period's
+// number within the day) and {ext}, which must come last if used. It needs
+// {label} and either {timestamp} or {year}, {month} and {day}.
+//
+// Times are in Timezone: "UTC" (or empty), "Local", a name such as
+// "Europe/Berlin" or a fixed offset such as "+02:00".
+//
+// PreviousTemplates lists templates files under the root were named with
+// before, so ParseFileName still reads their names. The default template and
+// those of earlier SetNamingPolicy calls are always read.
+type NamingPolicy struct {
+	Template          string   `json:"template"`
+	Timezone          string   `json:"timezone"`
+	PreviousTemplates []string `json:"previous_templates,omitempty"`
+}
+
+func GetDefaultNamingPolicy() NamingPolicy {
+	return NamingPolicy{Template: DEFAULT_FILE_NAME_TEMPLATE, Timezone: "UTC"}
+}
+
+func (p NamingPolicy) Validate() error {
+	_, err := p.compile()
+	return err
+}
+
+type fileNamer struct {
+	template string
+	location *time.Location
+	pattern  *regexp.Regexp
+	fields   map[string]bool
+	previous []*fileNamer // Of PreviousTemplates
+}
+
+var fileNameFieldPatterns = map[string]string{
+	"serial":    `.+?`,
+	"label":     `[A-Za-z0-9]+`,
+	"year":      `\d{4}`,
+	"month":     `\d{2}`,
+	"day":       `\d{2}`,
+	"hour":      `\d{2}`,
+	"minute":    `\d{2}`,
+	"timestamp": `\d{8}(?:T\d{2}(?:\d{2})?)?`,
+	"index":     `\d+`,
+}
+
+func (p NamingPolicy) compile() (*fileNamer, error) {
+	n := &fileNamer{template: p.Template, fields: map[string]bool{}}
+	if n.template == "" {
+		n.template = DEFAULT_FILE_NAME_TEMPLATE
+	}
+	var err error
+	if n.location, err = loadTimezone(p.Timezone); err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(n.template, `/\`) {
+		return nil, fmt.Errorf("file name template may not contain a path separator: '%s'", n.template)
+	}
+
+	/* Build a pattern matching names made from the template, with the suffixes the sink adds */
+	body := strings.TrimSuffix(n.template, "{ext}")
+	pattern := "^"
+	for rest := body; rest != ""; {
+		open := strings.Index(rest, "{")
+		if open < 0 {
+			pattern += regexp.QuoteMeta(rest)
+			break
+		}
+		closing := strings.Index(rest[open:], "}")
+		if closing < 0 {
+			return nil, fmt.Errorf("unclosed placeholder in file name template: '%s'", n.template)
+		}
+		field := rest[open+1 : open+closing]
+		fieldPattern, ok := fileNameFieldPatterns[field]
+		if !ok {
+			if field == "ext" {
+				return nil, fmt.Errorf("{ext} must end the file name template: '%s'", n.template)
+			}
+			return nil, fmt.Errorf("unknown placeholder {%s} in file name template", field)
+		}
+		if n.fields[field] {
+			return nil, fmt.Errorf("placeholder {%s} is repeated in file name template", field)
+		}
+		n.fields[field] = true
+		pattern += regexp.QuoteMeta(rest[:open]) + fmt.Sprintf("(?P<%s>%s)", field, fieldPattern)
+		rest = rest[open+closing+1:]
+	}
+	pattern += `(?:_(?P<part>\d+))?(?:_v(?P<version>\d+))?(?P<ext>\.[A-Za-z0-9]+)(?P<gz>\.gz)?$`
+
+	if !n.fields["label"] {
+		return nil, fmt.Errorf("file name template needs {label}: '%s'", n.template)
+	}
+	if !n.fields["timestamp"] && !(n.fields["year"] && n.fields["month"] && n.fields["day"]) {
+		return nil, fmt.Errorf("file name template needs {timestamp} or {year}, {month} and {day}: '%s'", n.template)
+	}
+	if n.pattern, err = regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("failed to compile file name template '%s': %v", n.template, err)
+	}
+
+	for _, template := range p.PreviousTemplates {
+		previous, err := NamingPolicy{Template: template, Timezone: p.Timezone}.compile()
+		if err != nil {
+			return nil, fmt.Errorf("previous template: %v", err)
+		}
+		n.previous = append(n.previous, previous)
+	}
+	return n, nil
+}
+
+func loadTimezone(name string) (*time.Location, error) {
+	switch {
+	case name == "" || name == "UTC":
+		return time.UTC, nil
+	case name == "Local":
+		return time.Local, nil
+	case strings.HasPrefix(name, "+") || strings.HasPrefix(name, "-"):
+		t, err := time.Parse("-07:00", name)
+		if err != nil {
+			return nil, fmt.Errorf("bad timezone offset '%s', expected e.g. +02:00", name)
+		}
+		_, offset := t.Zone()
+		return time.FixedZone("UTC"+name, offset), nil
+	default:
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone '%s': %v", name, err)
+		}
+		return loc, nil
+	}
+}
+
+func (n *fileNamer) fileName(portentaSerial, dataLabel string, t time.Time, extension string) string {
+	rotation := GetRotationPolicy(dataLabel)
+	start := rotation.periodStart(t.In(n.location))
+	index, width := rotation.periodIndex(start)
+	name := strings.NewReplacer(
+		"{serial}", portentaSerial,
+		"{label}", dataLabel,
+		"{year}", fmt.Sprintf("%04d", start.Year()),
+		"{month}", fmt.Sprintf("%02d", start.Month()),
+		"{day}", fmt.Sprintf("%02d", start.Day()),
+		"{hour}", fmt.Sprintf("%02d", start.Hour()),
+		"{minute}", fmt.Sprintf("%02d", start.Minute()),
+		"{timestamp}", rotation.fileTimestamp(start),
+		"{index}", fmt.Sprintf("%0*d", width, index),
+		"{ext}", extension,
+	).Replace(n.template)
+	if !strings.HasSuffix(n.template, "{ext}") {
+		name += extension
+	}
+	return name
+}
+
+var (
+	namingMu     sync.RWMutex
+	namingPolicy = GetDefaultNamingPolicy()
+	namer, _     = namingPolicy.compile()
+	defaultNamer = namer
+	formerNamers = []*fileNamer{} // Replaced by SetNamingPolicy, most recent last
+)
+
+// Sets how generateFileName names files and how ParseFileName reads them back.
+func SetNamingPolicy(p NamingPolicy) error {
+	n, err := p.compile()
+	if err != nil {
+		return fmt.Errorf("invalid file naming: %v", err)
+	}
+	namingMu.Lock()
+	defer namingMu.Unlock()
+	formerNamers = append(formerNamers, namer)
+	namingPolicy, namer = p, n
+	return nil
+}
+
+func GetNamingPolicy() NamingPolicy {
+	namingMu.RLock()
+	defer namingMu.RUnlock()
+	return namingPolicy
+}
+
+func currentFileNamer() *fileNamer {
+	namingMu.RLock()
+	defer namingMu.RUnlock()
+	return namer
+}
+
+/* Parsing */
+
+// The parts of a data file name,
+// OPERA_<serial>_<label>_<timestamp>[_<part>][_v<version>]<extension>[.gz].
+type FileNameInfo struct {
+	PortentaSerial string
+	DataLabel      string
+	Start          time.Time
+	Interval       string // ROTATION_* the timestamp was written with
+	Part           int    // 0 for the first file of a period
+	Version        int    // 1 unless the CSV headers changed
+	Extension      string // Of the data, e.g. ".csv" for a .csv.gz file
+	Compressed     bool
+}
+
+// Parses a file name made with the current naming policy, or failing that
+// with one of the templates used before: its PreviousTemplates, those of
+// earlier SetNamingPolicy calls and the default. Names from a template without
+// {timestamp} are assumed to use the data label's current rotation.
+func ParseFileName(filename string) (FileNameInfo, error) {
+	return parseFileNameWith(knownFileNamers(), filename)
+}
+
+// Returns the first parse of filename by namers that succeeds.
+func parseFileNameWith(namers []*fileNamer, filename string) (FileNameInfo, error) {
+	var firstErr error
+	for _, n := range namers {
+		info, err := n.parse(filename)
+		if err == nil {
+			return info, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return FileNameInfo{Version: 1}, firstErr
+}
+
+// Returns the current namer followed by the earlier ones, most recent first,
+// each template and timezone once.
+func knownFileNamers() []*fileNamer {
+	namingMu.RLock()
+	candidates := append([]*fileNamer{namer}, namer.previous...)
+	for i := len(formerNamers) - 1; i >= 0; i-- {
+		candidates = append(candidates, formerNamers[i])
+		candidates = append(candidates, formerNamers[i].previous...)
+	}
+	candidates = append(candidates, defaultNamer)
+	namingMu.RUnlock()
+	return uniqueFileNamers(candidates)
+}
+
+func uniqueFileNamers(candidates []*fileNamer) []*fileNamer {
+	ret := []*fileNamer{}
+	seen := map[string]bool{}
+	for _, n := range candidates {
+		key := n.template + "\x00" + n.location.String()
+		if !seen[key] {
+			seen[key] = true
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+func (n *fileNamer) parse(filename string) (FileNameInfo, error) {
+	info := FileNameInfo{Version: 1}
+	match := n.pattern.FindStringSubmatch(filepath.Base(filename))
+	if match == nil {
+		return info, fmt.Errorf("not an OPERA data file name: '%s'", filename)
+	}
+	fields := map[string]string{}
+	for i, name := range n.pattern.SubexpNames() {
+		if name != "" {
+			fields[name] = match[i]
+		}
+	}
+	info.PortentaSerial = fields["serial"]
+	info.DataLabel = fields["label"]
+	info.Extension = fields["ext"]
+	info.Compressed = fields["gz"] != ""
+	if fields["part"] != "" {
+		info.Part, _ = strconv.Atoi(fields["part"])
+	}
+	if fields["version"] != "" {
+		info.Version, _ = strconv.Atoi(fields["version"])
+	}
+
+	var err error
+	if timestamp, ok := fields["timestamp"]; ok {
+		switch len(timestamp) {
+		case len("20060102"):
+			info.Interval = ROTATION_DAILY
+			info.Start, err = time.ParseInLocation("20060102", timestamp, n.location)
+		case len("20060102T15"):
+			info.Interval = ROTATION_HOURLY
+			info.Start, err = time.ParseInLocation("20060102T15", timestamp, n.location)
+		default:
+			info.Interval = ROTATION_MINUTES
+			info.Start, err = time.ParseInLocation("20060102T1504", timestamp, n.location)
+		}
+	} else {
+		rotation := GetRotationPolicy(info.DataLabel)
+		info.Interval = rotation.Interval
+		if info.Interval == "" {
+			info.Interval = ROTATION_DAILY
+		}
+		number := func(field string) int {
+			v, _ := strconv.Atoi(fields[field])
+			return v
+		}
+		minute := number("hour")*60 + number("minute")
+		if _, ok := fields["index"]; ok {
+			switch info.Interval {
+			case ROTATION_HOURLY:
+				minute = number("index") * 60
+			case ROTATION_MINUTES:
+				minute = number("index") * rotation.Minutes
+			}
+		}
+		info.Start, err = time.ParseInLocation("2006-01-02", fmt.Sprintf("%s-%s-%s", fields["year"], fields["month"], fields["day"]), n.location)
+		info.Start = time.Date(info.Start.Year(), info.Start.Month(), info.Start.Day(), 0, minute, 0, 0, n.location)
+	}
+	if err != nil {
+		return info, fmt.Errorf("bad timestamp in file name, '%s': %v", filename, err)
+	}
+	return info, nil
+}
+
+// Returns when no more records will be written to the file. N-minute files are
+// assumed to use the data label's current rotation.
+func (info FileNameInfo) End() time.Time {
+	switch info.Interval {
+	case ROTATION_HOURLY:
+		return info.Start.Add(time.Hour)
+	case ROTATION_MINUTES:
+		minutes := max(GetRotationPolicy(info.DataLabel).Minutes, 1)
+		return info.Start.Add(time.Duration(minutes) * time.Minute)
+	default:
+		return info.Start.AddDate(0, 0, 1)
+	}
+}
+
+// Returns "name_NNN.ext" for part > 0 of a file name. Parts past 999 take more
+// digits, so order part files with fileNameLess rather than by name.
+func partFileName(filename string, part int) string {
+	if part <= 0 {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	return fmt.Sprintf("%s_%03d%s", strings.TrimSuffix(filename, ext), part, ext)
+}
+
+// Orders data file names by device, data label and period start, then by part
+// and version number, so _1000 follows _999. Names that do not parse come
+// last, by name.
+func fileNameLess(a, b string) bool {
+	infoA, errA := ParseFileName(a)
+	infoB, errB := ParseFileName(b)
+	switch {
+	case errA != nil || errB != nil:
+		if (errA == nil) != (errB == nil) {
+			return errA == nil
+		}
+	case infoA.PortentaSerial != infoB.PortentaSerial:
+		return infoA.PortentaSerial < infoB.PortentaSerial
+	case infoA.DataLabel != infoB.DataLabel:
+		return infoA.DataLabel < infoB.DataLabel
+	case !infoA.Start.Equal(infoB.Start):
+		return infoA.Start.Before(infoB.Start)
+	case infoA.Part != infoB.Part:
+		return infoA.Part < infoB.Part
+	case infoA.Version != infoB.Version:
+		return infoA.Version < infoB.Version
+	}
+	return a < b
+}
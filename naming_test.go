@@ -0,0 +1,199 @@
+package operadatatypes
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRotationFileNames(t *testing.T) {
+	defer SetRotationPolicies(nil)
+	timestamp := uint32(time.Date(2026, 10, 18, 14, 47, 10, 0, time.UTC).Unix())
+
+	for _, test := range []struct {
+		policy   RotationPolicy
+		expected string
+	}{
+		{RotationPolicy{}, "OPERA_abc_PrimaryRaw_20261018.raw"},
+		{RotationPolicy{Interval: ROTATION_DAILY}, "OPERA_abc_PrimaryRaw_20261018.raw"},
+		{RotationPolicy{Interval: ROTATION_HOURLY}, "OPERA_abc_PrimaryRaw_20261018T14.raw"},
+		{RotationPolicy{Interval: ROTATION_MINUTES, Minutes: 15}, "OPERA_abc_PrimaryRaw_20261018T1445.raw"},
+	} {
+		if err := SetRotationPolicies(map[string]RotationPolicy{DATA_LABEL_PRIMARY_RAW: test.policy}); err != nil {
+			t.Errorf("SetRotationPolicies(%v): %v", test.policy, err)
+			continue
+		}
+		name := generateFileName("abc", DATA_LABEL_PRIMARY_RAW, timestamp, false)
+		if name != test.expected {
+			t.Errorf("rotation %v named file '%s', expected '%s'", test.policy, name, test.expected)
+		}
+
+		info, err := ParseFileName(name)
+		if err != nil {
+			t.Errorf("ParseFileName(%s): %v", name, err)
+			continue
+		}
+		if info.PortentaSerial != "abc" || info.DataLabel != DATA_LABEL_PRIMARY_RAW || info.Extension != BINARY_FILE_EXTENSION {
+			t.Errorf("ParseFileName(%s) returned %+v", name, info)
+		}
+		if info.Start.After(time.Unix(int64(timestamp), 0)) {
+			t.Errorf("ParseFileName(%s) starts at %v, after the record it holds", name, info.Start)
+		}
+	}
+
+	if err := SetRotationPolicies(map[string]RotationPolicy{DATA_LABEL_OUTPUT: {Interval: "weekly"}}); err == nil {
+		t.Errorf("expected an error for an unknown rotation interval")
+	}
+}
+
+func TestNamingTemplateAndTimezone(t *testing.T) {
+	defer SetRotationPolicies(nil)
+	defer SetNamingPolicy(GetDefaultNamingPolicy())
+	SetRotationPolicies(map[string]RotationPolicy{DATA_LABEL_OUTPUT: {Interval: ROTATION_MINUTES, Minutes: 10}})
+	timestamp := uint32(time.Date(2026, 10, 18, 23, 47, 10, 0, time.UTC).Unix())
+
+	for _, test := range []struct {
+		naming   NamingPolicy
+		expected string
+	}{
+		{NamingPolicy{}, "OPERA_abc_Output_20261018T2340.csv"},
+		{NamingPolicy{Timezone: "+02:00"}, "OPERA_abc_Output_20261019T0140.csv"},
+		{NamingPolicy{Timezone: "Local", Template: DEFAULT_FILE_NAME_TEMPLATE}, "OPERA_abc_Output_" + time.Unix(int64(timestamp), 0).Format("20060102T15") + "40.csv"},
+		{NamingPolicy{Template: "{label}-{serial}-{year}{month}{day}-{index}{ext}"}, "Output-abc-20261018-142.csv"},
+		{NamingPolicy{Template: "{serial}.{year}.{month}.{day}.{hour}{minute}.{label}"}, "abc.2026.10.18.2340.Output.csv"},
+	} {
+		if err := SetNamingPolicy(test.naming); err != nil {
+			t.Errorf("SetNamingPolicy(%v): %v", test.naming, err)
+			continue
+		}
+		name := generateFileName("abc", DATA_LABEL_OUTPUT, timestamp, true)
+		if name != test.expected {
+			t.Errorf("naming %v made '%s', expected '%s'", test.naming, name, test.expected)
+			continue
+		}
+
+		info, err := ParseFileName(partFileName(name, 2))
+		if err != nil {
+			t.Errorf("ParseFileName(%s): %v", name, err)
+			continue
+		}
+		start := time.Date(2026, 10, 18, 23, 40, 0, 0, time.UTC)
+		if info.PortentaSerial != "abc" || info.DataLabel != DATA_LABEL_OUTPUT || info.Part != 2 || !info.Start.Equal(start) || info.Interval != ROTATION_MINUTES {
+			t.Errorf("ParseFileName(%s) returned %+v", name, info)
+		}
+	}
+
+	for _, bad := range []NamingPolicy{
+		{Template: "{serial}_{year}{month}{day}{ext}"},
+		{Template: "{label}_{serial}"},
+		{Template: "{label}{ext}_{timestamp}"},
+		{Template: "{label}_{timestamp}_{week}"},
+		{Template: "data/{label}_{timestamp}"},
+		{Timezone: "Mars/Olympus"},
+	} {
+		if err := SetNamingPolicy(bad); err == nil {
+			t.Errorf("expected an error for naming %v", bad)
+		}
+	}
+}
+
+func TestParseFileNamePreviousTemplates(t *testing.T) {
+	defer SetNamingPolicy(GetDefaultNamingPolicy())
+	dashed, dotted := "{label}-{serial}-{timestamp}{ext}", "{serial}.{label}.{year}{month}{day}"
+	for _, p := range []NamingPolicy{{Template: dashed}, {Template: "{serial}+{label}+{timestamp}", PreviousTemplates: []string{dotted}}} {
+		if err := SetNamingPolicy(p); err != nil {
+			t.Errorf("SetNamingPolicy(%v): %v", p, err)
+			return
+		}
+	}
+
+	/* Names of the current, listed, replaced and default templates all parse */
+	for _, name := range []string{"abc+Output+20261018.csv", "abc.Output.20261018.csv", "Output-abc-20261018.csv", "OPERA_abc_Output_20261018.csv"} {
+		info, err := ParseFileName(name)
+		if err != nil || info.PortentaSerial != "abc" || info.DataLabel != DATA_LABEL_OUTPUT || info.Start.Day() != 18 {
+			t.Errorf("ParseFileName(%s) returned %+v, %v", name, info, err)
+		}
+	}
+	if err := SetNamingPolicy(NamingPolicy{PreviousTemplates: []string{"{serial}"}}); err == nil {
+		t.Errorf("expected an error for a bad previous template")
+	}
+}
+
+func TestParseFileNameSuffixes(t *testing.T) {
+	info, err := ParseFileName("/data/OPERA_abc_Output_20261018_002_v3.csv")
+	if err != nil {
+		t.Errorf("ParseFileName(): %v", err)
+		return
+	}
+	if info.Part != 2 || info.Version != 3 || info.DataLabel != DATA_LABEL_OUTPUT || info.PortentaSerial != "abc" {
+		t.Errorf("ParseFileName() returned %+v", info)
+	}
+	if _, err := ParseFileName("notes.txt"); err == nil {
+		t.Errorf("expected an error for a file that is not OPERA data")
+	}
+}
+
+func TestFileSinkMaxBytes(t *testing.T) {
+	defer SetRotationPolicies(nil)
+	SetRotationPolicies(map[string]RotationPolicy{DATA_LABEL_PRIMARY_RAW: {MaxBytes: 4}})
+
+	root := t.TempDir()
+	sink := NewFileSink(root, 0)
+	for i := byte(0); i < 5; i++ {
+		if err := sink.Write(BinaryFileWriteJob{Filename: "OPERA_abc_PrimaryRaw_20261018.raw", Content: []byte{i, i}}); err != nil {
+			t.Errorf("sink.Write(): %v", err)
+			return
+		}
+	}
+	sink.Close()
+
+	for name, expected := range map[string]string{
+		"OPERA_abc_PrimaryRaw_20261018.raw":     "\x00\x00\x01\x01",
+		"OPERA_abc_PrimaryRaw_20261018_001.raw": "\x02\x02\x03\x03",
+		"OPERA_abc_PrimaryRaw_20261018_002.raw": "\x04\x04",
+	} {
+		b, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Errorf("failed to read sink output: %v", err)
+		} else if string(b) != expected {
+			t.Errorf("sink wrote %q to %s, expected %q", b, name, expected)
+		}
+	}
+}
+
+func TestFileSinkOwnPolicies(t *testing.T) {
+	/* The sink's rotation and naming apply without the package's */
+	root := t.TempDir()
+	sink := NewFileSink(root, 0)
+	if err := sink.SetRotationPolicies(map[string]RotationPolicy{DATA_LABEL_OUTPUT: {MaxBytes: 4}}); err != nil {
+		t.Errorf("sink.SetRotationPolicies(): %v", err)
+		return
+	}
+	if err := sink.SetNamingPolicy(NamingPolicy{Template: "{label}-{serial}-{timestamp}{ext}"}); err != nil {
+		t.Errorf("sink.SetNamingPolicy(): %v", err)
+		return
+	}
+	for i := byte(0); i < 2; i++ {
+		sink.Write(BinaryFileWriteJob{Filename: "Output-abc-20261018.raw", Content: []byte{i, i, i}})
+	}
+	sink.Close()
+	if _, err := os.Stat(filepath.Join(root, "Output-abc-20261018_001.raw")); err != nil {
+		t.Errorf("sink did not rotate by its own policy: %v", err)
+	}
+	if err := sink.SetRotationPolicies(map[string]RotationPolicy{DATA_LABEL_OUTPUT: {MaxBytes: -1}}); err == nil {
+		t.Errorf("expected an error for negative max bytes")
+	}
+}
+
+func TestPartsPast999(t *testing.T) {
+	names := []string{partFileName("OPERA_abc_Output_20261018.csv", 1000), partFileName("OPERA_abc_Output_20261018.csv", 999), "OPERA_abc_Output_20261018.csv"}
+	if info, err := ParseFileName(names[0]); err != nil || info.Part != 1000 {
+		t.Errorf("ParseFileName(%s) returned %+v, %v", names[0], info, err)
+	}
+	sort.Slice(names, func(i, j int) bool { return fileNameLess(names[i], names[j]) })
+	if names[0] != "OPERA_abc_Output_20261018.csv" || names[1] != "OPERA_abc_Output_20261018_999.csv" || names[2] != "OPERA_abc_Output_20261018_1000.csv" {
+		t.Errorf("parts sorted as %v", names)
+	}
+}
@@ -0,0 +1,525 @@
+package operadatatypes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* NetCDF-3 Classic */
+
+// Enough of the NetCDF-3 classic format (CDF-1) to write fixed size variables.
+// All values are big endian and every header entry and variable is padded to
+// 4 bytes.
+
+const (
+	ncChar   = 2
+	ncInt    = 4
+	ncFloat  = 5
+	ncDouble = 6
+
+	ncDimensionTag = 10
+	ncVariableTag  = 11
+	ncAttributeTag = 12
+
+	NC_FILL_INT = -2147483647
+)
+
+// Value is a string, int32, float32 or float64.
+type ncAttribute struct {
+	name  string
+	value any
+}
+
+// Data is a []int32, []float32 or []float64 over the variable's dimensions.
+type ncVariable struct {
+	name  string
+	dims  []int
+	attrs []ncAttribute
+	data  any
+}
+
+type ncDimension struct {
+	name   string
+	length int
+}
+
+type netcdfFile struct {
+	dims  []ncDimension
+	attrs []ncAttribute
+	vars  []*ncVariable
+}
+
+func ncPad(b *bytes.Buffer) {
+	for b.Len()%4 != 0 {
+		b.WriteByte(0)
+	}
+}
+
+func ncWriteName(b *bytes.Buffer, name string) {
+	binary.Write(b, binary.BigEndian, int32(len(name)))
+	b.WriteString(name)
+	ncPad(b)
+}
+
+func ncWriteAttributes(b *bytes.Buffer, attrs []ncAttribute) error {
+	if len(attrs) == 0 {
+		b.Write(make([]byte, 8)) // ABSENT
+		return nil
+	}
+	binary.Write(b, binary.BigEndian, [2]int32{ncAttributeTag, int32(len(attrs))})
+	for _, a := range attrs {
+		ncWriteName(b, a.name)
+		switch v := a.value.(type) {
+		case string:
+			binary.Write(b, binary.BigEndian, [2]int32{ncChar, int32(len(v))})
+			b.WriteString(v)
+		case int32:
+			binary.Write(b, binary.BigEndian, [3]int32{ncInt, 1, v})
+		case float32:
+			binary.Write(b, binary.BigEndian, [2]int32{ncFloat, 1})
+			binary.Write(b, binary.BigEndian, v)
+		case float64:
+			binary.Write(b, binary.BigEndian, [2]int32{ncDouble, 1})
+			binary.Write(b, binary.BigEndian, v)
+		default:
+			return fmt.Errorf("attribute %s has unsupported type %T", a.name, a.value)
+		}
+		ncPad(b)
+	}
+	return nil
+}
+
+// Returns the nc_type of a variable's data and its size in bytes, unpadded.
+func (v *ncVariable) typeAndSize() (int32, int, error) {
+	switch d := v.data.(type) {
+	case []int32:
+		return ncInt, 4 * len(d), nil
+	case []float32:
+		return ncFloat, 4 * len(d), nil
+	case []float64:
+		return ncDouble, 8 * len(d), nil
+	default:
+		return 0, 0, fmt.Errorf("variable %s has unsupported data %T", v.name, v.data)
+	}
+}
+
+func (f *netcdfFile) header(begins []int64) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("CDF\x01")
+	binary.Write(&b, binary.BigEndian, int32(0)) // No record variables
+
+	if len(f.dims) == 0 {
+		b.Write(make([]byte, 8))
+	} else {
+		binary.Write(&b, binary.BigEndian, [2]int32{ncDimensionTag, int32(len(f.dims))})
+		for _, d := range f.dims {
+			ncWriteName(&b, d.name)
+			binary.Write(&b, binary.BigEndian, int32(d.length))
+		}
+	}
+	if err := ncWriteAttributes(&b, f.attrs); err != nil {
+		return nil, err
+	}
+
+	if len(f.vars) == 0 {
+		b.Write(make([]byte, 8))
+	} else {
+		binary.Write(&b, binary.BigEndian, [2]int32{ncVariableTag, int32(len(f.vars))})
+	}
+	for i, v := range f.vars {
+		ncWriteName(&b, v.name)
+		binary.Write(&b, binary.BigEndian, int32(len(v.dims)))
+		for _, dim := range v.dims {
+			binary.Write(&b, binary.BigEndian, int32(dim))
+		}
+		if err := ncWriteAttributes(&b, v.attrs); err != nil {
+			return nil, fmt.Errorf("variable %s: %v", v.name, err)
+		}
+		ncType, size, err := v.typeAndSize()
+		if err != nil {
+			return nil, err
+		}
+		binary.Write(&b, binary.BigEndian, [3]int32{ncType, int32((size + 3) / 4 * 4), int32(begins[i])})
+	}
+	return b.Bytes(), nil
+}
+
+// Writes the header and then each variable's data.
+func (f *netcdfFile) write(w io.Writer) error {
+	/* The header's size does not depend on the offsets it holds */
+	begins := make([]int64, len(f.vars))
+	header, err := f.header(begins)
+	if err != nil {
+		return err
+	}
+	offset := int64(len(header))
+	for i, v := range f.vars {
+		_, size, _ := v.typeAndSize()
+		begins[i] = offset
+		offset += int64(size+3) / 4 * 4
+	}
+	if offset > math.MaxInt32 {
+		return fmt.Errorf("%d bytes of data is too large for NetCDF classic", offset)
+	}
+	if header, err = f.header(begins); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.Write(header)
+	for _, v := range f.vars {
+		_, size, _ := v.typeAndSize()
+		binary.Write(bw, binary.BigEndian, v.data)
+		bw.Write(make([]byte, (4-size%4)%4))
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write netcdf: %v", err)
+	}
+	return nil
+}
+
+/* CF Export */
+
+// Long names of the exported variables, by column. The ML concentrations are
+// named from their column, e.g. "ML estimated PM2.5 mass concentration".
+var netcdfLongNames = map[string]string{
+	"temp":               "Air temperature (ML corrected)",
+	"rh":                 "Relative humidity (ML corrected)",
+	"sps30_pm1":          "SPS30 PM1 mass concentration",
+	"sps30_pm2p5":        "SPS30 PM2.5 mass concentration",
+	"sps30_pm4":          "SPS30 PM4 mass concentration",
+	"sps30_pm10":         "SPS30 PM10 mass concentration",
+	"sps30_pn0p5":        "SPS30 PN0.5 number concentration",
+	"sps30_pn1":          "SPS30 PN1 number concentration",
+	"sps30_pn2p5":        "SPS30 PN2.5 number concentration",
+	"sps30_pn4":          "SPS30 PN4 number concentration",
+	"sps30_pn10":         "SPS30 PN10 number concentration",
+	"sps30_tps":          "SPS30 typical particle size",
+	"pressure":           "Air pressure",
+	"co2":                "CO2 mole fraction",
+	"voc_index":          "Sensirion VOC index",
+	"flow_temp":          "Flow sensor temperature",
+	"flow_hum":           "Flow sensor relative humidity",
+	"flow_rate":          "Flow rate",
+	"imx8_temp":          "Portenta i.MX8 temperature",
+	"teensy_temp":        "Teensy MCU temperature",
+	"optical_temp0":      "Laser 0 temperature",
+	"optical_temp1":      "Laser 1 temperature",
+	"optical_temp2":      "Laser 2 temperature",
+	"omb_temp_htu":       "OMB HTU temperature",
+	"omb_hum_htu":        "OMB HTU relative humidity",
+	"omb_temp_scd":       "OMB SCD41 temperature",
+	"omb_hum_scd":        "OMB SCD41 relative humidity",
+	"mean_5v_monitor":    "5V supply mean",
+	"std_dev_5v_monitor": "5V supply standard deviation",
+}
+
+var netcdfStandardNames = map[string]string{
+	"temp":        "air_temperature",
+	"rh":          "relative_humidity",
+	"pressure":    "air_pressure",
+	"co2":         "mole_fraction_of_carbon_dioxide_in_air",
+	"PM1":         "mass_concentration_of_pm1_ambient_aerosol_particles_in_air",
+	"PM2_5":       "mass_concentration_of_pm2p5_ambient_aerosol_particles_in_air",
+	"PM10":        "mass_concentration_of_pm10_ambient_aerosol_particles_in_air",
+	"sps30_pm1":   "mass_concentration_of_pm1_ambient_aerosol_particles_in_air",
+	"sps30_pm2p5": "mass_concentration_of_pm2p5_ambient_aerosol_particles_in_air",
+	"sps30_pm10":  "mass_concentration_of_pm10_ambient_aerosol_particles_in_air",
+}
+
+// Columns that are not numeric time series.
+var netcdfSkippedColumns = map[string]bool{
+	"unix": true, "portenta": true, "class_label": true, "class_labels": true, "class_probs": true,
+}
+
+func netcdfLongName(column string) string {
+	if name, ok := netcdfLongNames[column]; ok {
+		return name
+	}
+	size := strings.ReplaceAll(column[2:], "_", ".")
+	if strings.HasPrefix(column, "PN") {
+		return "ML estimated PN" + size + " number concentration"
+	}
+	return "ML estimated PM" + size + " mass concentration"
+}
+
+// Returns the UDUNITS form of a Field.Unit.
+func netcdfUnits(unit string) string {
+	switch unit {
+	case "":
+		return "1"
+	case "ug/m3":
+		return "ug m-3"
+	case "#/cm3":
+		return "cm-3"
+	case "%":
+		return "percent"
+	case "ppm":
+		return "1e-6"
+	case "m/s":
+		return "m s-1"
+	default:
+		return unit
+	}
+}
+
+// A time series variable filled from one column of either output.
+type netcdfColumn struct {
+	name   string // Column name
+	unit   string
+	isInt  bool
+	values map[uint32]any
+}
+
+func netcdfColumnsOf[T any](s Schema[T], columns []*netcdfColumn, seen map[string]*netcdfColumn) []*netcdfColumn {
+	for _, f := range s.Fields {
+		if netcdfSkippedColumns[f.Name] || seen[f.Name] != nil {
+			continue
+		}
+		_, isFloat := f.value(new(T)).(float32)
+		c := &netcdfColumn{name: f.Name, unit: f.Unit, isInt: !isFloat, values: map[uint32]any{}}
+		seen[f.Name] = c
+		columns = append(columns, c)
+	}
+	return columns
+}
+
+func netcdfAdd[T any](s Schema[T], seen map[string]*netcdfColumn, unix uint32, d *T) {
+	for _, f := range s.Fields {
+		c := seen[f.Name]
+		if c == nil {
+			continue
+		}
+		if _, ok := c.values[unix]; !ok {
+			c.values[unix] = f.value(d)
+		}
+	}
+}
+
+// The records of one device for a NetCDF export. Records are keyed by their
+// unix time, so a record read twice (e.g. from the .raw and the .csv file of
+// the same day) is exported once.
+type NetcdfExport struct {
+	PortentaSerial string
+	FromUnix       uint32 // Records at or after this, if set
+	ToUnix         uint32 // Records before this, if set
+
+	opera     map[uint32]*OperaData
+	secondary map[uint32]*SecondaryData
+}
+
+func NewNetcdfExport(portentaSerial string, fromUnix, toUnix uint32) *NetcdfExport {
+	return &NetcdfExport{
+		PortentaSerial: portentaSerial,
+		FromUnix:       fromUnix,
+		ToUnix:         toUnix,
+		opera:          map[uint32]*OperaData{},
+		secondary:      map[uint32]*SecondaryData{},
+	}
+}
+
+func (e *NetcdfExport) inRange(unix uint32) bool {
+	return (e.FromUnix == 0 || unix >= e.FromUnix) && (e.ToUnix == 0 || unix < e.ToUnix)
+}
+
+// Adds an *OperaData or *SecondaryData in the export's range and of its serial.
+// Other records are ignored.
+func (e *NetcdfExport) Add(d OutputData) {
+	switch v := d.(type) {
+	case *OperaData:
+		if v.PortentaSerial == e.PortentaSerial && e.inRange(v.UnixSec) && e.opera[v.UnixSec] == nil {
+			e.opera[v.UnixSec] = v
+		}
+	case *SecondaryData:
+		if v.PortentaSerial == e.PortentaSerial && e.inRange(v.UnixSec) && e.secondary[v.UnixSec] == nil {
+			e.secondary[v.UnixSec] = v
+		}
+	}
+}
+
+// Adds the records of an Output or SecondaryRaw data file, .raw or .csv,
+// compressed or not. The records before a truncated or damaged part are kept
+// when the error about it is returned.
+func (e *NetcdfExport) ReadFile(path string) error {
+	info, err := ParseFileName(filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	f, err := OpenDataFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var next func() (OutputData, error)
+	switch {
+	case info.Extension == BINARY_FILE_EXTENSION:
+		next = NewRawArchiveReader(f).Next
+	case info.Extension == CSV_FILE_EXTENSION && info.DataLabel == DATA_LABEL_OUTPUT:
+		r, err := NewOperaCsvReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to read '%s': %v", path, err)
+		}
+		next = func() (OutputData, error) { return r.Next() }
+	case info.Extension == CSV_FILE_EXTENSION && info.DataLabel == DATA_LABEL_SECONDARY_RAW:
+		r, err := NewSecondaryCsvReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to read '%s': %v", path, err)
+		}
+		next = func() (OutputData, error) { return r.Next() }
+	default:
+		return nil
+	}
+	for {
+		d, err := next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read '%s': %v", path, err)
+		}
+		e.Add(d)
+	}
+}
+
+// Adds the records of the Output and SecondaryRaw files the catalog lists for
+// the export's serial and range. A damaged file does not stop the others; the
+// errors of all of them are returned together.
+func (e *NetcdfExport) ReadCatalog(c *Catalog) error {
+	q := CatalogQuery{PortentaSerial: e.PortentaSerial, FromUnix: e.FromUnix}
+	if e.ToUnix > 0 {
+		q.ToUnix = e.ToUnix - 1
+	}
+	fileErrs := []error{}
+	for _, label := range []string{DATA_LABEL_OUTPUT, DATA_LABEL_SECONDARY_RAW} {
+		q.DataLabel = label
+		for _, entry := range c.Query(q) {
+			if err := e.ReadFile(filepath.Join(c.Root, entry.Filename)); err != nil {
+				fileErrs = append(fileErrs, err)
+			}
+		}
+	}
+	return errors.Join(fileErrs...)
+}
+
+// Number of distinct times the export holds.
+func (e *NetcdfExport) Len() int {
+	return len(e.times())
+}
+
+func (e *NetcdfExport) times() []uint32 {
+	ret := []uint32{}
+	for unix := range e.opera {
+		ret = append(ret, unix)
+	}
+	for unix := range e.secondary {
+		if e.opera[unix] == nil {
+			ret = append(ret, unix)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// Writes the export as a CF-1.8 NetCDF-3 classic file with one time dimension.
+// Each numeric column of the Output and SecondaryRaw CSV files is a variable of
+// the same name (lower case), missing values as NaN or NC_FILL_INT. Columns
+// both outputs have, such as co2, take the Output value where there is one.
+// An export without records is an error, as a time length of 0 would make the
+// dimension unlimited.
+func (e *NetcdfExport) Write(w io.Writer) error {
+	times := e.times()
+	if len(times) == 0 {
+		return fmt.Errorf("no records from %s in the export's range", e.PortentaSerial)
+	}
+	seen := map[string]*netcdfColumn{}
+	columns := netcdfColumnsOf(OutputSchema, nil, seen)
+	columns = netcdfColumnsOf(SecondaryRawSchema, columns, seen)
+	for _, unix := range times {
+		if d := e.opera[unix]; d != nil {
+			netcdfAdd(OutputSchema, seen, unix, d)
+		}
+		if d := e.secondary[unix]; d != nil {
+			netcdfAdd(SecondaryRawSchema, seen, unix, d)
+		}
+	}
+
+	timeValues := make([]float64, len(times))
+	for i, unix := range times {
+		timeValues[i] = float64(unix)
+	}
+	f := &netcdfFile{
+		dims: []ncDimension{{name: "time", length: len(times)}},
+		attrs: []ncAttribute{
+			{"Conventions", "CF-1.8"},
+			{"title", "OPERA air quality data"},
+			{"featureType", "timeSeries"},
+			{"portenta_serial", e.PortentaSerial},
+			{"history", time.Now().UTC().Format(time.RFC3339) + " exported from OPERA data files"},
+		},
+		vars: []*ncVariable{{
+			name: "time",
+			dims: []int{0},
+			attrs: []ncAttribute{
+				{"standard_name", "time"},
+				{"long_name", "Time"},
+				{"units", "seconds since 1970-01-01 00:00:00 UTC"},
+				{"calendar", "standard"},
+				{"axis", "T"},
+			},
+			data: timeValues,
+		}},
+	}
+	f.attrs = append(f.attrs,
+		ncAttribute{"time_coverage_start", time.Unix(int64(times[0]), 0).UTC().Format(time.RFC3339)},
+		ncAttribute{"time_coverage_end", time.Unix(int64(times[len(times)-1]), 0).UTC().Format(time.RFC3339)},
+	)
+
+	for _, c := range columns {
+		v := &ncVariable{name: strings.ToLower(c.name), dims: []int{0}}
+		if standardName, ok := netcdfStandardNames[c.name]; ok {
+			v.attrs = append(v.attrs, ncAttribute{"standard_name", standardName})
+		}
+		v.attrs = append(v.attrs, ncAttribute{"long_name", netcdfLongName(c.name)}, ncAttribute{"units", netcdfUnits(c.unit)})
+		if c.isInt {
+			data := make([]int32, len(times))
+			for i, unix := range times {
+				data[i] = NC_FILL_INT
+				switch n := c.values[unix].(type) {
+				case uint8:
+					data[i] = int32(n)
+				case uint16:
+					data[i] = int32(n)
+				case uint32:
+					if n <= math.MaxInt32 {
+						data[i] = int32(n)
+					}
+				case int32:
+					data[i] = n
+				}
+			}
+			v.attrs = append(v.attrs, ncAttribute{"_FillValue", int32(NC_FILL_INT)})
+			v.data = data
+		} else {
+			data := make([]float32, len(times))
+			for i, unix := range times {
+				data[i] = float32(math.NaN())
+				if n, ok := c.values[unix].(float32); ok {
+					data[i] = n
+				}
+			}
+			v.attrs = append(v.attrs, ncAttribute{"_FillValue", float32(math.NaN())})
+			v.data = data
+		}
+		f.vars = append(f.vars, v)
+	}
+	return f.write(w)
+}
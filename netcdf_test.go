@@ -0,0 +1,235 @@
+package operadatatypes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type parsedNcVariable struct {
+	dims  []int32
+	attrs map[string]any
+	data  any
+}
+
+// Reads back a CDF-1 file as the format specification lays it out.
+func parseNetcdf(b []byte) (dims map[string]int32, attrs map[string]any, vars map[string]*parsedNcVariable, err error) {
+	r := bytes.NewReader(b)
+	read := func(v any) {
+		if err == nil {
+			err = binary.Read(r, binary.BigEndian, v)
+		}
+	}
+	readInt := func() int32 {
+		var n int32
+		read(&n)
+		return n
+	}
+	pad := func(n int) {
+		if err == nil && n%4 != 0 {
+			_, err = r.Seek(int64(4-n%4), io.SeekCurrent)
+		}
+	}
+	readName := func() string {
+		n := readInt()
+		if err != nil || n < 0 || int(n) > r.Len() {
+			return ""
+		}
+		s := make([]byte, n)
+		read(s)
+		pad(int(n))
+		return string(s)
+	}
+	readAttrs := func() map[string]any {
+		ret := map[string]any{}
+		readInt() // NC_ATTRIBUTE or ZERO
+		n := readInt()
+		for i := int32(0); i < n && err == nil; i++ {
+			name, ncType, count := readName(), readInt(), readInt()
+			switch ncType {
+			case ncChar:
+				s := make([]byte, count)
+				read(s)
+				pad(int(count))
+				ret[name] = string(s)
+			case ncInt:
+				ret[name] = readInt()
+			case ncFloat:
+				var f float32
+				read(&f)
+				ret[name] = f
+			case ncDouble:
+				var f float64
+				read(&f)
+				ret[name] = f
+			default:
+				err = fmt.Errorf("attribute %s has type %d", name, ncType)
+			}
+		}
+		return ret
+	}
+
+	magic := make([]byte, 4)
+	read(magic)
+	if string(magic) != "CDF\x01" {
+		return nil, nil, nil, fmt.Errorf("bad magic %q", magic)
+	}
+	readInt() // numrecs
+	dims = map[string]int32{}
+	readInt()
+	n := readInt()
+	dimLengths := []int32{}
+	for i := int32(0); i < n && err == nil; i++ {
+		name := readName()
+		dims[name] = readInt()
+		dimLengths = append(dimLengths, dims[name])
+	}
+	attrs = readAttrs()
+	vars = map[string]*parsedNcVariable{}
+	readInt()
+	n = readInt()
+	for i := int32(0); i < n && err == nil; i++ {
+		v := &parsedNcVariable{}
+		name := readName()
+		v.dims = make([]int32, readInt())
+		read(v.dims)
+		v.attrs = readAttrs()
+		ncType, size, begin := readInt(), readInt(), readInt()
+		length := 1
+		for _, d := range v.dims {
+			length *= int(dimLengths[d])
+		}
+		data := io.NewSectionReader(bytes.NewReader(b), int64(begin), int64(size))
+		switch ncType {
+		case ncInt:
+			v.data = make([]int32, length)
+		case ncFloat:
+			v.data = make([]float32, length)
+		case ncDouble:
+			v.data = make([]float64, length)
+		}
+		if err == nil {
+			err = binary.Read(data, binary.BigEndian, v.data)
+		}
+		vars[name] = v
+	}
+	return dims, attrs, vars, err
+}
+
+func TestNetcdfExport(t *testing.T) {
+	root := t.TempDir()
+	sink := NewFileSink(root, 0)
+	opera := &OperaData{UnixSec: 100, PortentaSerial: "abc", Temp: 21.5, Co2: 400}
+	opera.Concentrations.PM2p5 = 3.25
+	for _, d := range []OutputData{
+		opera,
+		&OperaData{UnixSec: 99, PortentaSerial: "abc"},  // Before the range
+		&OperaData{UnixSec: 101, PortentaSerial: "xyz"}, // Another device
+		&SecondaryData{UnixSec: 100, PortentaSerial: "abc", Co2: 405, FlowRate: 1.5},
+		&SecondaryData{UnixSec: 102, PortentaSerial: "abc", Co2: 410, VocIndex: -1},
+	} {
+		for _, job := range d.CsvFileWriteJob("abc") {
+			sink.Write(job)
+		}
+		for _, job := range d.BinaryFileWriteJob("abc") {
+			sink.Write(job)
+		}
+	}
+	sink.Close()
+	catalog, err := OpenCatalog(root)
+	if err != nil {
+		t.Errorf("OpenCatalog(): %v", err)
+		return
+	}
+
+	/* Records are in both the .csv and the .raw files, and are exported once */
+	e := NewNetcdfExport("abc", 100, 200)
+	if err := e.ReadCatalog(catalog); err != nil {
+		t.Errorf("ReadCatalog(): %v", err)
+		return
+	}
+	if e.Len() != 2 {
+		t.Errorf("export holds %d times, expected 2", e.Len())
+	}
+	path := filepath.Join(root, "export.nc")
+	f, _ := os.Create(path)
+	if err := e.Write(f); err != nil {
+		t.Errorf("Write(): %v", err)
+		return
+	}
+	f.Close()
+
+	b, _ := os.ReadFile(path)
+	dims, attrs, vars, err := parseNetcdf(b)
+	if err != nil {
+		t.Errorf("failed to parse the export: %v", err)
+		return
+	}
+	if dims["time"] != 2 || attrs["Conventions"] != "CF-1.8" || attrs["portenta_serial"] != "abc" || attrs["time_coverage_end"] != "1970-01-01T00:01:42Z" {
+		t.Errorf("export has dimensions %v and attributes %v", dims, attrs)
+	}
+	if v := vars["time"]; v == nil || v.data.([]float64)[0] != 100 || v.data.([]float64)[1] != 102 {
+		t.Errorf("time variable is %+v", v)
+	}
+	if v := vars["pm2_5"]; v == nil || v.attrs["units"] != "ug m-3" || v.attrs["long_name"] != "ML estimated PM2.5 mass concentration" || v.data.([]float32)[0] != 3.25 || !math.IsNaN(float64(v.data.([]float32)[1])) {
+		t.Errorf("pm2_5 variable is %+v", v)
+	}
+	if v := vars["co2"]; v == nil || v.attrs["standard_name"] != "mole_fraction_of_carbon_dioxide_in_air" || v.data.([]int32)[0] != 400 || v.data.([]int32)[1] != 410 {
+		t.Errorf("co2 variable is %+v", v)
+	}
+	if v := vars["flow_rate"]; v == nil || v.attrs["units"] != "m s-1" || v.data.([]float32)[0] != 1.5 {
+		t.Errorf("flow_rate variable is %+v", v)
+	}
+	if v := vars["temp"]; v == nil || v.attrs["units"] != "degC" || v.data.([]float32)[0] != 21.5 {
+		t.Errorf("temp variable is %+v", v)
+	}
+	if v := vars["voc_index"]; v == nil || v.data.([]int32)[1] != -1 || v.attrs["_FillValue"] != int32(NC_FILL_INT) {
+		t.Errorf("voc_index variable is %+v", v)
+	}
+	if vars["portenta"] != nil || vars["class_probs"] != nil {
+		t.Errorf("export has non numeric variables")
+	}
+}
+
+func TestNetcdfExportDamagedFile(t *testing.T) {
+	root := t.TempDir()
+	sink := NewFileSink(root, 0)
+	rawName := "OPERA_abc_Output_19700101.raw"
+	for _, unix := range []uint32{100, 101} {
+		for _, job := range (&OperaData{UnixSec: unix, PortentaSerial: "abc"}).BinaryFileWriteJob("abc") {
+			job.Filename = rawName
+			sink.Write(job)
+		}
+	}
+	for _, job := range (&SecondaryData{UnixSec: 102, PortentaSerial: "abc"}).CsvFileWriteJob("abc") {
+		sink.Write(job)
+	}
+	sink.Close()
+
+	/* The second record of the .raw is cut short */
+	info, _ := os.Stat(filepath.Join(root, rawName))
+	os.Truncate(filepath.Join(root, rawName), info.Size()-3)
+	catalog, err := OpenCatalog(root)
+	if err != nil {
+		t.Errorf("OpenCatalog(): %v", err)
+		return
+	}
+	e := NewNetcdfExport("abc", 100, 200)
+	if err := e.ReadCatalog(catalog); err == nil || !strings.Contains(err.Error(), rawName) {
+		t.Errorf("ReadCatalog() returned %v, expected the damaged file's error", err)
+	}
+	if e.Len() != 2 {
+		t.Errorf("export holds %d times, expected the good record and the other file's", e.Len())
+	}
+
+	/* Nothing to write is an error, not a file of unlimited length */
+	if err := NewNetcdfExport("xyz", 100, 200).Write(io.Discard); err == nil {
+		t.Errorf("expected an error writing an empty export")
+	}
+}
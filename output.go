@@ -5,26 +5,38 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"time"
 )
 
 /* Util */
 const CSV_FILE_EXTENSION = ".csv"
 const BINARY_FILE_EXTENSION = ".raw"
+const JSONL_FILE_EXTENSION = ".jsonl"
 const OUTPUT_FILE_RAW_TYPE_INDICATOR_PRIMARY = 'P'
 const OUTPUT_FILE_RAW_TYPE_INDICATOR_SECONDARY = 'S'
 const OUTPUT_FILE_RAW_TYPE_INDICATOR_OPERA_OUTPUT = 'O'
 
+const (
+	DATA_LABEL_PRIMARY_RAW   = "PrimaryRaw"
+	DATA_LABEL_SECONDARY_RAW = "SecondaryRaw"
+	DATA_LABEL_OUTPUT        = "Output"
+	DATA_LABEL_PULSES        = "Pulses"
+)
+
 func generateFileName(portentaSerial, dataLabel string, timestamp uint32, isCsv bool) string {
-	t := time.Unix(int64(timestamp), 0)
-	ret := fmt.Sprintf("OPERA_%s_%s_%04d%02d%02d", portentaSerial, dataLabel, t.Year(), t.Month(), t.Day())
 	if isCsv {
-		return ret + CSV_FILE_EXTENSION
+		return generateFileNameWithExtension(portentaSerial, dataLabel, timestamp, CSV_FILE_EXTENSION)
 	} else {
-		return ret + BINARY_FILE_EXTENSION
+		return generateFileNameWithExtension(portentaSerial, dataLabel, timestamp, BINARY_FILE_EXTENSION)
 	}
 }
 
+func generateFileNameWithExtension(portentaSerial, dataLabel string, timestamp uint32, extension string) string {
+	return currentFileNamer().fileName(portentaSerial, dataLabel, time.Unix(int64(timestamp), 0), extension)
+}
+
 func writeStringToBinary(w io.Writer, s string) {
 	binary.Write(w, binary.LittleEndian, uint32(len(s)))
 	w.Write([]byte(s))
@@ -35,7 +47,7 @@ func readStringFromBinary(r io.Reader) (string, error) {
 		return "", err
 	}
 	buf := make([]byte, n)
-	if _, err := r.Read(buf); err != nil {
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return "", err
 	}
 	return string(buf), nil
@@ -43,26 +55,26 @@ func readStringFromBinary(r io.Reader) (string, error) {
 
 /* Structs */
 type SecondaryData struct {
-	UnixSec        uint32
-	PortentaSerial string
-
-	Sps30           Sps30Data
-	Pressure        float32
-	Co2             uint32
-	VocIndex        int32
-	FlowTemperature float32
-	FlowHumidity    float32
-	FlowRate        float32
-
-	PortentaImx8Temp    float32
-	TeensyMcuTemp       float32
-	OpticalTemperatures [3]float32
-	OmbTemperatureHtu   float32
-	OmbHumidityHtu      float32
-	OmbTemperatureScd   float32
-	OmbHumidityScd      float32
-	Monitor5vMean       float32
-	Monitor5vStdDev     float32
+	UnixSec        uint32 `json:"unix_sec"`
+	PortentaSerial string `json:"portenta_serial"`
+
+	Sps30           Sps30Data `json:"sps30"`
+	Pressure        float32   `json:"pressure"`
+	Co2             uint32    `json:"co2"`
+	VocIndex        int32     `json:"voc"`
+	FlowTemperature float32   `json:"flow_temp"`
+	FlowHumidity    float32   `json:"flow_hum"`
+	FlowRate        float32   `json:"flow_rate"`
+
+	PortentaImx8Temp    float32    `json:"imx8_temp"`
+	TeensyMcuTemp       float32    `json:"mcu_temp"`
+	OpticalTemperatures [3]float32 `json:"optical_temps"`
+	OmbTemperatureHtu   float32    `json:"temp_htu"`
+	OmbHumidityHtu      float32    `json:"hum_htu"`
+	OmbTemperatureScd   float32    `json:"temp_scd"`
+	OmbHumidityScd      float32    `json:"hum_scd"`
+	Monitor5vMean       float32    `json:"monitor5vMean"`
+	Monitor5vStdDev     float32    `json:"monitor5vStdDev"`
 }
 
 func (d *SecondaryData) Populate(portentaSerial string, portentaImx8Temp float32, t *NewTeensyData, s *Sps30Data, m *M4SensorMeasurement) {
@@ -88,26 +100,51 @@ func (d *SecondaryData) Populate(portentaSerial string, portentaImx8Temp float32
 	d.Monitor5vStdDev = m.Monitor5VStdDev
 }
 
-type PrimaryData struct {
-	PortentaSerial string
-	TeensyData     NewTeensyData
+// Inverse of Populate for the SPS30 part, used when replaying archives.
+func (d *SecondaryData) Sps30Data() *Sps30Data {
+	s := d.Sps30
+	return &s
 }
 
-type OperaData struct {
-	UnixSec        uint32
-	PortentaSerial string
+// Inverse of Populate for the M4 part, used when replaying archives.
+func (d *SecondaryData) M4SensorMeasurement() *M4SensorMeasurement {
+	return &M4SensorMeasurement{
+		UnixSec:         d.UnixSec,
+		Pressure:        d.Pressure,
+		TempHtu:         d.OmbTemperatureHtu,
+		TempScd:         d.OmbTemperatureScd,
+		HumHtu:          d.OmbHumidityHtu,
+		HumScd:          d.OmbHumidityScd,
+		Co2:             d.Co2,
+		VocIndex:        d.VocIndex,
+		OpticalTemp0:    d.OpticalTemperatures[0],
+		OpticalTemp1:    d.OpticalTemperatures[1],
+		OpticalTemp2:    d.OpticalTemperatures[2],
+		Monitor5VMean:   d.Monitor5vMean,
+		Monitor5VStdDev: d.Monitor5vStdDev,
+	}
+}
 
-	Concentrations MlConcentrationOutputData
-	ClassLabel     string
-	ClassLabels    []string
-	ClassProbs     []float32
+type PrimaryData struct {
+	PortentaSerial string        `json:"portenta_serial"`
+	TeensyData     NewTeensyData `json:"teensy_data"`
+}
 
-	Temp       float32
-	RH         float32
-	Sps30Pm2p5 float32
-	Pressure   float32
-	Co2        uint32
-	VocIndex   int32
+type OperaData struct {
+	UnixSec        uint32 `json:"unix_sec"`
+	PortentaSerial string `json:"portenta_serial"`
+
+	Concentrations MlConcentrationOutputData `json:"concentrations"`
+	ClassLabel     string                    `json:"class_label"`
+	ClassLabels    []string                  `json:"class_labels"`
+	ClassProbs     []float32                 `json:"class_probs"`
+
+	Temp       float32 `json:"temp"`
+	RH         float32 `json:"rh"`
+	Sps30Pm2p5 float32 `json:"sps30_pm2p5"`
+	Pressure   float32 `json:"pressure"`
+	Co2        uint32  `json:"co2"`
+	VocIndex   int32   `json:"voc"`
 }
 
 func (d *OperaData) Populate(portentaSerial string, m *M4SensorMeasurement, s *Sps30Data, ml *MlPrimaryDataOutput, tr *MlTempHumOutputData) {
@@ -130,17 +167,26 @@ func (d *OperaData) Populate(portentaSerial string, m *M4SensorMeasurement, s *S
 type OutputData interface {
 	CsvFileWriteJob(string) []CsvFileWriteJob
 	BinaryFileWriteJob(string) []BinaryFileWriteJob
+	JsonlFileWriteJob(string) []JsonlFileWriteJob
 	Pack(io.Writer)
 	Unpack(io.Reader) error
 }
 
 const ML_CONCENTRATION_CSV_HEADER = "PM0_3,PM1,PM2_5,PM10,PN0_1,PN0_2,PN0_3,PN0_4,PN0_5,PN0_6,PN0_7,PN0_85,PN1,PN2_5,PN5,PN10"
 
+var mlConcentrationCsvColumns = strings.Split(ML_CONCENTRATION_CSV_HEADER, ",")
+
 func (d MlConcentrationOutputData) CsvString() string {
-	return fmt.Sprintf("%.5f,%.5f,%.5f,%.5f,%.5f,%.5f,%.5f,%.5f,%.5f,%.5f,%.5f,%.5f,%.5f,%.5f,%.5f,%.5f",
-		d.PM0p3, d.PM1, d.PM2p5, d.PM10,
-		d.PN0p1, d.PN0p2, d.PN0p3, d.PN0p4, d.PN0p5, d.PN0p6, d.PN0p7, d.PN0p85,
-		d.PN1, d.PN2p5, d.PN5, d.PN10)
+	return strings.Join(d.csvFields(GetCsvFormatPolicy()), ",")
+}
+
+// Returns the concentrations formatted as the ML_CONCENTRATION_CSV_HEADER columns.
+func (d MlConcentrationOutputData) csvFields(f CsvFormatPolicy) []string {
+	ret := make([]string, len(mlConcentrationCsvColumns))
+	for i, pFloat := range (&d).Iterate() {
+		ret[i] = f.float(mlConcentrationCsvColumns[i], *pFloat)
+	}
+	return ret
 }
 
 func (d *MlConcentrationOutputData) Iterate() []*float32 {
@@ -166,60 +212,124 @@ func (d *MlConcentrationOutputData) Unpack(r io.Reader) error {
 }
 
 /* CSV File Write Job */
+
 func (d *SecondaryData) CsvFileWriteJob(portentaSerial string) []CsvFileWriteJob {
 	return []CsvFileWriteJob{{
-		Filename: generateFileName(portentaSerial, "SecondaryRaw", d.UnixSec, true),
-		Headers:  "unix,portenta,sps30_pm1,sps30_pm2p5,sps30_pm4,sps30_pm10,sps30_pn0p5,sps30_pn1,sps30_pn2p5,sps30_pn4,sps30_pn10,sps30_tps,pressure,co2,voc_index,flow_temp,flow_hum,flow_rate,imx8_temp,teensy_temp,optical_temp0,optical_temp1,optical_temp2,omb_temp_htu,omb_hum_htu,omb_temp_scd,omg_hum_scd,mean_5v_monitor,std_dev_5v_monitor",
-		Content: fmt.Sprintf("%d,%s,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%d,%d,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%.4f,%.4f",
-			d.UnixSec, d.PortentaSerial, d.Sps30.Pm1, d.Sps30.Pm2p5, d.Sps30.Pm4, d.Sps30.Pm10, d.Sps30.Pn0p5, d.Sps30.Pn1, d.Sps30.Pn2p5, d.Sps30.Pn4, d.Sps30.Pn10, d.Sps30.TypicalParticleSize, d.Pressure, d.Co2, d.VocIndex, d.FlowTemperature, d.FlowHumidity, d.FlowRate, d.PortentaImx8Temp, d.TeensyMcuTemp, d.OpticalTemperatures[0], d.OpticalTemperatures[1], d.OpticalTemperatures[2], d.OmbTemperatureHtu, d.OmbHumidityHtu, d.OmbTemperatureScd, d.OmbHumidityScd, d.Monitor5vMean, d.Monitor5vStdDev),
+		Filename: generateFileName(portentaSerial, DATA_LABEL_SECONDARY_RAW, d.UnixSec, true),
+		Headers:  SecondaryRawSchema.Header(),
+		Content:  SecondaryRawSchema.record(d, GetCsvFormatPolicy()),
 	}}
 }
 
 func (d *OperaData) CsvFileWriteJob(portentaSerial string) []CsvFileWriteJob {
+	f := GetCsvFormatPolicy()
+	schema := OutputSchema
+	if f.ClassProbs == CLASS_PROBS_WIDE {
+		schema = wideOutputSchema(wideClassLabels(f, d.ClassLabels))
+	}
 	return []CsvFileWriteJob{{
-		Filename: generateFileName(portentaSerial, "Output", d.UnixSec, true),
-		Headers:  "unix,portenta," + ML_CONCENTRATION_CSV_HEADER + ",class_label,class_labels,class_probs,temp,rh,sps30_pm2p5,pressure,co2,voc_index",
-		Content: fmt.Sprintf("%d,%s,%s,%s,\"%s\",\"%.1f\",%.1f,%.1f,%.1f,%.1f,%d,%d",
-			d.UnixSec, d.PortentaSerial, d.Concentrations.CsvString(), d.ClassLabel, d.ClassLabels, d.ClassProbs, d.Temp, d.RH, d.Sps30Pm2p5, d.Pressure, d.Co2, d.VocIndex),
+		Filename: generateFileName(portentaSerial, DATA_LABEL_OUTPUT, d.UnixSec, true),
+		Headers:  schema.Header(),
+		Content:  schema.record(d, f),
 	}}
 }
 
 func (p NewPulse) String() string {
-	indicesStr := fmt.Sprintf("%d", p.Indices[0])
-	for _, ind := range p.Indices[1:] {
-		indicesStr += fmt.Sprintf(",%d", ind)
+	return string(p.appendString(nil))
+}
+
+func (p NewPulse) appendString(b []byte) []byte {
+	b = append(b, '(')
+	b = strconv.AppendUint(b, uint64(p.RawPeak), 10)
+	b = append(b, ',')
+	b = strconv.AppendUint(b, uint64(p.SidePeak), 10)
+	b = append(b, ",["...)
+	for i, ind := range p.Indices {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendUint(b, uint64(ind), 10)
 	}
-	return fmt.Sprintf("(%d,%d,[%s])", p.RawPeak, p.SidePeak, indicesStr)
+	return append(b, "])"...)
+}
+
+// Returns the pulses column of a PrimaryRaw CSV row: [(raw,side,[i0,...,i7]),...],
+// or "" without pulses. See PulsesCsvFileWriteJob for one row per pulse.
+func pulsesCsvString(pulses []NewPulse) string {
+	if len(pulses) == 0 {
+		return ""
+	}
+	b := make([]byte, 0, 48*len(pulses))
+	b = append(b, '[')
+	for i, p := range pulses {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = p.appendString(b)
+	}
+	return string(append(b, ']'))
 }
 
 func (d *PrimaryData) CsvFileWriteJob(portentaSerial string) []CsvFileWriteJob {
+	f := GetCsvFormatPolicy()
 	ret := []CsvFileWriteJob{}
-	filename := generateFileName(portentaSerial, "PrimaryRaw", d.TeensyData.UnixSec, true)
+	filename := generateFileName(portentaSerial, DATA_LABEL_PRIMARY_RAW, d.TeensyData.UnixSec, true)
 	for _, c := range d.TeensyData.Counts {
-		var pulsesStr = ""
-		if n := len(c.Pulses); n > 0 {
-			pulsesStr += "\"[" + c.Pulses[0].String()
-			if n > 1 {
-				for _, p := range c.Pulses[1:] {
-					pulsesStr += "," + p.String()
-				}
-			}
-			pulsesStr += "]\""
-		}
-
 		ret = append(ret, CsvFileWriteJob{
 			Filename: filename,
-			Headers: "unix,ms,portenta,hv_enabled,hv_set,hv_read,pd0,pd1,laser,raw_scalar0,raw_scalar1,diff_scalar0,diff_scalar1," +
-				"baseline0,baseline1,raw_upper_th0,raw_upper_th1,diff_upper_th0,diff_upper_th1,ms_read,num_buff,max_laser_on,num_pulse,pulses_per_second,pulses",
-			Content: fmt.Sprintf("%d,%d,%s,%v,%d,%d,%d,%d,%d,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%.1f,%.3f,%.3f,%d,%d,%d,%d,%.2f,%s",
-				d.TeensyData.UnixSec, d.TeensyData.MilliSec, d.PortentaSerial, d.TeensyData.HvEnabled, d.TeensyData.HvSet, d.TeensyData.HvMonitor, c.PinPd0, c.PinPd1, c.PinLaser,
-				c.RawScalar0, c.RawScalar1, c.DiffedScalar0, c.DiffedScalar1, c.Baseline0, c.Baseline1, c.RawUpperTh0, c.RawUpperTh1, c.DiffedUpperTh0, c.DiffedUpperTh1,
-				c.MsRead, c.BuffersRead, c.MaxLaserOn, c.NumPulses, c.PulsesPerSecond, pulsesStr),
+			Headers:  PrimaryRawSchema.Header(),
+			Content:  PrimaryRawSchema.record(&PrimaryRawRow{Data: d, Counts: c}, f),
 		})
 	}
 	return ret
 }
 
+// Returns every pulse of d as one row of a Pulses CSV file, in a single job, or
+// no job if d has no pulses.
+func (d *PrimaryData) PulsesCsvFileWriteJob(portentaSerial string) []CsvRowsFileWriteJob {
+	f := GetCsvFormatPolicy()
+	job := CsvRowsFileWriteJob{
+		Filename: generateFileName(portentaSerial, DATA_LABEL_PULSES, d.TeensyData.UnixSec, true),
+		Headers:  PulsesSchema.Header(),
+	}
+	for _, c := range d.TeensyData.Counts {
+		for i := range c.Pulses {
+			job.Rows = append(job.Rows, PulsesSchema.record(&PulseRow{Data: d, Counts: c, Pulse: &c.Pulses[i]}, f))
+		}
+	}
+	if len(job.Rows) == 0 {
+		return nil
+	}
+	return []CsvRowsFileWriteJob{job}
+}
+
+/* JSONL File Write Job */
+
+// Lines are keyed by the json tags of the data, nested as the structs are. NaN
+// values are left out as by RemoveNaN, but written as null inside lists.
+
+func (d *SecondaryData) JsonlFileWriteJob(portentaSerial string) []JsonlFileWriteJob {
+	return []JsonlFileWriteJob{{
+		Filename: generateFileNameWithExtension(portentaSerial, DATA_LABEL_SECONDARY_RAW, d.UnixSec, JSONL_FILE_EXTENSION),
+		Lines:    []string{jsonObject(d)},
+	}}
+}
+
+func (d *OperaData) JsonlFileWriteJob(portentaSerial string) []JsonlFileWriteJob {
+	return []JsonlFileWriteJob{{
+		Filename: generateFileNameWithExtension(portentaSerial, DATA_LABEL_OUTPUT, d.UnixSec, JSONL_FILE_EXTENSION),
+		Lines:    []string{jsonObject(d)},
+	}}
+}
+
+// One line per reading, its counts in a "counts" list.
+func (d *PrimaryData) JsonlFileWriteJob(portentaSerial string) []JsonlFileWriteJob {
+	return []JsonlFileWriteJob{{
+		Filename: generateFileNameWithExtension(portentaSerial, DATA_LABEL_PRIMARY_RAW, d.TeensyData.UnixSec, JSONL_FILE_EXTENSION),
+		Lines:    []string{jsonObject(d)},
+	}}
+}
+
 /* Binary File Write Job */
 
 func (d *SecondaryData) Pack(w io.Writer) {
@@ -254,7 +364,9 @@ func (d *SecondaryData) Unpack(r io.Reader) error {
 	if err != nil {
 		return err
 	}
-	d.Sps30.Unpack(r)
+	if err := d.Sps30.Unpack(r); err != nil {
+		return err
+	}
 	if err := binary.Read(r, binary.LittleEndian, &d.Pressure); err != nil {
 		return err
 	}
@@ -311,7 +423,7 @@ func (d *SecondaryData) BinaryFileWriteJob(portentaSerial string) []BinaryFileWr
 	buf.Write([]byte{OUTPUT_FILE_RAW_TYPE_INDICATOR_SECONDARY})
 	d.Pack(&buf)
 	return []BinaryFileWriteJob{{
-		Filename: generateFileName(portentaSerial, "SecondaryRaw", d.UnixSec, false),
+		Filename: generateFileName(portentaSerial, DATA_LABEL_SECONDARY_RAW, d.UnixSec, false),
 		Content:  buf.Bytes(),
 	}}
 }
@@ -395,7 +507,7 @@ func (d *OperaData) BinaryFileWriteJob(portentaSerial string) []BinaryFileWriteJ
 	buf.Write([]byte{OUTPUT_FILE_RAW_TYPE_INDICATOR_OPERA_OUTPUT})
 	d.Pack(&buf)
 	return []BinaryFileWriteJob{{
-		Filename: generateFileName(portentaSerial, "Output", d.UnixSec, false),
+		Filename: generateFileName(portentaSerial, DATA_LABEL_OUTPUT, d.UnixSec, false),
 		Content:  buf.Bytes(),
 	}}
 }
@@ -572,7 +684,6 @@ func (d *PrimaryData) Unpack(r io.Reader) error {
 			return err
 		}
 
-		println("HERE")
 		if err := binary.Read(r, binary.LittleEndian, &c.PulsesPerSecond); err != nil {
 			return err
 		}
@@ -599,7 +710,7 @@ func (d *PrimaryData) BinaryFileWriteJob(portentaSerial string) []BinaryFileWrit
 	buf.Write([]byte{OUTPUT_FILE_RAW_TYPE_INDICATOR_PRIMARY})
 	d.Pack(&buf)
 	return []BinaryFileWriteJob{{
-		Filename: generateFileName(portentaSerial, "PrimaryRaw", d.TeensyData.UnixSec, false),
+		Filename: generateFileName(portentaSerial, DATA_LABEL_PRIMARY_RAW, d.TeensyData.UnixSec, false),
 		Content:  buf.Bytes(),
 	}}
 }
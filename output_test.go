@@ -2,7 +2,13 @@ package operadatatypes
 
 import (
 	"bytes"
+	"encoding/gob"
+	"encoding/json"
 	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -460,3 +466,79 @@ func TestOperaToBinaryWriteJob(t *testing.T) {
 		t.Errorf("writeJob content (after first rune) does not match the results of .Pack()")
 	}
 }
+
+func TestJsonlFileWriteJob(t *testing.T) {
+	root := t.TempDir()
+	catalog, err := OpenCatalog(root)
+	if err != nil {
+		t.Errorf("OpenCatalog(): %v", err)
+		return
+	}
+	sink := NewFileSink(root, 0)
+	sink.Catalog = catalog
+
+	primary := &PrimaryData{PortentaSerial: "abc", TeensyData: NewTeensyData{UnixSec: 101, Counts: []*NewTeensyCounts{
+		{PinLaser: 1, Baseline0: float32(math.NaN()), Pulses: []NewPulse{{RawPeak: 25, Indices: [8]uint16{1, 2, 3, 4, 5, 6, 7, 8}}}},
+		{PinLaser: 2},
+	}}}
+	secondary := &SecondaryData{UnixSec: 100, PortentaSerial: "abc", Co2: 410, FlowRate: float32(math.NaN())}
+	for _, d := range []OutputData{secondary, primary, &OperaData{UnixSec: 102, ClassProbs: []float32{float32(math.NaN())}}} {
+		for _, job := range d.JsonlFileWriteJob("abc") {
+			if !strings.HasSuffix(job.Filename, JSONL_FILE_EXTENSION) {
+				t.Errorf("jsonl job for %T has file name %s", d, job.Filename)
+			}
+			if err := sink.Write(job); err != nil {
+				t.Errorf("sink.Write(): %v", err)
+			}
+		}
+	}
+	sink.Close()
+
+	/* Each line is valid JSON without the NaN values */
+	read := func(label string) map[string]any {
+		b, err := os.ReadFile(filepath.Join(root, generateFileNameWithExtension("abc", label, 100, JSONL_FILE_EXTENSION)))
+		if err != nil {
+			t.Errorf("failed to read %s jsonl: %v", label, err)
+			return nil
+		}
+		values := map[string]any{}
+		if err := json.Unmarshal(b, &values); err != nil || !strings.HasSuffix(string(b), "}\n") {
+			t.Errorf("%s jsonl %q is not one json line: %v", label, b, err)
+		}
+		return values
+	}
+	if values := read(DATA_LABEL_SECONDARY_RAW); values != nil {
+		if _, ok := values["flow_rate"]; ok || values["co2"] != 410.0 || values["portenta_serial"] != "abc" {
+			t.Errorf("secondary jsonl holds %v", values)
+		}
+	}
+	if values := read(DATA_LABEL_PRIMARY_RAW); values != nil {
+		teensy, _ := values["teensy_data"].(map[string]any)
+		counts, _ := teensy["counts"].([]any)
+		first, _ := counts[0].(map[string]any)
+		pulses, _ := first["pulses"].([]any)
+		if _, ok := first["baseline0"]; len(counts) != 2 || ok || len(pulses) != 1 || pulses[0].(map[string]any)["raw_peak"] != 25.0 || teensy["unix_sec"] != 101.0 {
+			t.Errorf("primary jsonl holds %v", values)
+		}
+	}
+	if values := read(DATA_LABEL_OUTPUT); values != nil {
+		if probs, _ := values["class_probs"].([]any); len(probs) != 1 || probs[0] != nil {
+			t.Errorf("output jsonl holds %v", values)
+		}
+	}
+	if e, ok := catalog.Get(generateFileNameWithExtension("abc", DATA_LABEL_PRIMARY_RAW, 100, JSONL_FILE_EXTENSION)); !ok || e.Records != 1 || e.FirstUnix != 101 {
+		t.Errorf("catalog entry for the primary jsonl is %+v", e)
+	}
+
+	/* Jobs travel over the gob protocol */
+	var buf bytes.Buffer
+	job := secondary.JsonlFileWriteJob("abc")[0]
+	encoder := gob.NewEncoder(&buf)
+	encoder.Encode(DATA_TYPE_JSONL)
+	encoder.Encode(job)
+	if d, err := ReceiveStructGob(&buf); err != nil {
+		t.Errorf("ReceiveStructGob(): %v", err)
+	} else if received, ok := d.(*JsonlFileWriteJob); !ok || received.Filename != job.Filename || len(received.Lines) != 1 || received.Lines[0] != job.Lines[0] {
+		t.Errorf("received %v, expected %v", d, job)
+	}
+}
@@ -0,0 +1,264 @@
+package operadatatypes
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	RETENTION_ACTION_DELETE   = "delete"
+	RETENTION_ACTION_COMPRESS = "compress"
+
+	COMPRESSED_FILE_EXTENSION = ".gz"
+)
+
+// When and how to free space under the data root. Once free space drops below
+// MinFreeBytes, files are handled oldest first, one data label at a time in
+// Order, until TargetFreeBytes are free.
+type RetentionPolicy struct {
+	MinFreeBytes    int64             `json:"min_free_bytes"`
+	TargetFreeBytes int64             `json:"target_free_bytes"`
+	Order           []string          `json:"order"`
+	Actions         map[string]string `json:"actions"` // Data label to RETENTION_ACTION_*
+	MinAgeSec       int64             `json:"min_age_sec"`
+	KeepUnexported  bool              `json:"keep_unexported"`
+}
+
+func GetDefaultRetentionPolicy() RetentionPolicy {
+	return RetentionPolicy{
+		MinFreeBytes:    256 << 20,
+		TargetFreeBytes: 512 << 20,
+		Order:           []string{DATA_LABEL_PULSES, DATA_LABEL_PRIMARY_RAW, DATA_LABEL_SECONDARY_RAW, DATA_LABEL_OUTPUT},
+		Actions: map[string]string{
+			DATA_LABEL_PULSES:        RETENTION_ACTION_DELETE,
+			DATA_LABEL_PRIMARY_RAW:   RETENTION_ACTION_DELETE,
+			DATA_LABEL_SECONDARY_RAW: RETENTION_ACTION_DELETE,
+			DATA_LABEL_OUTPUT:        RETENTION_ACTION_DELETE,
+		},
+		MinAgeSec:      60 * 60,
+		KeepUnexported: true,
+	}
+}
+
+type RetentionEvent struct {
+	Time       time.Time
+	Action     string
+	Path       string
+	BytesFreed int64
+	FreeBytes  int64
+}
+
+func (e RetentionEvent) String() string {
+	return fmt.Sprintf("[Retention| %s %s | %d Bytes freed, %d Bytes free]", e.Action, e.Path, e.BytesFreed, e.FreeBytes)
+}
+
+type RetentionManager struct {
+	Root   string
+	Policy RetentionPolicy
+
+	// Files are never deleted while this returns false for them, if
+	// Policy.KeepUnexported is set. Without it or a Catalog nothing is deleted.
+	IsExported func(path string) bool
+	// Files the sink still has open are left alone, if set.
+	Sink *FileSink
+	// Lists the files to consider instead of walking Root, and is updated with
+	// each action, if set. Its export status is used if IsExported is nil.
+	Catalog *Catalog
+
+	OnAction  func(RetentionEvent)
+	FreeSpace func(root string) (int64, error)
+}
+
+func NewRetentionManager(root string, policy RetentionPolicy) *RetentionManager {
+	return &RetentionManager{
+		Root:      root,
+		Policy:    policy,
+		FreeSpace: diskFreeBytes,
+	}
+}
+
+type retentionCandidate struct {
+	path string
+	info FileNameInfo
+	size int64
+}
+
+// Returns OPERA data files of a data label under Root, oldest first.
+func (m *RetentionManager) candidates(dataLabel string) ([]retentionCandidate, error) {
+	ret := []retentionCandidate{}
+	minAge := time.Duration(m.Policy.MinAgeSec) * time.Second
+	consider := func(path string) {
+		info, err := ParseFileName(path)
+		if err != nil || info.DataLabel != dataLabel {
+			return
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			return // Removed since listing
+		}
+		if time.Since(stat.ModTime()) < minAge {
+			return
+		}
+		if m.Sink != nil {
+			if rel, err := filepath.Rel(m.Root, path); err == nil && m.Sink.IsOpen(rel) {
+				return
+			}
+		}
+		ret = append(ret, retentionCandidate{path: path, info: info, size: stat.Size()})
+	}
+
+	var err error
+	if m.Catalog != nil {
+		for _, e := range m.Catalog.Query(CatalogQuery{DataLabel: dataLabel}) {
+			consider(filepath.Join(m.Root, e.Filename))
+		}
+	} else {
+		err = filepath.WalkDir(m.Root, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			consider(path)
+			return nil
+		})
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		a, b := ret[i].info, ret[j].info
+		if !a.Start.Equal(b.Start) {
+			return a.Start.Before(b.Start)
+		}
+		if a.Part != b.Part {
+			return a.Part < b.Part
+		}
+		return a.Version < b.Version
+	})
+	return ret, err
+}
+
+func (m *RetentionManager) isExported(path string) bool {
+	if m.IsExported != nil {
+		return m.IsExported(path)
+	}
+	if m.Catalog != nil {
+		e, ok := m.Catalog.Get(m.rel(path))
+		return ok && e.Exported()
+	}
+	return false
+}
+
+func (m *RetentionManager) rel(path string) string {
+	if rel, err := filepath.Rel(m.Root, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+// Frees space if it is below the policy's minimum. Returns an error if space
+// is still short once every allowed action has been taken.
+func (m *RetentionManager) Check() error {
+	free, err := m.FreeSpace(m.Root)
+	if err != nil {
+		return fmt.Errorf("failed to get free space under '%s': %v", m.Root, err)
+	}
+	if free >= m.Policy.MinFreeBytes {
+		return nil
+	}
+
+	for _, label := range m.Policy.Order {
+		action := m.Policy.Actions[label]
+		files, err := m.candidates(label)
+		if err != nil {
+			return fmt.Errorf("failed to list %s files: %v", label, err)
+		}
+		for _, c := range files {
+			var freed int64
+			switch action {
+			case RETENTION_ACTION_DELETE:
+				if m.Policy.KeepUnexported && !m.isExported(c.path) {
+					continue
+				}
+				remove := func() error {
+					if stat, err := os.Stat(c.path); err != nil || stat.Size() != c.size {
+						return errFileChanged
+					}
+					if err := os.Remove(c.path); err != nil {
+						return fmt.Errorf("failed to delete '%s': %v", c.path, err)
+					}
+					return nil
+				}
+				if m.Sink != nil {
+					err = m.Sink.whileClosed(m.rel(c.path), remove)
+				} else {
+					err = remove()
+				}
+				if errors.Is(err, errFileChanged) {
+					continue // Written to since it was listed, kept for now
+				} else if err != nil {
+					return err
+				}
+				freed = c.size
+				if m.Catalog != nil {
+					m.Catalog.recordRemoved(m.rel(c.path))
+					if err := m.Catalog.Save(); err != nil {
+						return err
+					}
+				}
+			case RETENTION_ACTION_COMPRESS:
+				if c.info.Compressed {
+					continue
+				}
+				finish := func(fn func() error) error { return fn() }
+				if m.Sink != nil {
+					finish = func(fn func() error) error { return m.Sink.whileClosed(m.rel(c.path), fn) }
+				}
+				compressedSize, err := gzipFile(c.path, finish)
+				if errors.Is(err, errFileChanged) {
+					continue
+				} else if err != nil {
+					return err
+				}
+				freed = c.size - compressedSize
+				if m.Catalog != nil {
+					if err := catalogCompressed(m.Catalog, m.rel(c.path), c.path); err != nil {
+						return err
+					}
+				}
+			default:
+				continue
+			}
+
+			if free, err = m.FreeSpace(m.Root); err != nil {
+				return fmt.Errorf("failed to get free space under '%s': %v", m.Root, err)
+			}
+			if m.OnAction != nil {
+				m.OnAction(RetentionEvent{Time: time.Now(), Action: action, Path: c.path, BytesFreed: freed, FreeBytes: free})
+			}
+			if free >= m.Policy.TargetFreeBytes {
+				return nil
+			}
+		}
+	}
+	if free < m.Policy.MinFreeBytes {
+		return fmt.Errorf("only %d bytes free under '%s' and no more files may be removed", free, m.Root)
+	}
+	return nil
+}
+
+// Calls Check every interval until stop is closed. Errors go to onError.
+func (m *RetentionManager) Run(interval time.Duration, stop <-chan struct{}, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := m.Check(); err != nil && onError != nil {
+			onError(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
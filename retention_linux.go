@@ -0,0 +1,11 @@
+package operadatatypes
+
+import "syscall"
+
+func diskFreeBytes(root string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(root, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
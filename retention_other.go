@@ -0,0 +1,9 @@
+//go:build !linux
+
+package operadatatypes
+
+import "fmt"
+
+func diskFreeBytes(root string) (int64, error) {
+	return 0, fmt.Errorf("free space is only available on linux")
+}
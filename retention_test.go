@@ -0,0 +1,105 @@
+package operadatatypes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetentionManagerOrder(t *testing.T) {
+	root := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{
+		"OPERA_abc_Output_20261016.csv",
+		"OPERA_abc_PrimaryRaw_20261017.raw",
+		"OPERA_abc_PrimaryRaw_20261016.raw",
+		"OPERA_abc_SecondaryRaw_20261016.csv",
+		"notes.txt",
+	} {
+		path := filepath.Join(root, name)
+		if err := os.WriteFile(path, make([]byte, 100), 0644); err != nil {
+			t.Errorf("failed to write test file: %v", err)
+			return
+		}
+		os.Chtimes(path, old, old)
+	}
+
+	policy := GetDefaultRetentionPolicy()
+	policy.MinFreeBytes, policy.TargetFreeBytes = 1000, 2000
+	policy.Actions[DATA_LABEL_SECONDARY_RAW] = RETENTION_ACTION_COMPRESS
+	m := NewRetentionManager(root, policy)
+	free := int64(1000 - 1)
+	m.FreeSpace = func(string) (int64, error) { return free, nil }
+	m.IsExported = func(path string) bool { return filepath.Base(path) != "OPERA_abc_PrimaryRaw_20261017.raw" }
+	events := []RetentionEvent{}
+	m.OnAction = func(e RetentionEvent) {
+		free += e.BytesFreed
+		events = append(events, e)
+	}
+
+	if err := m.Check(); err != nil {
+		t.Errorf("m.Check(): %v", err)
+		return
+	}
+
+	expected := []struct{ action, name string }{
+		{RETENTION_ACTION_DELETE, "OPERA_abc_PrimaryRaw_20261016.raw"},
+		{RETENTION_ACTION_COMPRESS, "OPERA_abc_SecondaryRaw_20261016.csv"},
+		{RETENTION_ACTION_DELETE, "OPERA_abc_Output_20261016.csv"},
+	}
+	if len(events) != len(expected) {
+		t.Errorf("got %d retention events, expected %d: %v", len(events), len(expected), events)
+		return
+	}
+	for i, e := range expected {
+		if events[i].Action != e.action || filepath.Base(events[i].Path) != e.name {
+			t.Errorf("event #%d was %v, expected %s of %s", i, events[i], e.action, e.name)
+		}
+	}
+	for _, name := range []string{"OPERA_abc_PrimaryRaw_20261017.raw", "OPERA_abc_SecondaryRaw_20261016.csv.gz", "notes.txt"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Errorf("expected %s to be kept: %v", name, err)
+		}
+	}
+}
+
+func TestRetentionManagerKeepsReopenedFile(t *testing.T) {
+	root := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	names := []string{"OPERA_abc_Output_20261015.csv", "OPERA_abc_Output_20261016.csv"}
+	for _, name := range names {
+		path := filepath.Join(root, name)
+		if err := os.WriteFile(path, []byte("unix,x\n1,a\n"), 0644); err != nil {
+			t.Errorf("failed to write test file: %v", err)
+			return
+		}
+		os.Chtimes(path, old, old)
+	}
+
+	sink := NewFileSink(root, 0)
+	defer sink.Close()
+	policy := GetDefaultRetentionPolicy()
+	policy.MinFreeBytes, policy.TargetFreeBytes = 1000, 2000
+	policy.KeepUnexported = false
+	m := NewRetentionManager(root, policy)
+	m.Sink = sink
+	m.FreeSpace = func(string) (int64, error) { return 0, nil }
+
+	/* A late row reopens the second file after it was listed for deletion */
+	m.OnAction = func(e RetentionEvent) {
+		if err := sink.Write(CsvFileWriteJob{Filename: names[1], Headers: "unix,x", Content: "2,b"}); err != nil {
+			t.Errorf("sink.Write(): %v", err)
+		}
+	}
+	if err := m.Check(); err == nil {
+		t.Errorf("expected m.Check() to report the space still short")
+	}
+	if _, err := os.Stat(filepath.Join(root, names[0])); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be deleted: %v", names[0], err)
+	}
+	sink.Flush()
+	if content, _ := os.ReadFile(filepath.Join(root, names[1])); string(content) != "unix,x\n1,a\n2,b\n" {
+		t.Errorf("reopened file holds '%s'", content)
+	}
+}
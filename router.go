@@ -0,0 +1,439 @@
+package operadatatypes
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DEFAULT_SINK_ROUTER_RETRY_INTERVAL = 10 * time.Second
+
+// A place the SinkRouter writes every job to, e.g. the SD card or USB stick.
+type SinkDestination struct {
+	Name string
+	Sink *FileSink
+
+	// Reports whether the destination can be written, e.g. that the USB stick
+	// is mounted. Always present if nil.
+	Present func() bool
+}
+
+type SinkHealth struct {
+	Name                string
+	Healthy             bool
+	ConsecutiveFailures int
+	LastError           error
+	LastErrorTime       time.Time
+	MissedFiles         int // Files waiting to be backfilled from another destination
+}
+
+func (h SinkHealth) String() string {
+	if h.Healthy {
+		return fmt.Sprintf("[Sink %s| healthy]", h.Name)
+	}
+	return fmt.Sprintf("[Sink %s| %d failures, %d files to backfill | %v]", h.Name, h.ConsecutiveFailures, h.MissedFiles, h.LastError)
+}
+
+// Writes each job to every destination. A destination that fails is skipped
+// until RetryInterval has passed; it is then first backfilled with whatever the
+// other destinations wrote meanwhile, so its files have no gaps, and only then
+// written to again. A job only fails if no destination took it.
+type SinkRouter struct {
+	RetryInterval time.Duration
+
+	// Called when a destination fails or recovers. Logs by default.
+	OnHealthChange func(SinkHealth)
+
+	mu    sync.Mutex
+	dests []*routerDest
+}
+
+type routerDest struct {
+	SinkDestination
+	health SinkHealth
+	missed map[string]*routerDest // File name to the destination to backfill it from, nil for any
+}
+
+func NewSinkRouter(destinations ...SinkDestination) *SinkRouter {
+	r := &SinkRouter{
+		RetryInterval: DEFAULT_SINK_ROUTER_RETRY_INTERVAL,
+		OnHealthChange: func(h SinkHealth) {
+			log.Println(h)
+		},
+	}
+	for _, d := range destinations {
+		dest := &routerDest{
+			SinkDestination: d,
+			health:          SinkHealth{Name: d.Name, Healthy: true},
+			missed:          map[string]*routerDest{},
+		}
+		r.dests = append(r.dests, dest)
+
+		/* Commits the sink makes on its own timer fail the destination too */
+		d.Sink.mu.Lock()
+		d.Sink.OnCommitError = func(err error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if dest.health.Healthy {
+				r.fail(dest, err)
+			}
+		}
+		d.Sink.mu.Unlock()
+	}
+	return r
+}
+
+func (r *SinkRouter) Health() []SinkHealth {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := make([]SinkHealth, len(r.dests))
+	for i, d := range r.dests {
+		ret[i] = d.health
+		ret[i].MissedFiles = len(d.missed)
+	}
+	return ret
+}
+
+func (r *SinkRouter) Write(job FileWriteJob) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	/* Backfill before the job reaches any destination, so it is not copied as well */
+	var lastErr error
+	retry := map[*routerDest]bool{}
+	for _, d := range r.dests {
+		if d.health.Healthy || time.Since(d.health.LastErrorTime) < r.RetryInterval {
+			continue
+		}
+		if err := r.backfill(d); err != nil {
+			r.fail(d, err)
+			lastErr = err
+			continue
+		}
+		retry[d] = true
+	}
+
+	var written *routerDest
+	for _, d := range r.dests {
+		if !d.health.Healthy && !retry[d] {
+			continue
+		}
+		if err := r.write(d, job); err != nil {
+			r.fail(d, err)
+			lastErr = err
+			continue
+		}
+		r.recover(d)
+		if written == nil {
+			written = d
+		}
+	}
+	if written == nil {
+		return fmt.Errorf("no destination could take the job: %v", lastErr)
+	}
+
+	filename := written.Sink.lastFileName()
+	for _, d := range r.dests {
+		if !d.health.Healthy {
+			if _, ok := d.missed[filename]; !ok {
+				d.missed[filename] = written
+			}
+		}
+	}
+	return nil
+}
+
+func (r *SinkRouter) write(d *routerDest, job FileWriteJob) error {
+	if d.Present != nil && !d.Present() {
+		return fmt.Errorf("destination %s is not present", d.Name)
+	}
+	return d.Sink.Write(job)
+}
+
+// Caller must hold mu.
+func (r *SinkRouter) fail(d *routerDest, err error) {
+	wasHealthy := d.health.Healthy
+	d.health.Healthy = false
+	d.health.ConsecutiveFailures++
+	d.health.LastError = err
+	d.health.LastErrorTime = time.Now()
+	for _, filename := range d.Sink.openFileNames() {
+		if _, ok := d.missed[filename]; !ok {
+			d.missed[filename] = nil // May have records pending that will be discarded
+		}
+	}
+	if wasHealthy && r.OnHealthChange != nil {
+		h := d.health
+		h.MissedFiles = len(d.missed)
+		r.OnHealthChange(h)
+	}
+}
+
+// Caller must hold mu.
+func (r *SinkRouter) recover(d *routerDest) {
+	if d.health.Healthy {
+		return
+	}
+	d.health = SinkHealth{Name: d.Name, Healthy: true}
+	if r.OnHealthChange != nil {
+		r.OnHealthChange(d.health)
+	}
+}
+
+// Copies what other destinations wrote to d's files while it was down. Caller
+// must hold mu.
+func (r *SinkRouter) backfill(d *routerDest) error {
+	if d.Present != nil && !d.Present() {
+		return fmt.Errorf("destination %s is not present", d.Name)
+	}
+	d.Sink.discard()
+	filenames := make([]string, 0, len(d.missed))
+	for filename := range d.missed {
+		filenames = append(filenames, filename)
+	}
+	sort.Slice(filenames, func(i, j int) bool { return fileNameLess(filenames[i], filenames[j]) })
+
+	for _, filename := range filenames {
+		src := d.missed[filename]
+		if src == nil {
+			if src = r.otherDest(d); src == nil {
+				delete(d.missed, filename)
+				continue
+			}
+		}
+		src.Sink.Flush() // Whatever did not reach src's disk is backfilled next time
+		if err := d.Sink.copyTail(filename, src.Sink); err != nil {
+			return fmt.Errorf("failed to backfill %s from %s: %v", d.Name, src.Name, err)
+		}
+		delete(d.missed, filename)
+	}
+	return nil
+}
+
+// Returns a healthy destination other than d, or nil. Caller must hold mu.
+func (r *SinkRouter) otherDest(d *routerDest) *routerDest {
+	for _, other := range r.dests {
+		if other != d && other.health.Healthy {
+			return other
+		}
+	}
+	return nil
+}
+
+// Retries every failed destination now, backfilling it first.
+func (r *SinkRouter) Backfill() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	for _, d := range r.dests {
+		if d.health.Healthy {
+			continue
+		}
+		if backfillErr := r.backfill(d); backfillErr != nil {
+			r.fail(d, backfillErr)
+			err = backfillErr
+			continue
+		}
+		r.recover(d)
+	}
+	return err
+}
+
+// Flushes every healthy destination. One that fails is marked unhealthy, as
+// on a failed Write.
+func (r *SinkRouter) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	for _, d := range r.dests {
+		if !d.health.Healthy {
+			continue
+		}
+		if flushErr := d.Sink.Flush(); flushErr != nil {
+			r.fail(d, flushErr)
+			err = flushErr
+		}
+	}
+	return err
+}
+
+func (r *SinkRouter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	for _, d := range r.dests {
+		if closeErr := d.Sink.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Message handler for ServeStructGob.
+func (r *SinkRouter) Handle(d interface{}) error {
+	job, ok := d.(FileWriteJob)
+	if !ok {
+		return fmt.Errorf("sink router received unexpected message: %T", d)
+	}
+	return r.Write(job)
+}
+
+// Writes jobs received on l until it is closed. Per-job errors go to onError.
+func (r *SinkRouter) Serve(l TransportListener, onError func(error)) error {
+	return ServeStructGob(l, r.Handle, onError)
+}
+
+// Closes every file without writing what is pending, so files are picked up
+// again from what is on disk. For a sink whose device went away.
+func (s *FileSink) discard() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		e.Value.(*sinkFile).f.Close()
+	}
+	s.files = map[string]*list.Element{}
+	s.lru.Init()
+	s.csvVersions = map[string]string{}
+	s.parts = map[string]int{}
+	s.pendingRecords = 0
+	if s.journal != nil {
+		clearJournal(s.journal)
+	}
+}
+
+func (s *FileSink) openFileNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]string, 0, len(s.files))
+	for filename := range s.files {
+		ret = append(ret, filename)
+	}
+	return ret
+}
+
+func (s *FileSink) lastFileName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastFile
+}
+
+// Appends the part of src's copy of filename beyond this sink's size, for
+// bringing a copy of another sink's file up to date.
+func (s *FileSink) copyTail(filename string, src *FileSink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size, err := s.fileSize(filename)
+	if err != nil {
+		return err
+	}
+	tail, err := src.openDataFrom(filename, size)
+	if err != nil || tail == nil {
+		return err
+	}
+	defer tail.Close()
+	srcPath := filepath.Join(src.Root, filename)
+	if _, err := tail.Peek(1); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read '%s': %v", srcPath, err)
+	}
+
+	/* Whatever is pending goes first, then the tail is streamed after it */
+	sf, _, err := s.open(filename)
+	if err != nil {
+		return err
+	}
+	if err := s.commit(); err != nil {
+		return err
+	}
+	n, err := io.Copy(sf.f, tail)
+	sf.written += n
+	if err != nil {
+		return fmt.Errorf("failed to copy '%s' to '%s': %v", srcPath, sf.path, err)
+	}
+	if s.durability.enabled() {
+		if err := sf.f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync '%s': %v", sf.path, err)
+		}
+	}
+	if s.Catalog != nil {
+		records, first, last, _ := summarizeDataFile(sf.path) // Keeps the records before any damage
+		s.Catalog.recordFile(filename, first, last, records, sf.written)
+		return s.Catalog.saveSoon()
+	}
+	return nil
+}
+
+type dataTail struct {
+	*bufio.Reader
+	files []io.Closer
+}
+
+func (t *dataTail) Close() error {
+	var err error
+	for _, f := range t.files {
+		err = errors.Join(err, f.Close())
+	}
+	return err
+}
+
+// Opens filename's data from offset on. Once filename has been compressed its
+// data is read from the .gz file, followed by any rows written to filename
+// since. Returns nil if the catalog shows the file was removed; a missing file
+// the catalog still lists, or any missing file without a catalog, is an error.
+func (s *FileSink) openDataFrom(filename string, offset int64) (*dataTail, error) {
+	path := filepath.Join(s.Root, filename)
+	t := &dataTail{}
+	readers := []io.Reader{}
+	if _, err := os.Stat(path + COMPRESSED_FILE_EXTENSION); err == nil {
+		gz, err := OpenDataFile(path + COMPRESSED_FILE_EXTENSION)
+		if err != nil {
+			return nil, err
+		}
+		t.files = append(t.files, gz)
+		readers = append(readers, gz)
+	}
+	if f, err := os.Open(path); err == nil {
+		t.files = append(t.files, f)
+		readers = append(readers, f)
+		if len(readers) > 1 { // Continues the compressed file, whose header it repeats
+			skip, err := repeatedHeaderLen(path)
+			if err == nil {
+				_, err = f.Seek(skip, io.SeekStart)
+			}
+			if err != nil {
+				t.Close()
+				return nil, fmt.Errorf("failed to skip the header of '%s': %v", path, err)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		t.Close()
+		return nil, fmt.Errorf("failed to open file, '%s': %v", path, err)
+	}
+
+	if len(readers) == 0 {
+		if s.Catalog != nil {
+			_, plain := s.Catalog.Get(filename)
+			_, compressed := s.Catalog.Get(filename + COMPRESSED_FILE_EXTENSION)
+			if !plain && !compressed {
+				return nil, nil // Removed by retention since, nothing to copy
+			}
+		}
+		return nil, fmt.Errorf("failed to open file, '%s': neither it nor its compressed file exists", path)
+	}
+	t.Reader = bufio.NewReader(io.MultiReader(readers...))
+	if _, err := t.Discard(int(offset)); err != nil && err != io.EOF {
+		t.Close()
+		return nil, fmt.Errorf("failed to skip to byte %d of '%s': %v", offset, path, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,170 @@
+package operadatatypes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSinkRouterFailover(t *testing.T) {
+	sdRoot, usbRoot := t.TempDir(), t.TempDir()
+	sd, usb := NewFileSink(sdRoot, 0), NewFileSink(usbRoot, 0)
+	usb.Catalog, _ = OpenCatalog(usbRoot)
+	usbPresent := true
+	router := NewSinkRouter(
+		SinkDestination{Name: "sd", Sink: sd},
+		SinkDestination{Name: "usb", Sink: usb, Present: func() bool { return usbPresent }},
+	)
+	router.RetryInterval = 0
+	changes := []SinkHealth{}
+	router.OnHealthChange = func(h SinkHealth) { changes = append(changes, h) }
+
+	write := func(filename, row string) {
+		if err := router.Write(CsvFileWriteJob{Filename: filename, Headers: "unix,x", Content: row}); err != nil {
+			t.Errorf("router.Write(%s): %v", row, err)
+		}
+	}
+	csvName, otherName := "OPERA_abc_Output_20261018.csv", "OPERA_abc_SecondaryRaw_20261018.csv"
+	write(csvName, "1,a")
+	write(csvName, "2,b")
+
+	/* USB pulled: rows only reach the SD card */
+	usbPresent = false
+	write(csvName, "3,c")
+	write(otherName, "3,z")
+	if h := router.Health(); h[0].Healthy != true || h[1].Healthy != false || h[1].MissedFiles != 2 {
+		t.Errorf("unexpected health while usb is out: %v", h)
+	}
+
+	/* USB back: backfilled before the next row */
+	usbPresent = true
+	write(csvName, "4,d")
+	if err := router.Close(); err != nil {
+		t.Errorf("router.Close(): %v", err)
+	}
+	for _, name := range []string{csvName, otherName} {
+		sdContent, _ := os.ReadFile(filepath.Join(sdRoot, name))
+		usbContent, err := os.ReadFile(filepath.Join(usbRoot, name))
+		if err != nil || string(usbContent) != string(sdContent) {
+			t.Errorf("usb copy of %s is '%s' (err %v), expected '%s'", name, usbContent, err, sdContent)
+		}
+	}
+	if content, _ := os.ReadFile(filepath.Join(usbRoot, csvName)); string(content) != "unix,x\n1,a\n2,b\n3,c\n4,d\n" {
+		t.Errorf("unexpected usb content: '%s'", content)
+	}
+	if len(changes) != 2 || changes[0].Healthy || !changes[1].Healthy {
+		t.Errorf("unexpected health changes: %v", changes)
+	}
+
+	/* The backfilled rows are in the usb catalog */
+	if e, ok := usb.Catalog.Get(csvName); !ok || e.Records != 4 || e.FirstUnix != 1 || e.LastUnix != 4 {
+		t.Errorf("usb catalog entry for %s is %+v", csvName, e)
+	}
+	if e, ok := usb.Catalog.Get(otherName); !ok || e.Records != 1 || e.FirstUnix != 3 {
+		t.Errorf("usb catalog entry for %s is %+v", otherName, e)
+	}
+}
+
+func TestSinkRouterNoDestination(t *testing.T) {
+	router := NewSinkRouter(SinkDestination{Name: "usb", Sink: NewFileSink(t.TempDir(), 0), Present: func() bool { return false }})
+	router.OnHealthChange = nil
+	if err := router.Write(BinaryFileWriteJob{Filename: "OPERA_abc_PrimaryRaw_20261018.raw", Content: []byte{1}}); err == nil {
+		t.Errorf("expected an error with no destination present")
+	}
+	if h := router.Health(); h[0].Healthy || h[0].ConsecutiveFailures != 1 || h[0].LastError == nil {
+		t.Errorf("unexpected health: %v", h)
+	}
+}
+
+func TestSinkRouterFlushFailure(t *testing.T) {
+	sdRoot, usbRoot := t.TempDir(), t.TempDir()
+	sd, usb := NewFileSink(sdRoot, 0), NewFileSink(usbRoot, 0)
+	router := NewSinkRouter(SinkDestination{Name: "sd", Sink: sd}, SinkDestination{Name: "usb", Sink: usb})
+	router.RetryInterval = 0
+	router.OnHealthChange = nil
+	csvName := "OPERA_abc_Output_20261018.csv"
+	router.Write(CsvFileWriteJob{Filename: csvName, Headers: "unix,x", Content: "1,a"})
+
+	/* The usb file handle goes bad: its pending row cannot be committed */
+	usb.mu.Lock()
+	usb.files[csvName].Value.(*sinkFile).f.Close()
+	usb.mu.Unlock()
+	if err := router.Flush(); err == nil {
+		t.Errorf("expected the usb commit error from router.Flush()")
+	}
+	if h := router.Health(); !h[0].Healthy || h[1].Healthy || h[1].MissedFiles != 1 {
+		t.Errorf("unexpected health after the failed flush: %v", h)
+	}
+
+	/* Backfilled from the SD card on the next write */
+	if err := router.Write(CsvFileWriteJob{Filename: csvName, Headers: "unix,x", Content: "2,b"}); err != nil {
+		t.Errorf("router.Write(): %v", err)
+	}
+	router.Close()
+	if content, _ := os.ReadFile(filepath.Join(usbRoot, csvName)); string(content) != "unix,x\n1,a\n2,b\n" {
+		t.Errorf("unexpected usb content: '%s'", content)
+	}
+	if h := router.Health(); !h[1].Healthy {
+		t.Errorf("usb did not recover: %v", h)
+	}
+}
+
+func TestSinkRouterBackfillCompressed(t *testing.T) {
+	sdRoot, usbRoot := t.TempDir(), t.TempDir()
+	sd, usb := NewFileSink(sdRoot, 0), NewFileSink(usbRoot, 0)
+	usbPresent := true
+	router := NewSinkRouter(
+		SinkDestination{Name: "sd", Sink: sd},
+		SinkDestination{Name: "usb", Sink: usb, Present: func() bool { return usbPresent }},
+	)
+	router.RetryInterval = 0
+	router.OnHealthChange = nil
+	csvName, otherName := "OPERA_abc_Output_20261018.csv", "OPERA_abc_SecondaryRaw_20261018.csv"
+	router.Write(CsvFileWriteJob{Filename: csvName, Headers: "unix,x", Content: "1,a"})
+
+	/* USB out for longer than the compress delay: the SD copy is compressed */
+	usbPresent = false
+	router.Write(CsvFileWriteJob{Filename: csvName, Headers: "unix,x", Content: "2,b"})
+	router.Write(CsvFileWriteJob{Filename: otherName, Headers: "unix,y", Content: "2,z"})
+	sd.Flush()
+	compressor := NewCompressor(sdRoot, sd)
+	compressor.Delay = 0
+	if compressed, err := compressor.CompressCompleted(); err != nil || len(compressed) != 2 {
+		t.Errorf("compressor.CompressCompleted() returned %v, %v", compressed, err)
+		return
+	}
+
+	/* A late row goes to a new file continuing the compressed one */
+	router.Write(CsvFileWriteJob{Filename: csvName, Headers: "unix,x", Content: "3,c"})
+	sd.Flush()
+
+	/* Backfilled from the compressed files */
+	usbPresent = true
+	if err := router.Backfill(); err != nil {
+		t.Errorf("router.Backfill(): %v", err)
+	}
+	router.Close()
+	for name, expected := range map[string]string{csvName: "unix,x\n1,a\n2,b\n3,c\n", otherName: "unix,y\n2,z\n"} {
+		if content, _ := os.ReadFile(filepath.Join(usbRoot, name)); string(content) != expected {
+			t.Errorf("unexpected usb content of %s: '%s'", name, content)
+		}
+	}
+	if h := router.Health(); !h[1].Healthy {
+		t.Errorf("usb did not recover: %v", h)
+	}
+
+	/* A source file that is gone without the catalog saying so is an error */
+	usbPresent = false
+	router.Write(CsvFileWriteJob{Filename: csvName, Headers: "unix,x", Content: "4,d"})
+	sd.Flush()
+	os.Remove(filepath.Join(sdRoot, csvName))
+	os.Remove(filepath.Join(sdRoot, csvName+COMPRESSED_FILE_EXTENSION))
+	usbPresent = true
+	if err := router.Backfill(); err == nil {
+		t.Errorf("expected an error backfilling from a missing file")
+	}
+	if h := router.Health(); h[1].Healthy || h[1].MissedFiles != 1 {
+		t.Errorf("usb should still miss the file: %v", h)
+	}
+	router.Close()
+}
@@ -0,0 +1,460 @@
+package operadatatypes
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* Output Schemas */
+
+// One column of a CSV output. The header, row content and CSV reader of the
+// column all come from it.
+type Field[T any] struct {
+	Name    string   // CSV header
+	Unit    string   // Empty for counts, labels and dimensionless values
+	Aliases []string // Names older files use for the column
+	Source  string   // The struct field the column holds, e.g. "Sps30.Pm2p5"
+
+	format func(d *T, f CsvFormatPolicy) string
+	read   func(d *T, c *csvRowReader, names []string)
+	value  func(d *T) any // Plain value, Inf as nil
+}
+
+// Returns the column's name followed by its aliases.
+func (f Field[T]) names() []string {
+	return append([]string{f.Name}, f.Aliases...)
+}
+
+func (f Field[T]) withAliases(aliases ...string) Field[T] {
+	f.Aliases = aliases
+	return f
+}
+
+// The columns of one output type, in file order. Omitted lists the struct
+// fields the output deliberately leaves out, with the reason.
+type Schema[T any] struct {
+	Fields  []Field[T]
+	Omitted map[string]string
+}
+
+func (s Schema[T]) Columns() []string {
+	ret := make([]string, len(s.Fields))
+	for i, f := range s.Fields {
+		ret[i] = f.Name
+	}
+	return ret
+}
+
+// Returns the CSV header line, without the line ending.
+func (s Schema[T]) Header() string {
+	return strings.Join(s.Columns(), ",")
+}
+
+// Returns d as one CSV row, without the line ending.
+func (s Schema[T]) record(d *T, f CsvFormatPolicy) string {
+	fields := make([]string, len(s.Fields))
+	for i, field := range s.Fields {
+		fields[i] = field.format(d, f)
+	}
+	return csvRecord(fields...)
+}
+
+// Fills d from the current row of c. Conversion errors are left in c.
+func (s Schema[T]) read(c *csvRowReader, d *T) {
+	for _, field := range s.Fields {
+		field.read(d, c, field.names())
+	}
+}
+
+// Returns d as a JSON object keyed by its json tags in field order, nested
+// structs as objects. NaN values are left out as RemoveNaN does; NaN inside
+// lists and Inf, which JSON cannot hold, are written as null.
+func jsonObject(d any) string {
+	return jsonValue(reflect.ValueOf(d), false)
+}
+
+func jsonValue(v reflect.Value, list bool) string {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return "null"
+		}
+		return jsonValue(v.Elem(), list)
+	case reflect.Struct:
+		members := []string{}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" || isNaN(v.Field(i).Interface()) {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			key, _ := json.Marshal(name)
+			members = append(members, string(key)+":"+jsonValue(v.Field(i), false))
+		}
+		return "{" + strings.Join(members, ",") + "}"
+	case reflect.Slice, reflect.Array:
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = jsonValue(v.Index(i), true)
+		}
+		return "[" + strings.Join(items, ",") + "]"
+	case reflect.Float32, reflect.Float64:
+		if math.IsNaN(v.Float()) || math.IsInf(v.Float(), 0) {
+			return "null"
+		}
+	}
+	b, err := json.Marshal(v.Interface())
+	if err != nil {
+		return "null" // Values are plain numbers, strings and bools
+	}
+	return string(b)
+}
+
+/* Field Kinds */
+
+// Returns v, or nil for Inf, which JSON cannot hold. With nil for NaN too when
+// list is set, as list items cannot be left out.
+func jsonFloat(v float32, list bool) any {
+	if math.IsInf(float64(v), 0) || list && math.IsNaN(float64(v)) {
+		return nil
+	}
+	return v
+}
+
+func floatField[T any](name, unit, source string, get func(*T) *float32) Field[T] {
+	return Field[T]{
+		Name: name, Unit: unit, Source: source,
+		format: func(d *T, f CsvFormatPolicy) string { return f.float(name, *get(d)) },
+		read:   func(d *T, c *csvRowReader, names []string) { *get(d) = c.float(names...) },
+		value:  func(d *T) any { return jsonFloat(*get(d), false) },
+	}
+}
+
+type unsignedInteger interface {
+	~uint8 | ~uint16 | ~uint32
+}
+
+func uintField[T any, N unsignedInteger](name, unit, source string, get func(*T) *N) Field[T] {
+	return Field[T]{
+		Name: name, Unit: unit, Source: source,
+		format: func(d *T, f CsvFormatPolicy) string { return strconv.FormatUint(uint64(*get(d)), 10) },
+		read: func(d *T, c *csvRowReader, names []string) {
+			*get(d) = N(c.uint(reflect.TypeFor[N]().Bits(), names...))
+		},
+		value: func(d *T) any { return *get(d) },
+	}
+}
+
+func intField[T any](name, unit, source string, get func(*T) *int32) Field[T] {
+	return Field[T]{
+		Name: name, Unit: unit, Source: source,
+		format: func(d *T, f CsvFormatPolicy) string { return strconv.FormatInt(int64(*get(d)), 10) },
+		read:   func(d *T, c *csvRowReader, names []string) { *get(d) = int32(c.int(32, names...)) },
+		value:  func(d *T) any { return *get(d) },
+	}
+}
+
+func boolField[T any](name, source string, get func(*T) *bool) Field[T] {
+	return Field[T]{
+		Name: name, Source: source,
+		format: func(d *T, f CsvFormatPolicy) string { return strconv.FormatBool(*get(d)) },
+		read:   func(d *T, c *csvRowReader, names []string) { *get(d) = c.bool(names...) },
+		value:  func(d *T) any { return *get(d) },
+	}
+}
+
+func stringField[T any](name, source string, get func(*T) *string) Field[T] {
+	return Field[T]{
+		Name: name, Source: source,
+		format: func(d *T, f CsvFormatPolicy) string { return *get(d) },
+		read:   func(d *T, c *csvRowReader, names []string) { *get(d) = c.str(names...) },
+		value:  func(d *T) any { return *get(d) },
+	}
+}
+
+func stringListField[T any](name, source string, get func(*T) *[]string) Field[T] {
+	return Field[T]{
+		Name: name, Source: source,
+		format: func(d *T, f CsvFormatPolicy) string { return csvStringList(*get(d)) },
+		read:   func(d *T, c *csvRowReader, names []string) { *get(d) = c.stringList(names...) },
+		value: func(d *T) any {
+			if *get(d) == nil {
+				return []string{}
+			}
+			return *get(d)
+		},
+	}
+}
+
+func floatListField[T any](name, unit, source string, get func(*T) *[]float32) Field[T] {
+	return Field[T]{
+		Name: name, Unit: unit, Source: source,
+		format: func(d *T, f CsvFormatPolicy) string { return csvFloatList(*get(d), f.column(name)) },
+		read:   func(d *T, c *csvRowReader, names []string) { *get(d) = c.floatList(names...) },
+		value: func(d *T) any {
+			ret := make([]any, len(*get(d)))
+			for i, v := range *get(d) {
+				ret[i] = jsonFloat(v, true)
+			}
+			return ret
+		},
+	}
+}
+
+func pulsesField[T any](name, source string, get func(*T) *[]NewPulse) Field[T] {
+	return Field[T]{
+		Name: name, Source: source,
+		format: func(d *T, f CsvFormatPolicy) string { return pulsesCsvString(*get(d)) },
+		read:   func(d *T, c *csvRowReader, names []string) { *get(d) = c.pulses(names...) },
+		value: func(d *T) any {
+			if *get(d) == nil {
+				return []NewPulse{}
+			}
+			return *get(d)
+		},
+	}
+}
+
+/* SecondaryRaw */
+
+var SecondaryRawSchema = Schema[SecondaryData]{Fields: []Field[SecondaryData]{
+	uintField("unix", "s", "UnixSec", func(d *SecondaryData) *uint32 { return &d.UnixSec }),
+	stringField("portenta", "PortentaSerial", func(d *SecondaryData) *string { return &d.PortentaSerial }),
+	floatField("sps30_pm1", "ug/m3", "Sps30.Pm1", func(d *SecondaryData) *float32 { return &d.Sps30.Pm1 }),
+	floatField("sps30_pm2p5", "ug/m3", "Sps30.Pm2p5", func(d *SecondaryData) *float32 { return &d.Sps30.Pm2p5 }),
+	floatField("sps30_pm4", "ug/m3", "Sps30.Pm4", func(d *SecondaryData) *float32 { return &d.Sps30.Pm4 }),
+	floatField("sps30_pm10", "ug/m3", "Sps30.Pm10", func(d *SecondaryData) *float32 { return &d.Sps30.Pm10 }),
+	floatField("sps30_pn0p5", "#/cm3", "Sps30.Pn0p5", func(d *SecondaryData) *float32 { return &d.Sps30.Pn0p5 }),
+	floatField("sps30_pn1", "#/cm3", "Sps30.Pn1", func(d *SecondaryData) *float32 { return &d.Sps30.Pn1 }),
+	floatField("sps30_pn2p5", "#/cm3", "Sps30.Pn2p5", func(d *SecondaryData) *float32 { return &d.Sps30.Pn2p5 }),
+	floatField("sps30_pn4", "#/cm3", "Sps30.Pn4", func(d *SecondaryData) *float32 { return &d.Sps30.Pn4 }),
+	floatField("sps30_pn10", "#/cm3", "Sps30.Pn10", func(d *SecondaryData) *float32 { return &d.Sps30.Pn10 }),
+	floatField("sps30_tps", "um", "Sps30.TypicalParticleSize", func(d *SecondaryData) *float32 { return &d.Sps30.TypicalParticleSize }),
+	floatField("pressure", "kPa", "Pressure", func(d *SecondaryData) *float32 { return &d.Pressure }),
+	uintField("co2", "ppm", "Co2", func(d *SecondaryData) *uint32 { return &d.Co2 }),
+	intField("voc_index", "", "VocIndex", func(d *SecondaryData) *int32 { return &d.VocIndex }),
+	floatField("flow_temp", "degC", "FlowTemperature", func(d *SecondaryData) *float32 { return &d.FlowTemperature }),
+	floatField("flow_hum", "%", "FlowHumidity", func(d *SecondaryData) *float32 { return &d.FlowHumidity }),
+	floatField("flow_rate", "m/s", "FlowRate", func(d *SecondaryData) *float32 { return &d.FlowRate }),
+	floatField("imx8_temp", "degC", "PortentaImx8Temp", func(d *SecondaryData) *float32 { return &d.PortentaImx8Temp }),
+	floatField("teensy_temp", "degC", "TeensyMcuTemp", func(d *SecondaryData) *float32 { return &d.TeensyMcuTemp }),
+	floatField("optical_temp0", "degC", "OpticalTemperatures[0]", func(d *SecondaryData) *float32 { return &d.OpticalTemperatures[0] }),
+	floatField("optical_temp1", "degC", "OpticalTemperatures[1]", func(d *SecondaryData) *float32 { return &d.OpticalTemperatures[1] }),
+	floatField("optical_temp2", "degC", "OpticalTemperatures[2]", func(d *SecondaryData) *float32 { return &d.OpticalTemperatures[2] }),
+	floatField("omb_temp_htu", "degC", "OmbTemperatureHtu", func(d *SecondaryData) *float32 { return &d.OmbTemperatureHtu }),
+	floatField("omb_hum_htu", "%", "OmbHumidityHtu", func(d *SecondaryData) *float32 { return &d.OmbHumidityHtu }),
+	floatField("omb_temp_scd", "degC", "OmbTemperatureScd", func(d *SecondaryData) *float32 { return &d.OmbTemperatureScd }),
+	floatField("omb_hum_scd", "%", "OmbHumidityScd", func(d *SecondaryData) *float32 { return &d.OmbHumidityScd }).withAliases("omg_hum_scd"),
+	floatField("mean_5v_monitor", "V", "Monitor5vMean", func(d *SecondaryData) *float32 { return &d.Monitor5vMean }),
+	floatField("std_dev_5v_monitor", "V", "Monitor5vStdDev", func(d *SecondaryData) *float32 { return &d.Monitor5vStdDev }),
+}}
+
+/* Output */
+
+// The ML concentration columns are named by MlConcentrationOutputData's json
+// tags, in field order (the order of Iterate).
+func mlConcentrationFields() []Field[OperaData] {
+	t := reflect.TypeFor[MlConcentrationOutputData]()
+	ret := make([]Field[OperaData], t.NumField())
+	for i := range ret {
+		i, name := i, t.Field(i).Tag.Get("json")
+		unit := "ug/m3"
+		if strings.HasPrefix(name, "PN") {
+			unit = "#/cm3"
+		}
+		ret[i] = floatField(name, unit, "Concentrations."+t.Field(i).Name, func(d *OperaData) *float32 { return d.Concentrations.Iterate()[i] })
+	}
+	return ret
+}
+
+var OutputSchema = Schema[OperaData]{Fields: append(append([]Field[OperaData]{
+	uintField("unix", "s", "UnixSec", func(d *OperaData) *uint32 { return &d.UnixSec }),
+	stringField("portenta", "PortentaSerial", func(d *OperaData) *string { return &d.PortentaSerial }),
+}, mlConcentrationFields()...),
+	stringField("class_label", "ClassLabel", func(d *OperaData) *string { return &d.ClassLabel }),
+	stringListField("class_labels", "ClassLabels", func(d *OperaData) *[]string { return &d.ClassLabels }),
+	floatListField("class_probs", "", "ClassProbs", func(d *OperaData) *[]float32 { return &d.ClassProbs }),
+	floatField("temp", "degC", "Temp", func(d *OperaData) *float32 { return &d.Temp }),
+	floatField("rh", "%", "RH", func(d *OperaData) *float32 { return &d.RH }),
+	floatField("sps30_pm2p5", "ug/m3", "Sps30Pm2p5", func(d *OperaData) *float32 { return &d.Sps30Pm2p5 }),
+	floatField("pressure", "kPa", "Pressure", func(d *OperaData) *float32 { return &d.Pressure }),
+	uintField("co2", "ppm", "Co2", func(d *OperaData) *uint32 { return &d.Co2 }),
+	intField("voc_index", "", "VocIndex", func(d *OperaData) *int32 { return &d.VocIndex }),
+)}
+
+const CLASS_PROB_COLUMN_PREFIX = "prob_"
+
+// Returns the prob_<label> column of a classifier label: the label in lower
+// case with each run of characters other than letters and digits as "_".
+func classProbColumn(label string) string {
+	var sb strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(label) {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			sb.WriteRune(r)
+			underscore = false
+		} else if !underscore && sb.Len() > 0 {
+			sb.WriteByte('_')
+			underscore = true
+		}
+	}
+	name := strings.TrimSuffix(sb.String(), "_")
+	if name == "" {
+		name = "unlabeled"
+	}
+	return CLASS_PROB_COLUMN_PREFIX + name
+}
+
+// Returns OutputSchema with one prob_<label> column per label, in the order
+// given, in place of class_labels and class_probs. Labels that name the same
+// column get a _2, _3, ... suffix. Each record's probabilities go to the
+// columns of its own labels, whatever their order, or by position if it has
+// none; those of labels not given are left out.
+func wideOutputSchema(labels []string) Schema[OperaData] {
+	taken := map[string]bool{}
+	for _, f := range OutputSchema.Fields {
+		taken[f.Name] = true
+	}
+	ret := Schema[OperaData]{Omitted: map[string]string{"ClassLabels": "named by the prob_<label> columns"}}
+	for _, f := range OutputSchema.Fields {
+		switch f.Name {
+		case "class_labels":
+		case "class_probs":
+			for i, label := range labels {
+				name := classProbColumn(label)
+				for n := 2; taken[name]; n++ {
+					name = fmt.Sprintf("%s_%d", classProbColumn(label), n)
+				}
+				taken[name] = true
+				get := func(d *OperaData) *float32 {
+					j := i
+					if len(d.ClassLabels) > 0 {
+						j = slices.Index(d.ClassLabels, label)
+					}
+					if 0 <= j && j < len(d.ClassProbs) {
+						return &d.ClassProbs[j]
+					}
+					missing := float32(math.NaN())
+					return &missing
+				}
+				prob := floatField(name, "", "ClassProbs", get)
+				prob.format = func(d *OperaData, f CsvFormatPolicy) string { return f.column("class_probs").format(*get(d)) }
+				ret.Fields = append(ret.Fields, prob)
+			}
+		default:
+			ret.Fields = append(ret.Fields, f)
+		}
+	}
+	return ret
+}
+
+var (
+	wideLabelsMu sync.Mutex
+	wideLabels   []string
+)
+
+// Returns the labels of the wide prob_<label> columns: the policy's
+// ClassLabels, or else those of the first record that had labels, kept until a
+// record holds a label they lack. Records with no labels, or the same labels
+// in another order, so keep the header and file; only a new model's labels
+// start a new version of the file.
+func wideClassLabels(p CsvFormatPolicy, labels []string) []string {
+	if len(p.ClassLabels) > 0 {
+		return p.ClassLabels
+	}
+	wideLabelsMu.Lock()
+	defer wideLabelsMu.Unlock()
+	for _, label := range labels {
+		if !slices.Contains(wideLabels, label) {
+			wideLabels = slices.Clone(labels)
+			break
+		}
+	}
+	return wideLabels
+}
+
+/* PrimaryRaw */
+
+// One row of a PrimaryRaw CSV file: a reading and one of its counts.
+type PrimaryRawRow struct {
+	Data   *PrimaryData
+	Counts *NewTeensyCounts
+}
+
+var PrimaryRawSchema = Schema[PrimaryRawRow]{
+	Fields: []Field[PrimaryRawRow]{
+		uintField("unix", "s", "TeensyData.UnixSec", func(r *PrimaryRawRow) *uint32 { return &r.Data.TeensyData.UnixSec }),
+		uintField("ms", "ms", "TeensyData.MilliSec", func(r *PrimaryRawRow) *uint32 { return &r.Data.TeensyData.MilliSec }),
+		stringField("portenta", "PortentaSerial", func(r *PrimaryRawRow) *string { return &r.Data.PortentaSerial }),
+		boolField("hv_enabled", "TeensyData.HvEnabled", func(r *PrimaryRawRow) *bool { return &r.Data.TeensyData.HvEnabled }),
+		uintField("hv_set", "", "TeensyData.HvSet", func(r *PrimaryRawRow) *uint8 { return &r.Data.TeensyData.HvSet }),
+		uintField("hv_read", "", "TeensyData.HvMonitor", func(r *PrimaryRawRow) *uint16 { return &r.Data.TeensyData.HvMonitor }),
+		uintField("pd0", "", "TeensyData.Counts[].PinPd0", func(r *PrimaryRawRow) *uint8 { return &r.Counts.PinPd0 }),
+		uintField("pd1", "", "TeensyData.Counts[].PinPd1", func(r *PrimaryRawRow) *uint8 { return &r.Counts.PinPd1 }),
+		uintField("laser", "", "TeensyData.Counts[].PinLaser", func(r *PrimaryRawRow) *uint8 { return &r.Counts.PinLaser }),
+		floatField("raw_scalar0", "", "TeensyData.Counts[].RawScalar0", func(r *PrimaryRawRow) *float32 { return &r.Counts.RawScalar0 }),
+		floatField("raw_scalar1", "", "TeensyData.Counts[].RawScalar1", func(r *PrimaryRawRow) *float32 { return &r.Counts.RawScalar1 }),
+		floatField("diff_scalar0", "", "TeensyData.Counts[].DiffedScalar0", func(r *PrimaryRawRow) *float32 { return &r.Counts.DiffedScalar0 }),
+		floatField("diff_scalar1", "", "TeensyData.Counts[].DiffedScalar1", func(r *PrimaryRawRow) *float32 { return &r.Counts.DiffedScalar1 }),
+		floatField("baseline0", "", "TeensyData.Counts[].Baseline0", func(r *PrimaryRawRow) *float32 { return &r.Counts.Baseline0 }),
+		floatField("baseline1", "", "TeensyData.Counts[].Baseline1", func(r *PrimaryRawRow) *float32 { return &r.Counts.Baseline1 }),
+		floatField("raw_upper_th0", "", "TeensyData.Counts[].RawUpperTh0", func(r *PrimaryRawRow) *float32 { return &r.Counts.RawUpperTh0 }),
+		floatField("raw_upper_th1", "", "TeensyData.Counts[].RawUpperTh1", func(r *PrimaryRawRow) *float32 { return &r.Counts.RawUpperTh1 }),
+		floatField("diff_upper_th0", "", "TeensyData.Counts[].DiffedUpperTh0", func(r *PrimaryRawRow) *float32 { return &r.Counts.DiffedUpperTh0 }),
+		floatField("diff_upper_th1", "", "TeensyData.Counts[].DiffedUpperTh1", func(r *PrimaryRawRow) *float32 { return &r.Counts.DiffedUpperTh1 }),
+		uintField("ms_read", "ms", "TeensyData.Counts[].MsRead", func(r *PrimaryRawRow) *uint32 { return &r.Counts.MsRead }),
+		uintField("num_buff", "", "TeensyData.Counts[].BuffersRead", func(r *PrimaryRawRow) *uint32 { return &r.Counts.BuffersRead }),
+		uintField("max_laser_on", "", "TeensyData.Counts[].MaxLaserOn", func(r *PrimaryRawRow) *uint16 { return &r.Counts.MaxLaserOn }),
+		uintField("num_pulse", "", "TeensyData.Counts[].NumPulses", func(r *PrimaryRawRow) *uint32 { return &r.Counts.NumPulses }),
+		floatField("pulses_per_second", "1/s", "TeensyData.Counts[].PulsesPerSecond", func(r *PrimaryRawRow) *float32 { return &r.Counts.PulsesPerSecond }),
+		pulsesField("pulses", "TeensyData.Counts[].Pulses", func(r *PrimaryRawRow) *[]NewPulse { return &r.Counts.Pulses }),
+	},
+	Omitted: map[string]string{
+		"TeensyData.McuTemp":  "written to SecondaryRaw as teensy_temp",
+		"TeensyData.FlowTemp": "written to SecondaryRaw as flow_temp",
+		"TeensyData.FlowHum":  "written to SecondaryRaw as flow_hum",
+		"TeensyData.FlowRate": "written to SecondaryRaw as flow_rate",
+	},
+}
+
+/* Pulses */
+
+// One row of a Pulses CSV file: a pulse with its reading and counts.
+type PulseRow struct {
+	Data   *PrimaryData
+	Counts *NewTeensyCounts
+	Pulse  *NewPulse
+}
+
+func pulseIndexFields() []Field[PulseRow] {
+	ret := make([]Field[PulseRow], NUMBER_INDICES_PULSE)
+	for i := range ret {
+		i := i
+		ret[i] = uintField(fmt.Sprintf("index%d", i), "", fmt.Sprintf("TeensyData.Counts[].Pulses[].Indices[%d]", i), func(r *PulseRow) *uint16 { return &r.Pulse.Indices[i] })
+	}
+	return ret
+}
+
+// Sources are PrimaryData paths, the pulse's own columns under
+// TeensyData.Counts[].Pulses[].
+var PulsesSchema = Schema[PulseRow]{Fields: append([]Field[PulseRow]{
+	uintField("unix", "s", "TeensyData.UnixSec", func(r *PulseRow) *uint32 { return &r.Data.TeensyData.UnixSec }),
+	uintField("ms", "ms", "TeensyData.MilliSec", func(r *PulseRow) *uint32 { return &r.Data.TeensyData.MilliSec }),
+	stringField("portenta", "PortentaSerial", func(r *PulseRow) *string { return &r.Data.PortentaSerial }),
+	uintField("pd0", "", "TeensyData.Counts[].PinPd0", func(r *PulseRow) *uint8 { return &r.Counts.PinPd0 }),
+	uintField("pd1", "", "TeensyData.Counts[].PinPd1", func(r *PulseRow) *uint8 { return &r.Counts.PinPd1 }),
+	uintField("laser", "", "TeensyData.Counts[].PinLaser", func(r *PulseRow) *uint8 { return &r.Counts.PinLaser }),
+	floatField("baseline0", "", "TeensyData.Counts[].Baseline0", func(r *PulseRow) *float32 { return &r.Counts.Baseline0 }),
+	floatField("baseline1", "", "TeensyData.Counts[].Baseline1", func(r *PulseRow) *float32 { return &r.Counts.Baseline1 }),
+	uintField("raw_peak", "", "TeensyData.Counts[].Pulses[].RawPeak", func(r *PulseRow) *uint16 { return &r.Pulse.RawPeak }),
+	uintField("side_peak", "", "TeensyData.Counts[].Pulses[].SidePeak", func(r *PulseRow) *uint16 { return &r.Pulse.SidePeak }),
+}, pulseIndexFields()...)}
@@ -0,0 +1,122 @@
+package operadatatypes
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Returns the paths of the leaf fields of t as Field.Source names them:
+// nested structs joined with ".", arrays indexed and slices of struct
+// pointers as "[]".
+func structFieldPaths(t reflect.Type, prefix string) []string {
+	ret := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		path := prefix + f.Name
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			ret = append(ret, structFieldPaths(f.Type, path+".")...)
+		case f.Type.Kind() == reflect.Array:
+			for j := 0; j < f.Type.Len(); j++ {
+				ret = append(ret, fmt.Sprintf("%s[%d]", path, j))
+			}
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Pointer:
+			ret = append(ret, structFieldPaths(f.Type.Elem().Elem(), path+"[].")...)
+		default:
+			ret = append(ret, path)
+		}
+	}
+	return ret
+}
+
+func checkSchemaCoverage[T any](t *testing.T, name string, s Schema[T], record reflect.Type) {
+	sources, columns := map[string]bool{}, map[string]bool{}
+	for _, f := range s.Fields {
+		if sources[f.Source] {
+			t.Errorf("%s: %s is held by more than one column", name, f.Source)
+		}
+		if columns[strings.ToLower(f.Name)] {
+			t.Errorf("%s: column %s appears twice", name, f.Name)
+		}
+		sources[f.Source], columns[strings.ToLower(f.Name)] = true, true
+	}
+	paths := map[string]bool{}
+	for _, path := range structFieldPaths(record, "") {
+		paths[path] = true
+		if _, omitted := s.Omitted[path]; !sources[path] && !omitted {
+			t.Errorf("%s: struct field %s has no column", name, path)
+		}
+	}
+	for source := range sources {
+		if !paths[source] {
+			t.Errorf("%s: column source %s is not a field of %v", name, source, record)
+		}
+	}
+	for source := range s.Omitted {
+		if !paths[source] || sources[source] {
+			t.Errorf("%s: omitted %s is not a field of %v or has a column", name, source, record)
+		}
+	}
+}
+
+func TestSchemasCoverStructs(t *testing.T) {
+	checkSchemaCoverage(t, "SecondaryRaw", SecondaryRawSchema, reflect.TypeFor[SecondaryData]())
+	checkSchemaCoverage(t, "Output", OutputSchema, reflect.TypeFor[OperaData]())
+	checkSchemaCoverage(t, "PrimaryRaw", PrimaryRawSchema, reflect.TypeFor[PrimaryData]())
+
+	/* Pulses holds every NewPulse field, and its other columns come from PrimaryData */
+	pulsePrefix := "TeensyData.Counts[].Pulses[]."
+	sources, paths := map[string]bool{}, map[string]bool{}
+	for _, f := range PulsesSchema.Fields {
+		sources[f.Source] = true
+	}
+	for _, path := range structFieldPaths(reflect.TypeFor[PrimaryData](), "") {
+		paths[path] = true
+	}
+	for _, path := range structFieldPaths(reflect.TypeFor[NewPulse](), pulsePrefix) {
+		paths[path] = true
+		if !sources[path] {
+			t.Errorf("Pulses: pulse field %s has no column", path)
+		}
+	}
+	for source := range sources {
+		if !paths[source] {
+			t.Errorf("Pulses: column source %s is not a field of PrimaryData or NewPulse", source)
+		}
+	}
+	if len(sources) != len(PulsesSchema.Fields) {
+		t.Errorf("Pulses: a source is held by more than one column")
+	}
+
+	if !strings.Contains(SecondaryRawSchema.Header(), ",omb_hum_scd,") {
+		t.Errorf("SecondaryRaw header is %s", SecondaryRawSchema.Header())
+	}
+	if !strings.Contains(OutputSchema.Header(), ","+ML_CONCENTRATION_CSV_HEADER+",") {
+		t.Errorf("Output header %s does not hold the ML concentration columns", OutputSchema.Header())
+	}
+}
+
+func TestSchemaJson(t *testing.T) {
+	d := &OperaData{UnixSec: 100, PortentaSerial: "abc", ClassProbs: []float32{float32(math.NaN()), 0.5}, Temp: float32(math.Inf(1)), RH: float32(math.NaN())}
+	d.Concentrations.PN0p85 = 2.5
+	b := jsonObject(d)
+	values := map[string]any{}
+	if err := json.Unmarshal([]byte(b), &values); err != nil {
+		t.Errorf("jsonObject() gave invalid json %s: %v", b, err)
+		return
+	}
+	concentrations, _ := values["concentrations"].(map[string]any)
+	if _, ok := values["rh"]; ok || len(values) != 11 || values["unix_sec"] != 100.0 || values["portenta_serial"] != "abc" || concentrations["PN0_85"] != 2.5 || values["temp"] != nil {
+		t.Errorf("jsonObject() gave %s", b)
+	}
+	if probs, ok := values["class_probs"].([]any); !ok || len(probs) != 2 || probs[0] != nil || probs[1] != 0.5 {
+		t.Errorf("class_probs in json is %v", values["class_probs"])
+	}
+	if labels, ok := values["class_labels"].([]any); !ok || len(labels) != 0 {
+		t.Errorf("class_labels in json is %v, expected []", values["class_labels"])
+	}
+}
@@ -0,0 +1,535 @@
+package operadatatypes
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	DEFAULT_SINK_MAX_OPEN_FILES = 16
+	SINK_MAX_PENDING_BYTES      = 1 << 20
+)
+
+// The consumer of FileWriteJobs sent to USB_MASS_STORAGE_UNIX_SOCKET and
+// MAIN_SD_UNIX_SOCKET. Appends each job's content to its file under Root,
+// keeping up to MaxOpenFiles handles open and closing the least recently used.
+type FileSink struct {
+	Root         string
+	MaxOpenFiles int
+
+	// Called when a CSV job's Headers differ from the existing file's and the
+	// rows are redirected to a new version of the file. Logs by default.
+	OnHeaderChange func(filename, versionedFilename, oldHeaders, newHeaders string)
+	// Kept up to date with every write, if set. Saved Catalog.SaveInterval
+	// after a commit, and on Flush and Close.
+	Catalog *Catalog
+	// Called when a commit the sink makes on its own, under a DurabilityPolicy
+	// SyncIntervalMs, fails. Logs by default. Set under mu once the sink is in
+	// use.
+	OnCommitError func(err error)
+
+	durability     DurabilityPolicy
+	journal        *os.File
+	pendingRecords int
+	stopSync       chan struct{}
+
+	mu          sync.Mutex
+	files       map[string]*list.Element
+	lru         *list.List                // Front is most recently used
+	csvVersions map[string]string         // Filename + Headers to versioned file name
+	parts       map[string]int            // Filename to current part under MaxBytes rotation
+	lastFile    string                    // File the last job went to, after rotation and versioning
+	rotation    map[string]RotationPolicy // Nil to follow SetRotationPolicies
+	namer       *fileNamer                // Nil to follow SetNamingPolicy
+}
+
+type sinkFile struct {
+	name    string
+	path    string
+	f       *os.File
+	pending []byte // Whole records not yet written to f
+	written int64  // Size of f on disk
+	header  string // First line of a CSV file, once known
+}
+
+func (sf *sinkFile) size() int64 {
+	return sf.written + int64(len(sf.pending))
+}
+
+func NewFileSink(root string, maxOpenFiles int) *FileSink {
+	if maxOpenFiles <= 0 {
+		maxOpenFiles = DEFAULT_SINK_MAX_OPEN_FILES
+	}
+	return &FileSink{
+		Root:         root,
+		MaxOpenFiles: maxOpenFiles,
+		files:        map[string]*list.Element{},
+		lru:          list.New(),
+		csvVersions:  map[string]string{},
+		parts:        map[string]int{},
+		OnHeaderChange: func(filename, versionedFilename, oldHeaders, newHeaders string) {
+			log.Printf("csv headers of '%s' changed, writing to '%s' instead. Was: '%s', now: '%s'", filename, versionedFilename, oldHeaders, newHeaders)
+		},
+		OnCommitError: func(err error) {
+			log.Printf("failed to commit pending records: %v", err)
+		},
+	}
+}
+
+// Appends the job to its file. CSV rows are newline terminated and the
+// job's Headers are written first only if the file is new or empty. Content
+// reaches the disk according to the sink's DurabilityPolicy, or on Flush.
+func (s *FileSink) Write(job FileWriteJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	switch j := job.(type) {
+	case CsvFileWriteJob:
+		err = s.writeCsv(&j)
+	case *CsvFileWriteJob:
+		err = s.writeCsv(j)
+	case CsvRowsFileWriteJob:
+		err = s.writeCsvRows(&j)
+	case *CsvRowsFileWriteJob:
+		err = s.writeCsvRows(j)
+	case BinaryFileWriteJob:
+		err = s.writeBinary(&j)
+	case *BinaryFileWriteJob:
+		err = s.writeBinary(j)
+	case JsonlFileWriteJob:
+		err = s.writeJsonl(&j)
+	case *JsonlFileWriteJob:
+		err = s.writeJsonl(j)
+	default:
+		return fmt.Errorf("unsupported file write job: %T", job)
+	}
+	if err != nil {
+		return err
+	}
+	s.catalogWrite(job)
+
+	s.pendingRecords++
+	if s.durability.commitDue(s.pendingRecords) || s.pendingBytes() > SINK_MAX_PENDING_BYTES {
+		return s.commit()
+	}
+	return nil
+}
+
+func (s *FileSink) writeCsv(job *CsvFileWriteJob) error {
+	return s.appendCsv(job.Filename, job.Headers, job.Content+"\n")
+}
+
+func (s *FileSink) writeCsvRows(job *CsvRowsFileWriteJob) error {
+	if len(job.Rows) == 0 {
+		return nil
+	}
+	return s.appendCsv(job.Filename, job.Headers, job.content())
+}
+
+// Appends newline terminated rows to a CSV file. Caller must hold mu.
+func (s *FileSink) appendCsv(filename, headers, rows string) error {
+	filename, err := s.sizePart(filename, int64(len(headers)+len(rows)+1))
+	if err != nil {
+		return err
+	}
+	if filename, err = s.csvVersion(filename, headers); err != nil {
+		return err
+	}
+	sf, created, err := s.open(filename)
+	if err != nil {
+		return err
+	}
+	if created && headers != "" {
+		sf.pending = append(sf.pending, headers+"\n"...)
+		sf.header = headers
+	}
+	sf.pending = append(sf.pending, rows...)
+	s.lastFile = filename
+	return nil
+}
+
+func (s *FileSink) writeJsonl(job *JsonlFileWriteJob) error {
+	if len(job.Lines) == 0 {
+		return nil
+	}
+	content := job.content()
+	filename, err := s.sizePart(job.Filename, int64(len(content)))
+	if err != nil {
+		return err
+	}
+	sf, _, err := s.open(filename)
+	if err != nil {
+		return err
+	}
+	sf.pending = append(sf.pending, content...)
+	s.lastFile = filename
+	return nil
+}
+
+func (s *FileSink) writeBinary(job *BinaryFileWriteJob) error {
+	filename, err := s.sizePart(job.Filename, int64(len(job.Content)))
+	if err != nil {
+		return err
+	}
+	sf, _, err := s.open(filename)
+	if err != nil {
+		return err
+	}
+	sf.pending = append(sf.pending, job.Content...)
+	s.lastFile = filename
+	return nil
+}
+
+// Sets the rotation of this sink's files, keyed by data label, in place of
+// the policies given to SetRotationPolicies. Of a policy the sink applies
+// MaxBytes; the interval is in the names of the files it is sent.
+func (s *FileSink) SetRotationPolicies(policies map[string]RotationPolicy) error {
+	rotation := map[string]RotationPolicy{}
+	for label, p := range policies {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("invalid rotation for %s: %v", label, err)
+		}
+		rotation[label] = p
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotation = rotation
+	return nil
+}
+
+// Sets how this sink reads the names of the files it is sent, in place of the
+// policy given to SetNamingPolicy.
+func (s *FileSink) SetNamingPolicy(p NamingPolicy) error {
+	n, err := p.compile()
+	if err != nil {
+		return fmt.Errorf("invalid file naming: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.namer = n
+	return nil
+}
+
+// Caller must hold mu.
+func (s *FileSink) rotationPolicy(dataLabel string) RotationPolicy {
+	if s.rotation == nil {
+		return GetRotationPolicy(dataLabel)
+	}
+	return s.rotation[dataLabel]
+}
+
+// Parses filename with the sink's naming policy and its previous templates,
+// or as ParseFileName does without one. Caller must hold mu.
+func (s *FileSink) parseFileName(filename string) (FileNameInfo, error) {
+	if s.namer == nil {
+		return ParseFileName(filename)
+	}
+	return parseFileNameWith(uniqueFileNamers(append(append([]*fileNamer{s.namer}, s.namer.previous...), defaultNamer)), filename)
+}
+
+// Returns the part of filename that n more bytes should go to, moving on to a
+// new part if the data label's rotation has a MaxBytes the current part would
+// exceed. Caller must hold mu.
+func (s *FileSink) sizePart(filename string, n int64) (string, error) {
+	info, err := s.parseFileName(filename)
+	if err != nil {
+		return filename, nil // Not ours to rotate
+	}
+	maxBytes := s.rotationPolicy(info.DataLabel).MaxBytes
+	if maxBytes <= 0 {
+		return filename, nil
+	}
+	for part := s.parts[filename]; ; part++ {
+		name := partFileName(filename, part)
+		size, err := s.fileSize(name)
+		if err != nil {
+			return "", err
+		}
+		if size == 0 || size+n <= maxBytes {
+			s.parts[filename] = part
+			return name, nil
+		}
+	}
+}
+
+// Caller must hold mu.
+func (s *FileSink) fileSize(filename string) (int64, error) {
+	if e, ok := s.files[filename]; ok {
+		return e.Value.(*sinkFile).size(), nil
+	}
+	path := filepath.Join(s.Root, filename)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to stat file, '%s': %v", path, err)
+	}
+	return info.Size(), nil
+}
+
+// Returns "name_vN.ext" for version > 1 of a file name.
+func versionedFileName(filename string, version int) string {
+	if version <= 1 {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	return fmt.Sprintf("%s_v%d%s", strings.TrimSuffix(filename, ext), version, ext)
+}
+
+// Returns the version of filename whose header line is headers, or the first
+// version that does not exist yet. Caller must hold mu.
+func (s *FileSink) csvVersion(filename, headers string) (string, error) {
+	if headers == "" {
+		return filename, nil
+	}
+	key := filename + "\x00" + headers
+	if name, ok := s.csvVersions[key]; ok {
+		return name, nil
+	}
+
+	var firstHeader string
+	for version := 1; ; version++ {
+		name := versionedFileName(filename, version)
+		header, err := s.csvHeader(name)
+		if err != nil {
+			return "", err
+		}
+		if version == 1 {
+			firstHeader = header
+		}
+		if header == "" || header == headers {
+			if version > 1 && s.OnHeaderChange != nil {
+				s.OnHeaderChange(filename, name, firstHeader, headers)
+			}
+			s.csvVersions[key] = name
+			return name, nil
+		}
+	}
+}
+
+// Returns the first line of a CSV file, or of its compressed file if only that
+// exists, or "" if neither exists or it is empty. Caller must hold mu.
+func (s *FileSink) csvHeader(filename string) (string, error) {
+	if e, ok := s.files[filename]; ok {
+		if sf := e.Value.(*sinkFile); sf.header != "" {
+			return sf.header, nil
+		}
+	}
+	if !filepath.IsLocal(filename) {
+		return "", fmt.Errorf("file name is not local to the sink root: '%s'", filename)
+	}
+	path := filepath.Join(s.Root, filename)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		path += COMPRESSED_FILE_EXTENSION
+	}
+	return firstLine(path)
+}
+
+// Returns the open handle for filename, opening it for append if needed.
+// created is true if the file did not exist or was empty, so a CSV file gets
+// its header even when it continues a file already compressed by a Compressor;
+// gzipFile drops the repeated header when it joins the two. Caller must hold mu.
+func (s *FileSink) open(filename string) (sf *sinkFile, created bool, err error) {
+	if e, ok := s.files[filename]; ok {
+		s.lru.MoveToFront(e)
+		return e.Value.(*sinkFile), false, nil
+	}
+	if !filepath.IsLocal(filename) {
+		return nil, false, fmt.Errorf("file name is not local to the sink root: '%s'", filename)
+	}
+
+	path := filepath.Join(s.Root, filename)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, false, fmt.Errorf("failed to create directory for '%s': %v", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open file, '%s': %v", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, false, fmt.Errorf("failed to stat file, '%s': %v", path, err)
+	}
+
+	for s.lru.Len() >= s.MaxOpenFiles {
+		if err := s.closeFile(s.lru.Back()); err != nil {
+			f.Close()
+			return nil, false, err
+		}
+	}
+	sf = &sinkFile{name: filename, path: path, f: f, written: info.Size()}
+	s.files[filename] = s.lru.PushFront(sf)
+	return sf, info.Size() == 0, nil
+}
+
+// Commits pending content and closes the file. Caller must hold mu.
+func (s *FileSink) closeFile(e *list.Element) error {
+	commitErr := s.commit()
+	sf := s.lru.Remove(e).(*sinkFile)
+	delete(s.files, sf.name)
+	if err := sf.f.Close(); err != nil {
+		return fmt.Errorf("failed to close '%s': %v", sf.path, err)
+	}
+	return commitErr
+}
+
+// Caller must hold mu.
+func (s *FileSink) pendingBytes() int {
+	n := 0
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		n += len(e.Value.(*sinkFile).pending)
+	}
+	return n
+}
+
+// Writes the pending records of every file. Under a DurabilityPolicy the
+// records are journaled first and the files are synced before the journal is
+// cleared, so a crash part way leaves whole records or a journal to replay.
+// Caller must hold mu.
+func (s *FileSink) commit() error {
+	dirty := []*sinkFile{}
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		if sf := e.Value.(*sinkFile); len(sf.pending) > 0 {
+			dirty = append(dirty, sf)
+		}
+	}
+	s.pendingRecords = 0
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	if s.journal != nil {
+		entries := make([]journalEntry, len(dirty))
+		for i, sf := range dirty {
+			entries[i] = journalEntry{filename: sf.name, offset: sf.written, data: sf.pending}
+		}
+		if err := writeJournal(s.journal, entries); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	for _, sf := range dirty {
+		n, writeErr := sf.f.Write(sf.pending)
+		sf.written += int64(n)
+		sf.pending = sf.pending[n:]
+		if writeErr != nil {
+			err = fmt.Errorf("failed to write to '%s': %v", sf.path, writeErr)
+			continue
+		}
+		sf.pending = nil
+		if s.durability.enabled() {
+			if syncErr := sf.f.Sync(); syncErr != nil {
+				err = fmt.Errorf("failed to sync '%s': %v", sf.path, syncErr)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.journal != nil {
+		if err := clearJournal(s.journal); err != nil {
+			return err
+		}
+	}
+	if s.Catalog != nil {
+		return s.Catalog.saveSoon()
+	}
+	return nil
+}
+
+// Returns true if the sink has filename (relative to Root) open.
+func (s *FileSink) IsOpen(filename string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.files[filepath.Clean(filename)]
+	return ok
+}
+
+// Writes pending content to filename (relative to Root) and closes it, if the
+// sink has it open.
+func (s *FileSink) CloseFile(filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.files[filepath.Clean(filename)]
+	if !ok {
+		return nil
+	}
+	return s.closeFile(e)
+}
+
+// Runs fn with writes held off, if filename (relative to Root) has stayed
+// closed since CloseFile. Returns errFileChanged if the sink has opened it
+// again.
+func (s *FileSink) whileClosed(filename string, fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[filepath.Clean(filename)]; ok {
+		return errFileChanged
+	}
+	return fn()
+}
+
+// Writes all pending content to the open files, and saves the Catalog.
+func (s *FileSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.commit(); err != nil {
+		return err
+	}
+	if s.Catalog != nil {
+		return s.Catalog.Save()
+	}
+	return nil
+}
+
+// Flushes and closes every open file.
+func (s *FileSink) Close() error {
+	if s.stopSync != nil {
+		close(s.stopSync)
+		s.stopSync = nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for s.lru.Len() > 0 {
+		if closeErr := s.closeFile(s.lru.Back()); closeErr != nil {
+			err = closeErr
+		}
+	}
+	if s.journal != nil {
+		if closeErr := s.journal.Close(); closeErr != nil {
+			err = fmt.Errorf("failed to close journal: %v", closeErr)
+		}
+		s.journal = nil
+	}
+	if s.Catalog != nil {
+		if saveErr := s.Catalog.Save(); saveErr != nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+// Message handler for ServeStructGob.
+func (s *FileSink) Handle(d interface{}) error {
+	job, ok := d.(FileWriteJob)
+	if !ok {
+		return fmt.Errorf("file sink received unexpected message: %T", d)
+	}
+	return s.Write(job)
+}
+
+// Writes jobs received on l until it is closed. Per-job errors go to onError.
+func (s *FileSink) Serve(l TransportListener, onError func(error)) error {
+	return ServeStructGob(l, s.Handle, onError)
+}
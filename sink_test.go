@@ -0,0 +1,107 @@
+package operadatatypes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSinkCsvHeaders(t *testing.T) {
+	root := t.TempDir()
+	for _, content := range []string{"1,a", "2,b"} {
+		// A fresh sink each time, as after a daemon restart
+		sink := NewFileSink(root, 0)
+		if err := sink.Write(&CsvFileWriteJob{Filename: "test.csv", Headers: "unix,label", Content: content}); err != nil {
+			t.Errorf("sink.Write(): %v", err)
+			return
+		}
+		if err := sink.Close(); err != nil {
+			t.Errorf("sink.Close(): %v", err)
+			return
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(root, "test.csv"))
+	if err != nil {
+		t.Errorf("failed to read sink output: %v", err)
+		return
+	}
+	if expected := "unix,label\n1,a\n2,b\n"; string(b) != expected {
+		t.Errorf("sink wrote %q, expected %q", b, expected)
+	}
+}
+
+func TestFileSinkLru(t *testing.T) {
+	root := t.TempDir()
+	sink := NewFileSink(root, 1)
+	for _, job := range []FileWriteJob{
+		BinaryFileWriteJob{Filename: "a.raw", Content: []byte{1}},
+		BinaryFileWriteJob{Filename: "b.raw", Content: []byte{2}},
+		BinaryFileWriteJob{Filename: "a.raw", Content: []byte{3}},
+	} {
+		if err := sink.Write(job); err != nil {
+			t.Errorf("sink.Write(%v): %v", job, err)
+			return
+		}
+		if n := sink.lru.Len(); n != 1 {
+			t.Errorf("sink has %d files open, expected at most 1", n)
+		}
+	}
+	sink.Close()
+
+	for name, expected := range map[string]string{"a.raw": "\x01\x03", "b.raw": "\x02"} {
+		b, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Errorf("failed to read sink output: %v", err)
+		} else if string(b) != expected {
+			t.Errorf("sink wrote %q to %s, expected %q", b, name, expected)
+		}
+	}
+}
+
+func TestFileSinkRejectsEscapingNames(t *testing.T) {
+	sink := NewFileSink(t.TempDir(), 0)
+	defer sink.Close()
+	if err := sink.Write(BinaryFileWriteJob{Filename: "../escape.raw"}); err == nil {
+		t.Errorf("expected an error for a file name outside the sink root")
+	}
+}
+
+func TestFileSinkHeaderChange(t *testing.T) {
+	root := t.TempDir()
+	sink := NewFileSink(root, 0)
+	changes := 0
+	sink.OnHeaderChange = func(filename, versionedFilename, oldHeaders, newHeaders string) {
+		changes++
+		if versionedFilename != "OPERA_x_Output_20261018_v2.csv" {
+			t.Errorf("rows redirected to '%s', expected a _v2 file", versionedFilename)
+		}
+	}
+	for _, job := range []*CsvFileWriteJob{
+		{Filename: "OPERA_x_Output_20261018.csv", Headers: "unix,a", Content: "1,a"},
+		{Filename: "OPERA_x_Output_20261018.csv", Headers: "unix,a,b", Content: "2,a,b"},
+		{Filename: "OPERA_x_Output_20261018.csv", Headers: "unix,a,b", Content: "3,a,b"},
+		{Filename: "OPERA_x_Output_20261018.csv", Headers: "unix,a", Content: "4,a"},
+	} {
+		if err := sink.Write(job); err != nil {
+			t.Errorf("sink.Write(): %v", err)
+			return
+		}
+	}
+	sink.Close()
+
+	if changes != 1 {
+		t.Errorf("OnHeaderChange called %d times, expected 1", changes)
+	}
+	for name, expected := range map[string]string{
+		"OPERA_x_Output_20261018.csv":    "unix,a\n1,a\n4,a\n",
+		"OPERA_x_Output_20261018_v2.csv": "unix,a,b\n2,a,b\n3,a,b\n",
+	} {
+		b, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Errorf("failed to read sink output: %v", err)
+		} else if string(b) != expected {
+			t.Errorf("sink wrote %q to %s, expected %q", b, name, expected)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package operadatatypes
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Moves encoded messages between a sender and the receiver listening on an
+// address. Every send opens a new stream carrying exactly one message (or batch).
+type Transport interface {
+	Dial(address string) (io.WriteCloser, error)
+	Listen(address string) (TransportListener, error)
+}
+
+type TransportListener interface {
+	Accept() (io.ReadCloser, error)
+	Close() error
+}
+
+// Transport used by SendGob, SendGobBatch and SendDisplayData. Swap it for a
+// ChannelTransport to run producers and consumers in one process.
+var DefaultTransport Transport = UnixTransport{}
+
+/* Unix Sockets */
+
+type UnixTransport struct{}
+
+func (UnixTransport) Dial(address string) (io.WriteCloser, error) {
+	return net.Dial("unix", address)
+}
+
+func (UnixTransport) Listen(address string) (TransportListener, error) {
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		return nil, err
+	}
+	return unixListener{l}, nil
+}
+
+type unixListener struct {
+	net.Listener
+}
+
+func (l unixListener) Accept() (io.ReadCloser, error) {
+	return l.Listener.Accept()
+}
+
+/* In-Memory Channels */
+
+const DEFAULT_CHANNEL_TRANSPORT_BUFFER = 64
+
+type ChannelTransport struct {
+	BufferSize int
+
+	mu        sync.Mutex
+	listeners map[string]*channelListener
+}
+
+func NewChannelTransport() *ChannelTransport {
+	return &ChannelTransport{
+		BufferSize: DEFAULT_CHANNEL_TRANSPORT_BUFFER,
+		listeners:  map[string]*channelListener{},
+	}
+}
+
+func (t *ChannelTransport) Dial(address string) (io.WriteCloser, error) {
+	t.mu.Lock()
+	l, ok := t.listeners[address]
+	t.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no listener on channel address, %s", address)
+	}
+	return &channelConn{listener: l}, nil
+}
+
+func (t *ChannelTransport) Listen(address string) (TransportListener, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.listeners[address]; ok {
+		return nil, fmt.Errorf("channel address already in use, %s", address)
+	}
+	l := &channelListener{
+		transport: t,
+		address:   address,
+		frames:    make(chan []byte, t.BufferSize),
+		done:      make(chan struct{}),
+	}
+	t.listeners[address] = l
+	return l, nil
+}
+
+type channelListener struct {
+	transport *ChannelTransport
+	address   string
+	frames    chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *channelListener) Accept() (io.ReadCloser, error) {
+	select {
+	case frame := <-l.frames:
+		return io.NopCloser(bytes.NewReader(frame)), nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *channelListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.transport.mu.Lock()
+		delete(l.transport.listeners, l.address)
+		l.transport.mu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+// Buffers one message and hands it to the listener on Close, which is when a
+// unix socket receiver would see EOF.
+type channelConn struct {
+	listener *channelListener
+	buf      bytes.Buffer
+	closed   bool
+}
+
+func (c *channelConn) Write(p []byte) (int, error) {
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	return c.buf.Write(p)
+}
+
+func (c *channelConn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	select {
+	case c.listener.frames <- c.buf.Bytes():
+		return nil
+	case <-c.listener.done:
+		return fmt.Errorf("listener on channel address closed, %s", c.listener.address)
+	}
+}
+
+/* Receiving */
+
+// Accepts messages from l until it is closed, calling handler once per record.
+// Errors from a single message are passed to onError (if set) and do not stop
+// the loop.
+func ServeStructGob(l TransportListener, handler func(interface{}) error, onError func(error)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		err = HandleStructGob(conn, handler)
+		conn.Close()
+		if err != nil && err != io.EOF && onError != nil {
+			onError(err)
+		}
+	}
+}
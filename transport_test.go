@@ -0,0 +1,70 @@
+package operadatatypes
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func checkTransportDelivers(t *testing.T, transport Transport, address string) {
+	original := DefaultTransport
+	DefaultTransport = transport
+	defer func() { DefaultTransport = original }()
+
+	l, err := transport.Listen(address)
+	if err != nil {
+		t.Errorf("transport.Listen(%s): %v", address, err)
+		return
+	}
+	received := make(chan interface{}, 8)
+	go ServeStructGob(l, func(d interface{}) error {
+		received <- d
+		return nil
+	}, nil)
+	defer l.Close()
+
+	if err := (&Sps30Data{Pm2p5: 3.5}).SendGob(address); err != nil {
+		t.Errorf("SendGob(): %v", err)
+		return
+	}
+	job := CsvFileWriteJob{Filename: "a.csv", Headers: "unix", Content: "12"}
+	if err := job.SendGob(address); err != nil {
+		t.Errorf("SendGob(): %v", err)
+		return
+	}
+
+	for _, check := range []func(interface{}) bool{
+		func(d interface{}) bool { s, ok := d.(*Sps30Data); return ok && s.Pm2p5 == 3.5 },
+		func(d interface{}) bool { c, ok := d.(*CsvFileWriteJob); return ok && *c == job },
+	} {
+		select {
+		case d := <-received:
+			if !check(d) {
+				t.Errorf("received unexpected message over %T: %v", transport, d)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("timed out waiting for message over %T", transport)
+			return
+		}
+	}
+}
+
+func TestUnixTransport(t *testing.T) {
+	checkTransportDelivers(t, UnixTransport{}, filepath.Join(t.TempDir(), "transport.sock"))
+}
+
+func TestChannelTransport(t *testing.T) {
+	checkTransportDelivers(t, NewChannelTransport(), MAIN_SD_UNIX_SOCKET)
+}
+
+func TestChannelTransportNoListener(t *testing.T) {
+	transport := NewChannelTransport()
+	if _, err := transport.Dial(MAIN_SD_UNIX_SOCKET); err == nil {
+		t.Errorf("expected an error dialing an address nobody listens on")
+	}
+	l, _ := transport.Listen(MAIN_SD_UNIX_SOCKET)
+	l.Close()
+	if _, err := transport.Dial(MAIN_SD_UNIX_SOCKET); err == nil {
+		t.Errorf("expected an error dialing a closed listener")
+	}
+}
@@ -5,19 +5,22 @@ import "math"
 func RemoveNaN(m map[string]interface{}) {
 	keysToRemove := []string{}
 	for k, v := range m {
-		switch rv := v.(type) {
-		case float32:
-			if math.IsNaN(float64(rv)) {
-				keysToRemove = append(keysToRemove, k)
-			}
-		case float64:
-			if math.IsNaN(rv) {
-				keysToRemove = append(keysToRemove, k)
-			}
-		default:
+		if isNaN(v) {
+			keysToRemove = append(keysToRemove, k)
 		}
 	}
 	for _, k := range keysToRemove {
 		delete(m, k)
 	}
 }
+
+func isNaN(v interface{}) bool {
+	switch rv := v.(type) {
+	case float32:
+		return math.IsNaN(float64(rv))
+	case float64:
+		return math.IsNaN(rv)
+	default:
+		return false
+	}
+}
@@ -2,6 +2,7 @@ package operadatatypes
 
 import (
 	"fmt"
+	"strings"
 )
 
 const (
@@ -10,6 +11,8 @@ const (
 
 	DATA_TYPE_CSV_FILE = "C"
 	DATA_TYPE_BIN_FILE = "B"
+	DATA_TYPE_CSV_ROWS = "W"
+	DATA_TYPE_JSONL    = "J"
 )
 
 type FileWriteJob interface {
@@ -52,3 +55,74 @@ func (b BinaryFileWriteJob) FileName() string {
 func (b BinaryFileWriteJob) SendGob(unixSocketPath string) error {
 	return sendStructGob(b, DATA_TYPE_BIN_FILE, unixSocketPath)
 }
+
+// Several rows for one CSV file, written together.
+type CsvRowsFileWriteJob struct {
+	Filename string
+	Headers  string
+	Rows     []string
+}
+
+func (c CsvRowsFileWriteJob) String() string {
+	return fmt.Sprintf("[File: %s, Headers: %s, Rows: %d]", c.Filename, c.Headers, len(c.Rows))
+}
+
+func (c CsvRowsFileWriteJob) FileName() string {
+	return c.Filename
+}
+
+func (c CsvRowsFileWriteJob) SendGob(unixSocketPath string) error {
+	return sendStructGob(c, DATA_TYPE_CSV_ROWS, unixSocketPath)
+}
+
+// Returns the rows as they appear in the file, each newline terminated.
+func (c CsvRowsFileWriteJob) content() string {
+	var sb strings.Builder
+	for _, row := range c.Rows {
+		sb.WriteString(row)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// JSON Lines for one file, each a JSON object without its newline.
+type JsonlFileWriteJob struct {
+	Filename string
+	Lines    []string
+}
+
+func (j JsonlFileWriteJob) String() string {
+	return fmt.Sprintf("[File: %s, Lines: %d]", j.Filename, len(j.Lines))
+}
+
+func (j JsonlFileWriteJob) FileName() string {
+	return j.Filename
+}
+
+func (j JsonlFileWriteJob) SendGob(unixSocketPath string) error {
+	return sendStructGob(j, DATA_TYPE_JSONL, unixSocketPath)
+}
+
+// Returns the lines as they appear in the file, each newline terminated.
+func (j JsonlFileWriteJob) content() string {
+	var sb strings.Builder
+	for _, line := range j.Lines {
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// Merges consecutive jobs for the same file and headers, such as the rows of
+// PrimaryData.CsvFileWriteJob, into one job each.
+func NewCsvRowsFileWriteJobs(jobs []CsvFileWriteJob) []CsvRowsFileWriteJob {
+	ret := []CsvRowsFileWriteJob{}
+	for _, job := range jobs {
+		if n := len(ret); n > 0 && ret[n-1].Filename == job.Filename && ret[n-1].Headers == job.Headers {
+			ret[n-1].Rows = append(ret[n-1].Rows, job.Content)
+			continue
+		}
+		ret = append(ret, CsvRowsFileWriteJob{Filename: job.Filename, Headers: job.Headers, Rows: []string{job.Content}})
+	}
+	return ret
+}